@@ -0,0 +1,159 @@
+package abuse
+
+import (
+	"encoding/json"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exporter"
+	"github.com/ozonru/accesslog-exporter/exposer"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestAbuse(t *testing.T) { TestingT(t) }
+
+type AbuseSuite struct{}
+
+var _ = Suite(&AbuseSuite{})
+
+// newDetector creates detector of rules counting events to returned gatherer, the clock is set to now
+func newDetector(c *C, now *time.Time, rules ...*config.AbuseRule) (*Detector, prometheus.Gatherer) {
+	counter, gatherer, err := exposer.NewDummyCounter(exposer.AbuseEventsTotal, exposer.MetricsOptions{})
+	c.Assert(err, IsNil)
+
+	detector, err := NewDetector(rules, counter)
+	c.Assert(err, IsNil)
+	detector.now = func() time.Time { return *now }
+
+	return detector, gatherer
+}
+
+func (s AbuseSuite) TestClientKey(c *C) {
+	ipv4 := &exporter.Request{ClientIP: stdnet.ParseIP("10.1.2.3").To4(), UserAgent: "curl/8.0"}
+	ipv6 := &exporter.Request{ClientIP: stdnet.ParseIP("2001:db8:1:2:3::4"), UserAgent: "-"}
+
+	c.Assert(clientKey(config.AbuseKeyIP, ipv4), Equals, "10.1.2.3")
+	c.Assert(clientKey(config.AbuseKeyPrefix, ipv4), Equals, "10.1.2.0/24")
+	c.Assert(clientKey(config.AbuseKeyUserAgent, ipv4), Equals, "d0580b7162cacf62")
+
+	c.Assert(clientKey(config.AbuseKeyIP, ipv6), Equals, "2001:db8:1:2:3::4")
+	c.Assert(clientKey(config.AbuseKeyPrefix, ipv6), Equals, "2001:db8:1:2::/64")
+	c.Assert(clientKey(config.AbuseKeyUserAgent, ipv6), Equals, "")
+
+	// client without address is not identified
+	c.Assert(clientKey(config.AbuseKeyIP, &exporter.Request{}), Equals, "")
+	c.Assert(clientKey(config.AbuseKeyPrefix, &exporter.Request{}), Equals, "")
+}
+
+func (s AbuseSuite) TestObserveRequest(c *C) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rule := &config.AbuseRule{
+		Name:      "login",
+		Key:       config.AbuseKeyIP,
+		URIs:      []string{"login"},
+		Methods:   []string{"POST"},
+		Window:    time.Minute,
+		Threshold: 3,
+		MaxKeys:   10,
+	}
+	detector, gatherer := newDetector(c, &now, rule)
+
+	login := &exporter.Request{URI: "login", Method: "POST", ClientIP: stdnet.ParseIP("10.0.0.1").To4()}
+	other := &exporter.Request{URI: "login", Method: "GET", ClientIP: stdnet.ParseIP("10.0.0.1").To4()}
+
+	for i := 0; i < 3; i++ {
+		detector.ObserveRequest(login)
+		detector.ObserveRequest(other)
+	}
+	c.Assert(detector.Offenders(), HasLen, 0)
+
+	// event is counted once, when client exceeds threshold
+	detector.ObserveRequest(login)
+	detector.ObserveRequest(login)
+	c.Assert(events(c, gatherer), DeepEquals, map[string]float64{"login": 1})
+	c.Assert(detector.Offenders(), DeepEquals, []Offender{
+		{Rule: "login", Key: "10.0.0.1", Requests: 5, Since: now, LastSeen: now},
+	})
+
+	// requests of the previous window are weighted by overlap with sliding window
+	now = now.Add(75 * time.Second)
+	offenders := detector.Offenders()
+	c.Assert(offenders, HasLen, 1)
+	c.Assert(offenders[0].Requests, Equals, 3.75)
+
+	// client is not an offender, when its requests fall below threshold, and it could be counted again
+	now = now.Add(15 * time.Second)
+	c.Assert(detector.Offenders(), HasLen, 0)
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		detector.ObserveRequest(login)
+	}
+	c.Assert(events(c, gatherer), DeepEquals, map[string]float64{"login": 2})
+}
+
+func (s AbuseSuite) TestMaxKeys(c *C) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	detector, _ := newDetector(c, &now, &config.AbuseRule{
+		Name:      "scrapers",
+		Key:       config.AbuseKeyPrefix,
+		Window:    time.Minute,
+		Threshold: 1,
+		MaxKeys:   2,
+	})
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.1.2"} {
+		detector.ObserveRequest(&exporter.Request{ClientIP: stdnet.ParseIP(ip).To4()})
+	}
+	c.Assert(detector.Offenders(), DeepEquals, []Offender{
+		{Rule: "scrapers", Key: "10.0.0.0/24", Requests: 2, Since: now, LastSeen: now},
+		{Rule: "scrapers", Key: "10.0.1.0/24", Requests: 2, Since: now, LastSeen: now},
+	})
+
+	// the least recently seen client is forgotten with its offense
+	detector.ObserveRequest(&exporter.Request{ClientIP: stdnet.ParseIP("10.0.2.1").To4()})
+	offenders := detector.Offenders()
+	c.Assert(offenders, HasLen, 1)
+	c.Assert(offenders[0].Key, Equals, "10.0.1.0/24")
+}
+
+func (s AbuseSuite) TestServeHTTP(c *C) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	detector, _ := newDetector(c, &now, &config.AbuseRule{
+		Name:      "bots",
+		Key:       config.AbuseKeyUserAgent,
+		Window:    time.Minute,
+		Threshold: 1,
+		MaxKeys:   10,
+	})
+	detector.ObserveRequest(&exporter.Request{UserAgent: "curl/8.0"})
+	detector.ObserveRequest(&exporter.Request{UserAgent: "curl/8.0"})
+
+	recorder := httptest.NewRecorder()
+	detector.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/abuse", nil))
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), Equals, "application/json")
+
+	var response struct {
+		Offenders []Offender `json:"offenders"`
+	}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Offenders, DeepEquals, []Offender{
+		{Rule: "bots", Key: "d0580b7162cacf62", UserAgent: "curl/8.0", Requests: 2, Since: now, LastSeen: now},
+	})
+}
+
+// events returns values of abuse events counter by rule
+func events(c *C, gatherer prometheus.Gatherer) map[string]float64 {
+	values, err := exposer.GatherValues(gatherer, exposer.AbuseEventsTotal)
+	c.Assert(err, IsNil)
+
+	return values
+}
@@ -0,0 +1,282 @@
+package abuse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	stdnet "net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exporter"
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// ipv4PrefixLength and ipv6PrefixLength are lengths of prefixes of clients identified by prefix
+	ipv4PrefixLength = 24
+	ipv6PrefixLength = 64
+)
+
+// Offender is a client exceeding threshold of rule
+type Offender struct {
+	Rule string `json:"rule"`
+	Key  string `json:"key"`
+	// UserAgent is a user agent of client identified by hash of user agent
+	UserAgent string `json:"user_agent,omitempty"`
+	// Requests is an estimated number of requests in sliding window
+	Requests float64   `json:"requests"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Detector counts requests of clients by rules in sliding windows and detects clients exceeding thresholds
+type Detector struct {
+	trackers []*tracker
+	counter  *exposer.Counter
+
+	// now is the clock of request windows and offender timestamps, tests set it to move windows deterministically
+	now func() time.Time
+}
+
+// NewDetector creates detector of rules, exceeding of threshold is counted by counter with rule label
+func NewDetector(rules []*config.AbuseRule, counter *exposer.Counter) (*Detector, error) {
+	d := &Detector{counter: counter, now: time.Now}
+	for _, rule := range rules {
+		t, err := newTracker(rule)
+		if err != nil {
+			return nil, fmt.Errorf("could not create tracker of abuse rule %q: %s", rule.Name, err)
+		}
+		d.trackers = append(d.trackers, t)
+	}
+
+	return d, nil
+}
+
+// ObserveRequest counts request for clients of rules selecting it. Requests without client key, for example
+// with invalid client address, are not counted.
+func (d *Detector) ObserveRequest(request *exporter.Request) {
+	now := d.now()
+
+	for _, t := range d.trackers {
+		if !t.rule.Matches(request.Host, request.URI, request.Method) {
+			continue
+		}
+
+		key := clientKey(t.rule.Key, request)
+		if key == "" {
+			continue
+		}
+
+		offender, exceeded := t.add(key, request.UserAgent, now)
+		if !exceeded {
+			continue
+		}
+
+		d.counter.Inc(t.rule.Name)
+
+		if t.rule.LogOffenders {
+			logging.WithContext(context.Background()).Sugar().With(
+				"key", offender.Key,
+				"user_agent", request.UserAgent,
+				"requests", offender.Requests,
+				"host", request.Host,
+				"uri", request.URI,
+			).Warnf("client exceeded threshold of abuse rule %q", t.rule.Name)
+		}
+	}
+}
+
+// Offenders returns clients exceeding thresholds sorted by rule and number of requests
+func (d *Detector) Offenders() []Offender {
+	now := d.now()
+
+	offenders := make([]Offender, 0)
+	for _, t := range d.trackers {
+		offenders = append(offenders, t.offenders(now)...)
+	}
+
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Rule != offenders[j].Rule {
+			return offenders[i].Rule < offenders[j].Rule
+		}
+		if offenders[i].Requests != offenders[j].Requests {
+			return offenders[i].Requests > offenders[j].Requests
+		}
+
+		return offenders[i].Key < offenders[j].Key
+	})
+
+	return offenders
+}
+
+// ServeHTTP serves current offenders as JSON
+func (d *Detector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Offenders []Offender `json:"offenders"`
+	}{
+		Offenders: d.Offenders(),
+	})
+}
+
+// clientKey returns key of client of request by type of key, empty key is returned if client could not be identified
+func clientKey(keyType string, request *exporter.Request) string {
+	switch keyType {
+	case config.AbuseKeyIP:
+		if request.ClientIP != nil {
+			return request.ClientIP.String()
+		}
+	case config.AbuseKeyPrefix:
+		if ip := request.ClientIP.To4(); ip != nil {
+			return fmt.Sprintf("%s/%d", ip.Mask(stdnet.CIDRMask(ipv4PrefixLength, 32)), ipv4PrefixLength)
+		}
+		if ip := request.ClientIP.To16(); ip != nil {
+			return fmt.Sprintf("%s/%d", ip.Mask(stdnet.CIDRMask(ipv6PrefixLength, 128)), ipv6PrefixLength)
+		}
+	case config.AbuseKeyUserAgent:
+		if request.UserAgent != "" && request.UserAgent != "-" {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(request.UserAgent))
+
+			return fmt.Sprintf("%016x", h.Sum64())
+		}
+	}
+
+	return ""
+}
+
+// tracker counts requests of clients of rule, the least recently seen clients are forgotten, when number
+// of clients exceeds limit of rule
+type tracker struct {
+	rule *config.AbuseRule
+
+	mu        sync.Mutex
+	clients   *simplelru.LRU
+	offending map[string]*client
+}
+
+// newTracker creates tracker of rule
+func newTracker(rule *config.AbuseRule) (*tracker, error) {
+	t := &tracker{rule: rule, offending: make(map[string]*client)}
+
+	clients, err := simplelru.NewLRU(rule.MaxKeys, func(key interface{}, _ interface{}) {
+		delete(t.offending, key.(string))
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.clients = clients
+
+	return t, nil
+}
+
+// add counts request of client and returns offender, if client has just exceeded threshold
+func (t *tracker) add(key, userAgent string, now time.Time) (Offender, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var c *client
+	if value, ok := t.clients.Get(key); ok {
+		c = value.(*client)
+	} else {
+		c = &client{}
+		t.clients.Add(key, c)
+	}
+
+	c.advance(now, t.rule.Window)
+	c.current++
+	c.lastSeen = now
+
+	requests := c.estimate(now, t.rule.Window)
+	switch exceeded := requests > float64(t.rule.Threshold); {
+	case exceeded && !c.offending:
+		c.offending, c.since = true, now
+		if t.rule.Key == config.AbuseKeyUserAgent {
+			c.userAgent = userAgent
+		}
+		t.offending[key] = c
+
+		return c.offender(t.rule.Name, key, requests), true
+	case !exceeded && c.offending:
+		c.offending, c.userAgent = false, ""
+		delete(t.offending, key)
+	}
+
+	return Offender{}, false
+}
+
+// offenders returns clients, that still exceed threshold, clients below it are not offending anymore
+func (t *tracker) offenders(now time.Time) []Offender {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offenders := make([]Offender, 0, len(t.offending))
+	for key, c := range t.offending {
+		c.advance(now, t.rule.Window)
+
+		requests := c.estimate(now, t.rule.Window)
+		if requests <= float64(t.rule.Threshold) {
+			c.offending, c.userAgent = false, ""
+			delete(t.offending, key)
+
+			continue
+		}
+
+		offenders = append(offenders, c.offender(t.rule.Name, key, requests))
+	}
+
+	return offenders
+}
+
+// client counts requests in the current and the previous fixed windows. Requests of sliding window are
+// estimated as requests of the current window and requests of the previous one weighted by their overlap.
+type client struct {
+	start             time.Time
+	previous, current float64
+
+	offending       bool
+	since, lastSeen time.Time
+	userAgent       string
+}
+
+// advance moves the current fixed window to the one containing now
+func (c *client) advance(now time.Time, window time.Duration) {
+	start := now.Truncate(window)
+
+	switch {
+	case start.Equal(c.start):
+		return
+	case start.Sub(c.start) == window:
+		c.previous, c.current = c.current, 0
+	default:
+		c.previous, c.current = 0, 0
+	}
+	c.start = start
+}
+
+// estimate returns estimated number of requests in sliding window ending at now
+func (c *client) estimate(now time.Time, window time.Duration) float64 {
+	overlap := 1 - float64(now.Sub(c.start))/float64(window)
+
+	return c.previous*overlap + c.current
+}
+
+// offender returns client as offender of rule
+func (c *client) offender(rule, key string, requests float64) Offender {
+	return Offender{
+		Rule:      rule,
+		Key:       key,
+		UserAgent: c.userAgent,
+		Requests:  requests,
+		Since:     c.since,
+		LastSeen:  c.lastSeen,
+	}
+}
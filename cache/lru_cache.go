@@ -38,3 +38,8 @@ func (c *LRUCache) Get(key string) (map[string]string, bool) {
 func (c *LRUCache) Len() int {
 	return c.Cache.Len()
 }
+
+// Purge removes all values from cache
+func (c *LRUCache) Purge() {
+	c.Cache.Purge()
+}
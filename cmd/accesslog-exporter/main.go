@@ -8,30 +8,44 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/ozonru/accesslog-exporter/abuse"
 	"github.com/ozonru/accesslog-exporter/cache"
 	"github.com/ozonru/accesslog-exporter/config"
 	"github.com/ozonru/accesslog-exporter/exporter"
 	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/geoip"
+	"github.com/ozonru/accesslog-exporter/hll"
 	"github.com/ozonru/accesslog-exporter/input"
 	"github.com/ozonru/accesslog-exporter/parser"
 	"github.com/ozonru/accesslog-exporter/pkg/logging"
+	"github.com/ozonru/accesslog-exporter/sampling"
+	"github.com/ozonru/accesslog-exporter/tap"
+	"github.com/ozonru/accesslog-exporter/topk"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
+	defaultConfigPath    = "etc/config.yaml"
+	defaultRegexPath     = "etc/regexes.yaml"
 	defaultWebAddress    = ":9032"
 	defaultSyslogAddress = ":9033"
 )
 
 var (
-	configPath          = flag.String("config.path", "etc/config.yaml", "Exporter configuration file path.")
-	regexPath           = flag.String("ua-regex.path", "etc/regexes.yaml", "User agent regexes file path.")
+	configPath          = flag.String("config.path", defaultConfigPath, "Exporter configuration file path.")
+	regexPath           = flag.String("ua-regex.path", defaultRegexPath, "User agent regexes file path.")
 	webListenAddress    = flag.String("web.addr", defaultWebAddress, "Address on which to expose metrics and web interface.")
 	syslogListenAddress = flag.String("syslog.addr", defaultSyslogAddress, "Listen address of syslog server.")
 )
 
 func main() {
+	// subcommands have their own flags
+	if len(os.Args) > 1 && os.Args[1] == testFormatCommand {
+		os.Exit(testFormat(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(logging.NewContext(context.Background()))
@@ -56,16 +70,207 @@ func main() {
 		logger.Sugar().Fatalf("could not initialize cache: %s", err)
 	}
 
+	var geoResolver geoip.Resolver
+	if cfg.Global.GeoIP != nil {
+		mmdbResolver, err := geoip.NewMMDBResolver(
+			cfg.Global.GeoIP.CountryDatabasePath,
+			cfg.Global.GeoIP.ASNDatabasePath,
+			cfg.Global.GeoIP.CacheSize,
+		)
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize geoip resolver: %s", err)
+		}
+		defer mmdbResolver.Close()
+
+		go mmdbResolver.Run(ctx, cfg.Global.GeoIP.ReloadInterval)
+
+		geoResolver = mmdbResolver
+	}
+
+	// register metrics and sinks
+	registry := exposer.NewRegistry()
+	if err := registry.Subscribe(exposer.NewPromSink(prometheus.DefaultRegisterer, cfg.Global.Namespace)); err != nil {
+		logger.Sugar().Fatalf("could not subscribe prometheus sink: %s", err)
+	}
+
+	if cfg.Global.StatsD != nil {
+		statsDSink, err := exposer.NewStatsDSink(
+			cfg.Global.StatsD.Address,
+			cfg.Global.StatsD.Prefix,
+			cfg.Global.StatsD.DogStatsDTags,
+			cfg.Global.StatsD.SampleRates,
+			cfg.Global.StatsD.PacketSize,
+		)
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize statsd sink: %s", err)
+		}
+		defer statsDSink.Close()
+
+		if err := registry.Subscribe(statsDSink); err != nil {
+			logger.Sugar().Fatalf("could not subscribe statsd sink: %s", err)
+		}
+
+		go statsDSink.Run(ctx, cfg.Global.StatsD.FlushInterval)
+	}
+
+	if err := exposer.RegisterMetrics(registry, metricsOptions(cfg)); err != nil {
+		logger.Sugar().Fatalf("could not register metrics: %s", err)
+	}
+
+	if influx := cfg.Global.Influx; influx != nil {
+		influxSink, err := exposer.NewInfluxSink(influx.Address, influx.Prefix, influx.PacketSize, influx.Timeout)
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize influx sink: %s", err)
+		}
+		defer influxSink.Close()
+
+		if err := registry.Subscribe(influxSink); err != nil {
+			logger.Sugar().Fatalf("could not subscribe influx sink: %s", err)
+		}
+
+		go influxSink.Run(ctx, influx.FlushInterval)
+	}
+
+	if graphite := cfg.Global.Graphite; graphite != nil {
+		graphiteSink := exposer.NewGraphiteSink(graphite.Address, graphite.Prefix, graphite.Tags, graphite.Templates, graphite.Timeout)
+		defer graphiteSink.Close()
+
+		if err := registry.Subscribe(graphiteSink); err != nil {
+			logger.Sugar().Fatalf("could not subscribe graphite sink: %s", err)
+		}
+
+		go graphiteSink.Run(ctx, graphite.FlushInterval)
+	}
+
+	if rw := cfg.Global.RemoteWrite; rw != nil {
+		opts := exposer.RemoteWriteOptions{
+			URL:            rw.URL,
+			ExternalLabels: rw.ExternalLabels,
+			BearerToken:    rw.BearerToken,
+			Timeout:        rw.Timeout,
+			MaxRetries:     *rw.MaxRetries,
+			MinBackoff:     rw.MinBackoff,
+			MaxBackoff:     rw.MaxBackoff,
+			BufferSize:     rw.BufferSize,
+		}
+		if rw.BasicAuth != nil {
+			opts.Username, opts.Password = rw.BasicAuth.Username, rw.BasicAuth.Password
+		}
+
+		go exposer.NewRemoteWriter(prometheus.DefaultGatherer, opts).Run(ctx, rw.Interval)
+	}
+
+	if otlp := cfg.Global.OTLP; otlp != nil {
+		otlpExporter, err := exposer.NewOTLPExporter(prometheus.DefaultGatherer, exposer.OTLPOptions{
+			Endpoint:    otlp.Endpoint,
+			Protocol:    otlp.Protocol,
+			Insecure:    otlp.Insecure,
+			Headers:     otlp.Headers,
+			Timeout:     otlp.Timeout,
+			ServiceName: otlp.ServiceName,
+			HostName:    otlp.HostName,
+		})
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize otlp exporter: %s", err)
+		}
+		defer otlpExporter.Close()
+
+		go otlpExporter.Run(ctx, otlp.Interval)
+	}
+
+	var observers []interface{}
+	if topK := cfg.Global.TopK; topK != nil {
+		dimensions := make([]topk.Dimension, 0, len(topK.Dimensions))
+		for _, dimension := range topK.Dimensions {
+			dimensions = append(dimensions, topk.Dimension{Name: dimension.Name, Value: dimension.Value})
+		}
+		tracker := topk.NewTracker(dimensions, topK.Capacity, topK.Window)
+
+		var gauge *exposer.Gauge
+		if topK.ExportTop > 0 {
+			if gauge, err = registry.Gauge(exposer.TopKRequests); err != nil {
+				logger.Sugar().Fatalf("could not get top k gauge: %s", err)
+			}
+		}
+
+		go tracker.Run(ctx, gauge, topK.ExportTop)
+
+		http.Handle("/debug/topk", tracker)
+		observers = append(observers, tracker)
+	}
+
+	if uniques := cfg.Global.UniqueVisitors; uniques != nil {
+		dimensions := make([]hll.Dimension, 0, len(uniques.Dimensions))
+		for _, dimension := range uniques.Dimensions {
+			dimensions = append(dimensions, hll.Dimension{Name: dimension.Name, Value: dimension.Value})
+		}
+		tracker, err := hll.NewTracker(uniques.Host, dimensions, uniques.Windows, uniques.Precision, uniques.MaxHosts)
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize unique visitors tracker: %s", err)
+		}
+
+		gauge, err := registry.Gauge(exposer.UniqueVisitors)
+		if err != nil {
+			logger.Sugar().Fatalf("could not get unique visitors gauge: %s", err)
+		}
+
+		go tracker.Run(ctx, gauge)
+
+		http.Handle("/debug/hll", tracker)
+		observers = append(observers, tracker)
+	}
+
+	if len(cfg.Global.AbuseRules) > 0 {
+		counter, err := registry.Counter(exposer.AbuseEventsTotal)
+		if err != nil {
+			logger.Sugar().Fatalf("could not get abuse events counter: %s", err)
+		}
+
+		detector, err := abuse.NewDetector(cfg.Global.AbuseRules, counter)
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize abuse detector: %s", err)
+		}
+
+		http.Handle("/debug/abuse", detector)
+		observers = append(observers, detector)
+	}
+
+	if cfg.Global.Sampling != nil {
+		counter, err := registry.Counter(exposer.SampledLinesTotal)
+		if err != nil {
+			logger.Sugar().Fatalf("could not get sampled lines counter: %s", err)
+		}
+
+		sampler, err := sampling.NewSampler(cfg.Global.Sampling, counter)
+		if err != nil {
+			logger.Sugar().Fatalf("could not initialize sampling log: %s", err)
+		}
+		defer sampler.Close()
+
+		observers = append(observers, sampler)
+	}
+
+	if settings := cfg.Global.Tap; settings != nil {
+		logTap := tap.NewTap(settings.BufferSize, settings.IdleTimeout, settings.MaxSubscribers)
+
+		http.Handle("/debug/tap", logTap)
+		observers = append(observers, logTap)
+	}
+
 	// create exporter
-	exp, err := exporter.NewExporter(cfg, input.NewSyslog(*syslogListenAddress), parser.ParsePipedFormat, uaParser, cc, exposer.PromExposer)
+	exp, err := exporter.NewExporter(cfg, input.NewSyslog(*syslogListenAddress), parser.ParsePipedFormat, uaParser, cc, geoResolver, registry, observers...)
 	if err != nil {
 		logger.Sugar().Fatalf("could not initialize exporter: %s", err)
 	}
 
+	if cfg.Global.ParseErrors.Endpoint {
+		http.Handle("/debug/parse-errors", exp.ParseErrors())
+	}
+
 	// run exporter
 	exp.Run(ctx)
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 
 	go func() {
@@ -82,9 +287,67 @@ func main() {
 		}
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())
+	if !cfg.Global.DisableMetricsEndpoint {
+		// OpenMetrics format is negotiated to expose exemplars
+		http.Handle("/metrics", promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+		))
+	}
 
 	logger.Sugar().Infof("Web listen address: %s", *webListenAddress)
 	logger.Sugar().Infof("Syslog listen address: %s", *syslogListenAddress)
 	logger.Sugar().Fatal(http.ListenAndServe(*webListenAddress, nil))
 }
+
+// metricsOptions makes options of exporter metrics from config
+func metricsOptions(cfg *config.Config) exposer.MetricsOptions {
+	opts := exposer.MetricsOptions{
+		ExtraLabels:  cfg.Global.MetricLabels,
+		Histograms:   make(map[string]exposer.HistogramOpts),
+		SourceLabels: cfg.SourceLabelNames,
+		ConstLabels:  cfg.Global.ConstLabels,
+		DropLabels:   cfg.Global.MetricDropLabels,
+	}
+
+	for name, histogram := range cfg.Global.Histograms {
+		histogramOpts := exposer.HistogramOpts{Buckets: histogram.Buckets}
+
+		switch histogram.Type {
+		case config.HistogramTypeNative:
+			histogramOpts.NativeHistogram = &exposer.NativeHistogramOpts{
+				BucketFactor:     histogram.NativeBucketFactor,
+				MaxBuckets:       histogram.NativeMaxBuckets,
+				MinResetDuration: histogram.NativeMinResetDuration,
+			}
+		case config.HistogramTypeSummary:
+			histogramOpts.Summary = &exposer.SummaryOpts{
+				Objectives: histogram.Objectives,
+				MaxAge:     histogram.MaxAge,
+				AgeBuckets: histogram.AgeBuckets,
+			}
+		}
+
+		opts.Histograms[name] = histogramOpts
+	}
+
+	for _, metric := range cfg.Global.CustomMetrics {
+		desc := exposer.Desc{Name: metric.Name, Help: metric.Help, Labels: metric.LabelNames, Buckets: metric.Buckets}
+		if desc.Help == "" {
+			desc.Help = "Custom metric " + metric.Name
+		}
+
+		switch metric.Type {
+		case config.CustomMetricTypeCounter:
+			desc.Type = exposer.CounterType
+		case config.CustomMetricTypeGauge:
+			desc.Type = exposer.GaugeType
+		case config.CustomMetricTypeHistogram:
+			desc.Type = exposer.HistogramType
+		}
+
+		opts.CustomMetrics = append(opts.CustomMetrics, desc)
+	}
+
+	return opts
+}
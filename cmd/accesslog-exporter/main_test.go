@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ozonru/accesslog-exporter/config"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestTestFormat(t *testing.T) { TestingT(t) }
+
+type TestFormatSuite struct{}
+
+var _ = Suite(&TestFormatSuite{})
+
+const testFormatConfig = `
+global:
+  filters:
+    - name: health_checks
+      variable: $request
+      regex: ^GET /ping
+  relabel_configs:
+    - source_labels: [$http_user_agent]
+      regex: kube-probe.*
+      action: drop
+sources:
+  - host: localhost
+    log_format: $remote_addr | $host | "$request" | $status | $request_time | $http_user_agent
+`
+
+// makeTestFormatConfig loads config from YAML written to temporary file
+func makeTestFormatConfig(c *C, content string) *config.Config {
+	path := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(os.WriteFile(path, []byte(content), 0644), IsNil)
+
+	cfg, err := config.MakeConfigFromFile(path)
+	c.Assert(err, IsNil)
+
+	return cfg
+}
+
+func (s TestFormatSuite) TestTestFormatHost(c *C) {
+	testCases := []struct {
+		sources []config.Source
+		arg     string
+		host    string
+		err     string
+		added   bool
+	}{
+		{
+			sources: []config.Source{{Host: "localhost", LogFormat: "$status"}},
+			arg:     "localhost",
+			host:    "localhost",
+		},
+		{
+			sources: []config.Source{{Host: "localhost", LogFormat: "$status"}},
+			arg:     "backend",
+			err:     `source "backend" is not configured`,
+		},
+		// format doesn't replace format of the only source
+		{
+			sources: []config.Source{{Host: "localhost", LogFormat: "$status"}},
+			arg:     "$status | $request_time",
+			host:    testFormatSource,
+			added:   true,
+		},
+		{
+			sources: []config.Source{{Host: "localhost", LogFormat: "$status"}, {Host: "backend", LogFormat: "$status"}},
+			arg:     "$status | $request_time",
+			host:    testFormatSource,
+			added:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		sources := append([]config.Source{}, tc.sources...)
+		cfg := &config.Config{Sources: sources}
+
+		host, err := testFormatHost(cfg, tc.arg)
+		if tc.err != "" {
+			c.Assert(err, ErrorMatches, tc.err, Commentf("arg %q", tc.arg))
+		} else {
+			c.Assert(err, IsNil, Commentf("arg %q", tc.arg))
+		}
+		c.Assert(host, Equals, tc.host, Commentf("arg %q", tc.arg))
+
+		expected := tc.sources
+		if tc.added {
+			expected = append(append([]config.Source{}, tc.sources...), config.Source{Host: testFormatSource, LogFormat: tc.arg})
+		}
+		c.Assert(cfg.Sources, DeepEquals, expected, Commentf("arg %q", tc.arg))
+	}
+}
+
+func (s TestFormatSuite) TestCheckLine(c *C) {
+	cfg := makeTestFormatConfig(c, testFormatConfig)
+	format := cfg.Sources[0].LogFormat
+
+	exp, recorder, err := newTestFormatExporter(cfg, "../../etc/regexes.yaml")
+	c.Assert(err, IsNil)
+
+	// outputs are matched by patterns of lines
+	testCases := []struct {
+		content  string
+		parsed   bool
+		expected []string
+	}{
+		{
+			content:  `10.0.0.1 | www.site.com | "GET /api HTTP/1.1" | 200 | 0.5 | curl/8.0`,
+			parsed:   true,
+			expected: []string{`  variables:`, `    \$status +"200"`, `  labels:`, `    host +"www.site.com"`, `    client_ip +"10.0.0.1"`},
+		},
+		{
+			content:  `10.0.0.1 | www.site.com | "GET /ping HTTP/1.1" | 200 | 0.5 | curl/8.0`,
+			parsed:   true,
+			expected: []string{`  variables:`, `  dropped by filters: health_checks`},
+		},
+		{
+			content:  `10.0.0.1 | www.site.com | "GET /api HTTP/1.1" | 200 | 0.5 | kube-probe/1.28`,
+			parsed:   true,
+			expected: []string{`  variables:`, `  dropped by relabel configs`},
+		},
+		{
+			content:  `10.0.0.1 | www.site.com | "GET /api HTTP/1.1" | 200 | 0.5`,
+			parsed:   false,
+			expected: []string{`  could not parse: .*format has 6 fields, content has 5`, `  6 +\$http_user_agent +"<missing>" +<- counts diverge here`},
+		},
+	}
+
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		parsed := checkLine(context.Background(), &out, exp, recorder, "localhost", format, tc.content)
+		c.Assert(parsed, Equals, tc.parsed, Commentf("line %q", tc.content))
+
+		for _, expected := range tc.expected {
+			c.Assert(out.String(), Matches, `(?s)(.*\n)?`+expected+`\n.*`, Commentf("line %q", tc.content))
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ozonru/accesslog-exporter/cache"
+	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exporter"
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/filter"
+	"github.com/ozonru/accesslog-exporter/geoip"
+	"github.com/ozonru/accesslog-exporter/input"
+	"github.com/ozonru/accesslog-exporter/parser"
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+)
+
+const (
+	testFormatCommand = "test-format"
+	// testFormatSource is a name of source, which is checked, when format is passed instead of source name
+	testFormatSource = "test-format"
+	maxLineSize      = 1024 * 1024
+)
+
+// lineRecorder records request of processed log line or name of filter, that dropped it. It is subscribed to
+// metrics to read filter of logs_filter_dropped_total.
+type lineRecorder struct {
+	request *exporter.Request
+	filter  string
+}
+
+// ObserveRequest records request of log line, that is not dropped by filters and relabel configs
+func (r *lineRecorder) ObserveRequest(request *exporter.Request) {
+	r.request = request
+}
+
+// Register accepts all metrics, only logs_filter_dropped_total is observed
+func (r *lineRecorder) Register(*exposer.Desc) error {
+	return nil
+}
+
+// Observe records name of filter, that dropped log line, relabel configs are counted as filter "relabel"
+func (r *lineRecorder) Observe(desc *exposer.Desc, labels []string, _ float64) {
+	if desc.Name != exposer.LogsFilterDroppedTotal {
+		return
+	}
+
+	for i, name := range desc.Labels {
+		if name == "filter" {
+			r.filter = labels[i]
+		}
+	}
+}
+
+// testFormat checks log format of source against sample lines read from stdin. It prints variables and labels
+// of parsed lines and alignment of fields of lines, that could not be parsed, and returns exit code.
+func testFormat(args []string) int {
+	flags := flag.NewFlagSet(testFormatCommand, flag.ExitOnError)
+	configPath := flags.String("config.path", defaultConfigPath, "Exporter configuration file path.")
+	regexPath := flags.String("ua-regex.path", defaultRegexPath, "User agent regexes file path.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <source host | log format> < lines.log\n", os.Args[0], testFormatCommand)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+
+		return 2
+	}
+
+	cfg, err := config.MakeConfigFromFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not make config from file: %s\n", err)
+
+		return 2
+	}
+
+	host, err := testFormatHost(cfg, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 2
+	}
+
+	exp, recorder, err := newTestFormatExporter(cfg, *regexPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 2
+	}
+
+	var format string
+	for _, source := range cfg.Sources {
+		if source.Host == host {
+			format = source.LogFormat
+		}
+	}
+
+	ctx := logging.NewContext(context.Background())
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	code, n := 0, 0
+	for scanner.Scan() {
+		content := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		n++
+
+		fmt.Fprintf(out, "line %d: %s\n", n, content)
+		if !checkLine(ctx, out, exp, recorder, host, format, content) {
+			code = 1
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not read log lines: %s\n", err)
+
+		return 2
+	}
+
+	return code
+}
+
+// checkLine prints variables and labels of log line or notes, that it is dropped by filters or relabel configs.
+// It prints alignment of fields and returns false, if line could not be parsed.
+func checkLine(ctx context.Context, out io.Writer, exp *exporter.Exporter, recorder *lineRecorder, host, format, content string) bool {
+	data, err := parser.ParsePipedFormat(format, content)
+	if err != nil {
+		fmt.Fprintf(out, "  could not parse: %s\n", err)
+		printAlignment(out, parser.AlignPipedFormat(format, content))
+
+		return false
+	}
+
+	*recorder = lineRecorder{}
+	exp.Process(ctx, &input.LogLine{NginxHost: host, Content: content})
+
+	printVariables(out, data)
+	switch {
+	case recorder.filter == filter.RelabelName:
+		fmt.Fprintln(out, "  dropped by relabel configs")
+	case recorder.filter != "":
+		fmt.Fprintf(out, "  dropped by filters: %s\n", recorder.filter)
+	default:
+		printLabels(out, recorder.request)
+	}
+
+	return true
+}
+
+// testFormatHost returns host of source to check. Format, that is not a name of source, is checked as a new source,
+// so only global settings are applied to it.
+func testFormatHost(cfg *config.Config, arg string) (string, error) {
+	for _, source := range cfg.Sources {
+		if source.Host == arg {
+			return arg, nil
+		}
+	}
+
+	if !strings.Contains(arg, "$") {
+		return "", fmt.Errorf("source %q is not configured", arg)
+	}
+
+	cfg.Sources = append(cfg.Sources, config.Source{Host: testFormatSource, LogFormat: arg})
+
+	return testFormatSource, nil
+}
+
+// newTestFormatExporter creates exporter with metrics, that are not exposed, and recorder of processed lines
+func newTestFormatExporter(cfg *config.Config, regexPath string) (*exporter.Exporter, *lineRecorder, error) {
+	uaParser, err := parser.NewUAParser(regexPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not initialize user agent parser: %s", err)
+	}
+
+	cc, err := cache.NewLRUCache(cfg.Global.UserAgentCacheSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not initialize cache: %s", err)
+	}
+
+	var geoResolver geoip.Resolver
+	if cfg.Global.GeoIP != nil {
+		geoResolver, err = geoip.NewMMDBResolver(
+			cfg.Global.GeoIP.CountryDatabasePath,
+			cfg.Global.GeoIP.ASNDatabasePath,
+			cfg.Global.GeoIP.CacheSize,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not initialize geoip resolver: %s", err)
+		}
+	}
+
+	recorder := &lineRecorder{}
+
+	registry := exposer.NewRegistry()
+	if err := registry.Subscribe(recorder); err != nil {
+		return nil, nil, fmt.Errorf("could not subscribe to metrics: %s", err)
+	}
+	if err := exposer.RegisterMetrics(registry, metricsOptions(cfg)); err != nil {
+		return nil, nil, fmt.Errorf("could not register metrics: %s", err)
+	}
+
+	exp, err := exporter.NewExporter(cfg, nil, parser.ParsePipedFormat, uaParser, cc, geoResolver, registry, recorder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not initialize exporter: %s", err)
+	}
+
+	return exp, recorder, nil
+}
+
+// printAlignment prints variables of format aligned with values of log line and marks the field, where they diverge
+func printAlignment(out io.Writer, fields []parser.Field) {
+	divergence := parser.Divergence(fields)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  #\tvariable\tvalue")
+	for i, field := range fields {
+		variable, value := field.Variable, field.Value
+		if field.MissingVariable {
+			variable = "<missing>"
+		}
+		if field.MissingValue {
+			value = "<missing>"
+		}
+
+		mark := ""
+		if i == divergence {
+			mark = "<- counts diverge here"
+		}
+
+		fmt.Fprintf(w, "  %d\t%s\t%q\t%s\n", i+1, variable, value, mark)
+	}
+	w.Flush()
+}
+
+// printVariables prints variables of parsed log line sorted by name
+func printVariables(out io.Writer, data map[string]string) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "  variables:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "    %s\t%q\n", name, data[name])
+	}
+	w.Flush()
+}
+
+// printLabels prints labels of request detected by exporter
+func printLabels(out io.Writer, request *exporter.Request) {
+	clientIP := ""
+	if request.ClientIP != nil {
+		clientIP = request.ClientIP.String()
+	}
+
+	fmt.Fprintln(out, "  labels:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, label := range [][2]string{
+		{"nginx_host", request.NginxHost},
+		{"host", request.Host},
+		{"uri", request.URI},
+		{"method", request.Method},
+		{"code", request.Code},
+		{"client_ip", clientIP},
+		{"user_agent", request.UserAgentLabel},
+		{"os", request.OSLabel},
+		{"device", request.DeviceLabel},
+		{"device_type", request.DeviceType},
+	} {
+		fmt.Fprintf(w, "    %s\t%q\n", label[0], label[1])
+	}
+	fmt.Fprintf(w, "    response_time\t%g\n", request.ResponseTime)
+	w.Flush()
+}
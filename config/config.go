@@ -1,21 +1,110 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/expr"
+	"github.com/ozonru/accesslog-exporter/filter"
+	pkgnet "github.com/ozonru/accesslog-exporter/pkg/net"
+	"github.com/ozonru/accesslog-exporter/relabel"
 
 	"gopkg.in/yaml.v2"
 )
 
+var (
+	// defaultClientAbortCodes are nginx codes of connections closed by client(499) or without response(444)
+	defaultClientAbortCodes = []int{499, 444}
+	// defaultUpstreamTimeoutCodes are codes of upstream timeouts
+	defaultUpstreamTimeoutCodes = []int{504}
+
+	// defaultUniqueVisitorsWindows are default rolling windows of unique visitors
+	defaultUniqueVisitorsWindows = []time.Duration{time.Minute, time.Hour}
+	// defaultUniqueVisitorsDimensions are default dimensions of unique visitors
+	defaultUniqueVisitorsDimensions = map[string]string{"ip": "$remote_addr", "user_agent": "$http_user_agent"}
+
+	// defaultSLOSuccessCodes are codes of successful requests of SLO objectives, only server errors are failures
+	defaultSLOSuccessCodes = []string{"1xx", "2xx", "3xx", "4xx"}
+	// successCodeRe matches http codes and classes of codes
+	successCodeRe = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+	// metricNameRe matches valid metric names
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	// labelNameRe matches valid label names
+	labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
 const (
-	defaultUserAgentCacheSize int = 100000
-	defaultExportWorkers      int = 100
+	defaultUserAgentCacheSize int    = 100000
+	defaultExportWorkers      int    = 100
+	defaultNamespace          string = "accesslog"
+
+	defaultGeoIPCacheSize      int           = 100000
+	defaultGeoIPReloadInterval time.Duration = time.Minute
+
+	defaultRealIPHeader = "$http_x_forwarded_for"
+
+	defaultExemplarVariable  = "$request_id"
+	defaultExemplarLabelName = "trace_id"
+
+	defaultStatsDPacketSize    int           = 1432
+	defaultStatsDFlushInterval time.Duration = time.Second
+
+	defaultRemoteWriteInterval   time.Duration = 15 * time.Second
+	defaultRemoteWriteTimeout    time.Duration = 10 * time.Second
+	defaultRemoteWriteMaxRetries int           = 3
+	defaultRemoteWriteMinBackoff time.Duration = 30 * time.Millisecond
+	defaultRemoteWriteMaxBackoff time.Duration = 5 * time.Second
+	defaultRemoteWriteBufferSize int           = 100
+
+	defaultOTLPProtocol string        = "grpc"
+	defaultOTLPInterval time.Duration = 15 * time.Second
+	defaultOTLPTimeout  time.Duration = 10 * time.Second
+
+	defaultNativeHistogramBucketFactor     float64       = 1.1
+	defaultNativeHistogramMaxBuckets       uint32        = 160
+	defaultNativeHistogramMinResetDuration time.Duration = time.Hour
+	defaultSummaryMaxAge                   time.Duration = 10 * time.Minute
+	defaultSummaryAgeBuckets               uint32        = 5
+
+	defaultTopKWindow   time.Duration = time.Minute
+	defaultTopKCapacity int           = 1000
+
+	defaultUniqueVisitorsPrecision uint8 = 12
+	defaultUniqueVisitorsMaxHosts  int   = 100
+
+	hostVariable = "$host"
+
+	defaultAbuseWindow  time.Duration = time.Minute
+	defaultAbuseMaxKeys int           = 10000
+
+	defaultSamplingMaxSizeMB  int     = 100
+	defaultSamplingMaxBackups int     = 3
+	defaultSamplingRateLimit  float64 = 10
+
+	defaultTapBufferSize     int           = 100
+	defaultTapIdleTimeout    time.Duration = time.Minute
+	defaultTapMaxSubscribers int           = 10
+
+	defaultInfluxPacketSize int           = 1432
+	defaultFlushInterval    time.Duration = 10 * time.Second
+	defaultSinkTimeout      time.Duration = 5 * time.Second
 )
 
 // Config contains all config of application
 type Config struct {
 	Global  Global   `yaml:"global"`
 	Sources []Source `yaml:"sources"`
+
+	// compiled settings
+	SourceLabelNames  []string
+	SourceLabelValues map[string][]string
 }
 
 // Global contains global config settings
@@ -37,9 +126,79 @@ type Global struct {
 
 	Hosts []Host `yaml:"hosts"`
 
+	Networks []Network `yaml:"networks"`
+
+	RealIP *RealIP `yaml:"real_ip"`
+	GeoIP  *GeoIP  `yaml:"geoip"`
+	Bots   *Bots   `yaml:"bots"`
+
+	Exemplars *Exemplars `yaml:"exemplars"`
+
+	// Outcome contains settings of outcome label of requests
+	Outcome *Outcome `yaml:"outcome"`
+
+	// ParseErrors contains settings of failed log lines kept for debugging and logging of failures
+	ParseErrors *ParseErrors `yaml:"parse_errors"`
+
+	// TopK contains settings of tracking the most frequent values of dimensions
+	TopK *TopK `yaml:"top_k"`
+
+	// UniqueVisitors contains settings of estimation of distinct values of dimensions by host
+	UniqueVisitors *UniqueVisitors `yaml:"unique_visitors"`
+
+	// SLOObjectives contains objectives of latency and success of requests by host and URI
+	SLOObjectives []*SLOObjective `yaml:"slo_objectives"`
+
+	// AbuseRules contains rules of detection of clients making too many requests
+	AbuseRules []*AbuseRule `yaml:"abuse_rules"`
+
+	// Sampling contains settings of log of slow and failed requests
+	Sampling *Sampling `yaml:"sampling"`
+
+	// Tap contains settings of streaming of parsed log lines, streaming is disabled without them
+	Tap *Tap `yaml:"tap"`
+
+	StatsD      *StatsD      `yaml:"statsd"`
+	RemoteWrite *RemoteWrite `yaml:"remote_write"`
+	OTLP        *OTLP        `yaml:"otlp"`
+	Influx      *Influx      `yaml:"influx"`
+	Graphite    *Graphite    `yaml:"graphite"`
+
+	// DisableMetricsEndpoint disables /metrics endpoint, when metrics are only pushed
+	DisableMetricsEndpoint bool `yaml:"disable_metrics_endpoint"`
+
+	// MetricLabels contains additional labels that are appended to metrics by metric name
+	MetricLabels map[string][]string `yaml:"metric_labels"`
+
+	// Histograms contains representations of response time metrics by metric name
+	Histograms map[string]*Histogram `yaml:"histograms"`
+
+	// Filters drop or keep log lines of all sources before metrics are exposed
+	Filters []*filter.Filter `yaml:"filters"`
+
+	// ComputedLabelsRaw contains expressions over variables of log line by label name, computed labels could be
+	// used in metric_labels and relabel_configs
+	ComputedLabelsRaw map[string]string `yaml:"computed_labels"`
+
+	// CustomMetrics are metrics with labels and values extracted from variables of log line by expressions
+	CustomMetrics []*CustomMetric `yaml:"custom_metrics"`
+
+	// RelabelConfigs are applied to nginx variables and computed labels of request before exposure
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+
+	// Namespace is a prefix of metric names, it is also a default prefix of StatsD, Influx and Graphite metrics
+	Namespace string `yaml:"namespace"`
+	// ConstLabels contains labels that are added to all metrics
+	ConstLabels map[string]string `yaml:"const_labels"`
+	// MetricDropLabels contains labels that are not exposed by metric name
+	MetricDropLabels map[string][]string `yaml:"metric_drop_labels"`
+
 	// compiled settings
 	UserAgentReplacementSettings  []UserAgentReplacementSetting
 	RequestURIReplacementSettings []RequestURIReplacementSetting
+	InternalSubnetsTrie           *pkgnet.Trie
+	NetworksTrie                  *pkgnet.Trie
+	ComputedLabels                []ComputedLabel
 }
 
 // UserAgentReplacementSetting is a set of settings to replace user agent with custom value
@@ -72,6 +231,12 @@ type RequestURIReplacement struct {
 type Source struct {
 	Host      string `yaml:"host"`
 	LogFormat string `yaml:"log_format"`
+
+	// Labels contains static labels that are added to all metrics of source
+	Labels map[string]string `yaml:"labels"`
+
+	// Filters drop or keep log lines of source, they are applied after global filters
+	Filters []*filter.Filter `yaml:"filters"`
 }
 
 // Host contains replacements for host label
@@ -80,6 +245,321 @@ type Host struct {
 	Replacement string `yaml:"replacement"`
 }
 
+// Network is a named group of subnets
+type Network struct {
+	Name           string   `yaml:"name"`
+	Subnets        []string `yaml:"subnets"`
+	ExcludeMetrics []string `yaml:"exclude_metrics"`
+}
+
+// RealIP contains settings of client address detection, when requests are passed through proxies
+type RealIP struct {
+	Header         string   `yaml:"header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Recursive      bool     `yaml:"recursive"`
+
+	// compiled settings
+	TrustedProxyNets []*net.IPNet
+}
+
+// GeoIP contains settings of geo labels resolving using local MaxMind databases
+type GeoIP struct {
+	CountryDatabasePath string        `yaml:"country_database_path"`
+	ASNDatabasePath     string        `yaml:"asn_database_path"`
+	CacheSize           int           `yaml:"cache_size"`
+	ReloadInterval      time.Duration `yaml:"reload_interval"`
+}
+
+// Bots contains settings of bots and crawlers classification
+type Bots struct {
+	UserAgentsRaw           []string `yaml:"user_agents"`
+	MonitoringUserAgentsRaw []string `yaml:"monitoring_user_agents"`
+	VerifiedCrawlersRaw     []struct {
+		Name    string   `yaml:"name"`
+		MatchRe string   `yaml:"match_re"`
+		Subnets []string `yaml:"subnets"`
+	} `yaml:"verified_crawlers"`
+
+	// compiled settings
+	UserAgents           []*regexp.Regexp
+	MonitoringUserAgents []*regexp.Regexp
+	VerifiedCrawlers     []VerifiedCrawler
+}
+
+// StatsD contains settings of StatsD output
+type StatsD struct {
+	// Address is udp://host:port or unix:///path/to/socket
+	Address       string             `yaml:"address"`
+	Prefix        string             `yaml:"prefix"`
+	DogStatsDTags bool               `yaml:"dogstatsd_tags"`
+	SampleRates   map[string]float64 `yaml:"sample_rates"`
+	PacketSize    int                `yaml:"packet_size"`
+	FlushInterval time.Duration      `yaml:"flush_interval"`
+}
+
+// RemoteWrite contains settings of pushing metrics using Prometheus remote write protocol
+type RemoteWrite struct {
+	URL            string            `yaml:"url"`
+	Interval       time.Duration     `yaml:"interval"`
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	BasicAuth      *struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+	BearerToken string        `yaml:"bearer_token"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// MaxRetries is nil if it is not specified, zero disables retries
+	MaxRetries *int          `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	BufferSize int           `yaml:"buffer_size"`
+}
+
+// OTLP contains settings of exporting metrics using OpenTelemetry protocol
+type OTLP struct {
+	// Endpoint is host:port for grpc protocol and URL for http protocol
+	Endpoint    string            `yaml:"endpoint"`
+	Protocol    string            `yaml:"protocol"`
+	Insecure    bool              `yaml:"insecure"`
+	Headers     map[string]string `yaml:"headers"`
+	Interval    time.Duration     `yaml:"interval"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	ServiceName string            `yaml:"service_name"`
+	HostName    string            `yaml:"host_name"`
+}
+
+// Influx contains settings of writing aggregated metrics to InfluxDB
+type Influx struct {
+	// Address is http(s)://host:port/write?db=name or udp://host:port
+	Address       string        `yaml:"address"`
+	Prefix        string        `yaml:"prefix"`
+	PacketSize    int           `yaml:"packet_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// Graphite contains settings of sending aggregated metrics to Graphite
+type Graphite struct {
+	Address       string            `yaml:"address"`
+	Prefix        string            `yaml:"prefix"`
+	Tags          bool              `yaml:"tags"`
+	Templates     map[string]string `yaml:"templates"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+// Histogram types
+const (
+	HistogramTypeClassic = "classic"
+	HistogramTypeNative  = "native"
+	HistogramTypeSummary = "summary"
+)
+
+// Histogram contains representation of response time metric: classic histogram with fixed buckets,
+// native histogram with exponential buckets or summary
+type Histogram struct {
+	Type    string    `yaml:"type"`
+	Buckets []float64 `yaml:"buckets"`
+
+	NativeBucketFactor     float64       `yaml:"native_bucket_factor"`
+	NativeMaxBuckets       uint32        `yaml:"native_max_buckets"`
+	NativeMinResetDuration time.Duration `yaml:"native_min_reset_duration"`
+
+	Objectives map[float64]float64 `yaml:"objectives"`
+	MaxAge     time.Duration       `yaml:"max_age"`
+	AgeBuckets uint32              `yaml:"age_buckets"`
+}
+
+// Exemplars contains settings of exemplars attached to response time histograms
+type Exemplars struct {
+	// Variables are log format variables, the first non-empty one is used as exemplar value
+	Variables []string `yaml:"variables"`
+	LabelName string   `yaml:"label_name"`
+}
+
+// ParseErrors contains settings of the last failed log lines kept by source and of logging of failures, that is
+// limited to one message by source in interval. Defaults are set by exporter.
+type ParseErrors struct {
+	BufferSize  int           `yaml:"buffer_size"`
+	LogInterval time.Duration `yaml:"log_interval"`
+	// Endpoint enables serving of kept lines, it is disabled by default, because lines contain client addresses
+	// and query strings
+	Endpoint bool `yaml:"endpoint"`
+}
+
+// Outcome contains status codes, that are not real errors of server. Codes of upstream are taken from the last
+// value of $upstream_status, status of request is used, if there is no upstream.
+type Outcome struct {
+	ClientAbortCodes     []int `yaml:"client_abort_codes"`
+	UpstreamTimeoutCodes []int `yaml:"upstream_timeout_codes"`
+}
+
+// SLOObjective is an objective of requests latency and success. Requests are selected by labels of host and URI,
+// empty selector matches all values. Request is good, if it succeeds not slower than latency threshold, objective
+// without latency threshold requires only success.
+type SLOObjective struct {
+	Name             string        `yaml:"name"`
+	Hosts            []string      `yaml:"hosts"`
+	URIs             []string      `yaml:"uris"`
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+	// SuccessCodes are http codes or classes of codes(2xx) of successful requests
+	SuccessCodes []string `yaml:"success_codes"`
+	// ApdexThreshold is a time, requests faster than it are satisfied, requests faster than 4 times of it are tolerating.
+	// Apdex is not counted, if neither it nor latency threshold is set.
+	ApdexThreshold time.Duration `yaml:"apdex_threshold"`
+}
+
+// Matches checks if objective selects request with host and URI labels
+func (o *SLOObjective) Matches(host, uri string) bool {
+	return (len(o.Hosts) == 0 || containsString(o.Hosts, host)) && (len(o.URIs) == 0 || containsString(o.URIs, uri))
+}
+
+// IsSuccess checks if http code is a code of successful request
+func (o *SLOObjective) IsSuccess(code string) bool {
+	for _, c := range o.SuccessCodes {
+		if c == code || (len(code) == 3 && c[1:] == "xx" && c[0] == code[0]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Abuse rule keys
+const (
+	AbuseKeyIP        = "ip"
+	AbuseKeyPrefix    = "prefix"
+	AbuseKeyUserAgent = "user_agent"
+)
+
+// AbuseRule is a rule of detection of clients, that make more than threshold requests in sliding window. Requests
+// are selected by labels of host and URI and by methods, empty selector matches all values. Clients are identified
+// by key: ip, prefix(/24 of IPv4 and /64 of IPv6) or user_agent.
+type AbuseRule struct {
+	Name      string        `yaml:"name"`
+	Key       string        `yaml:"key"`
+	Hosts     []string      `yaml:"hosts"`
+	URIs      []string      `yaml:"uris"`
+	Methods   []string      `yaml:"methods"`
+	Window    time.Duration `yaml:"window"`
+	Threshold int           `yaml:"threshold"`
+	// MaxKeys limits number of tracked clients, the least recently seen ones are forgotten
+	MaxKeys int `yaml:"max_keys"`
+	// LogOffenders enables logging of clients exceeding threshold
+	LogOffenders bool `yaml:"log_offenders"`
+}
+
+// Matches checks if rule selects request with host and URI labels and method
+func (r *AbuseRule) Matches(host, uri, method string) bool {
+	return (len(r.Hosts) == 0 || containsString(r.Hosts, host)) && (len(r.URIs) == 0 || containsString(r.URIs, uri)) &&
+		(len(r.Methods) == 0 || containsString(r.Methods, method))
+}
+
+// Tap contains settings of streaming of parsed log lines. Lines exceeding buffer of slow client are dropped,
+// stream is closed, if no line was written to it in idle timeout.
+type Tap struct {
+	BufferSize     int           `yaml:"buffer_size"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxSubscribers int           `yaml:"max_subscribers"`
+}
+
+// SamplingOutputStdout is an output of sampling log writing to stdout
+const SamplingOutputStdout = "stdout"
+
+// Sampling contains settings of log of slow and failed requests. Requests qualify, if they are slower than latency
+// threshold of their uri label or fail with 5xx code. Lines are written as JSON to stdout or file rotated by size.
+type Sampling struct {
+	Output    string `yaml:"output"`
+	MaxSizeMB int    `yaml:"max_size_mb"`
+	// MaxBackups is nil if it is not specified, zero keeps no rotated files
+	MaxBackups *int `yaml:"max_backups"`
+	// LatencyThresholds are thresholds of response time by uri label, DefaultLatencyThreshold is used for other uris
+	LatencyThresholds       map[string]time.Duration `yaml:"latency_thresholds"`
+	DefaultLatencyThreshold time.Duration            `yaml:"default_latency_threshold"`
+	// RateLimit is a number of lines per second by host label, Burst is a number of lines written at once
+	RateLimit float64 `yaml:"rate_limit"`
+	Burst     int     `yaml:"burst"`
+}
+
+// LatencyThreshold returns latency threshold of uri label, zero threshold is disabled
+func (s *Sampling) LatencyThreshold(uri string) time.Duration {
+	if threshold, ok := s.LatencyThresholds[uri]; ok {
+		return threshold
+	}
+
+	return s.DefaultLatencyThreshold
+}
+
+// TopK contains settings of tracking the most frequent values of dimensions in sliding window. Dimensions are
+// expressions over variables of log line by dimension name.
+type TopK struct {
+	Window        time.Duration     `yaml:"window"`
+	Capacity      int               `yaml:"capacity"`
+	ExportTop     int               `yaml:"export_top"`
+	DimensionsRaw map[string]string `yaml:"dimensions"`
+
+	// compiled settings, dimensions are sorted by name
+	Dimensions []Dimension `yaml:"-"`
+}
+
+// UniqueVisitors contains settings of estimation of distinct values of dimensions by host in rolling windows
+// with HyperLogLog sketches. Host and dimensions are expressions over variables of log line.
+type UniqueVisitors struct {
+	Windows       []time.Duration   `yaml:"windows"`
+	Precision     uint8             `yaml:"precision"`
+	MaxHosts      int               `yaml:"max_hosts"`
+	HostRaw       string            `yaml:"host"`
+	DimensionsRaw map[string]string `yaml:"dimensions"`
+
+	// compiled settings, dimensions are sorted by name
+	Host       *expr.Expression `yaml:"-"`
+	Dimensions []Dimension      `yaml:"-"`
+}
+
+// Dimension is a dimension of log lines, which values are computed by expression
+type Dimension struct {
+	Name  string
+	Value *expr.Expression
+}
+
+// ComputedLabel is a label, which value is computed by expression
+type ComputedLabel struct {
+	Name       string
+	Expression *expr.Expression
+}
+
+// Custom metric types
+const (
+	CustomMetricTypeCounter   = "counter"
+	CustomMetricTypeGauge     = "gauge"
+	CustomMetricTypeHistogram = "histogram"
+)
+
+// CustomMetric is a metric defined by expressions. Value of counter is 1 by default, the metric is not exposed
+// for log lines, which don't match condition.
+type CustomMetric struct {
+	Name         string            `yaml:"name"`
+	Help         string            `yaml:"help"`
+	Type         string            `yaml:"type"`
+	LabelsRaw    map[string]string `yaml:"labels"`
+	ValueRaw     string            `yaml:"value"`
+	ConditionRaw string            `yaml:"condition"`
+	Buckets      []float64         `yaml:"buckets"`
+
+	// compiled settings, label names are sorted
+	LabelNames []string           `yaml:"-"`
+	Labels     []*expr.Expression `yaml:"-"`
+	Value      *expr.Expression   `yaml:"-"`
+	Condition  *expr.Expression   `yaml:"-"`
+}
+
+// VerifiedCrawler is a crawler that is verified by subnets it comes from
+type VerifiedCrawler struct {
+	Name        string
+	MatchRe     *regexp.Regexp
+	SubnetsTrie *pkgnet.Trie
+}
+
 // MakeConfigFromFile loads file and makes config
 func MakeConfigFromFile(path string) (*Config, error) {
 	raw, err := ioutil.ReadFile(path)
@@ -87,12 +567,20 @@ func MakeConfigFromFile(path string) (*Config, error) {
 		return nil, err
 	}
 
-	cfg := &Config{Global: Global{UserAgentCacheSize: defaultUserAgentCacheSize, ExportWorkers: defaultExportWorkers}}
+	cfg := &Config{Global: Global{
+		UserAgentCacheSize: defaultUserAgentCacheSize,
+		ExportWorkers:      defaultExportWorkers,
+		Namespace:          defaultNamespace,
+	}}
 	err = yaml.Unmarshal(raw, cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := cfg.compileSourceLabels(); err != nil {
+		return nil, err
+	}
+
 	for _, rep := range cfg.Global.UserAgentReplacementSettingsRaw {
 		if rep.MatchRe != "" {
 			cfg.Global.UserAgentReplacementSettings = append(cfg.Global.UserAgentReplacementSettings, UserAgentReplacementSetting{
@@ -115,5 +603,699 @@ func MakeConfigFromFile(path string) (*Config, error) {
 		})
 	}
 
+	cfg.Global.InternalSubnetsTrie, err = makeTrie([]Network{{Name: "internal", Subnets: cfg.Global.InternalSubnets}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Global.Networks) > 0 {
+		names := make(map[string]bool)
+		for _, network := range cfg.Global.Networks {
+			if network.Name == "" {
+				return nil, fmt.Errorf("network name is not specified")
+			}
+			if names[network.Name] {
+				return nil, fmt.Errorf("network %q is specified more than once", network.Name)
+			}
+
+			names[network.Name] = true
+		}
+
+		cfg.Global.NetworksTrie, err = makeTrie(cfg.Global.Networks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Global.RealIP != nil {
+		if cfg.Global.RealIP.Header == "" {
+			cfg.Global.RealIP.Header = defaultRealIPHeader
+		}
+
+		cfg.Global.RealIP.TrustedProxyNets, err = pkgnet.ParseCIDRs(cfg.Global.RealIP.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if bots := cfg.Global.Bots; bots != nil {
+		bots.UserAgents, err = compileRegexps(bots.UserAgentsRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		bots.MonitoringUserAgents, err = compileRegexps(bots.MonitoringUserAgentsRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, crawler := range bots.VerifiedCrawlersRaw {
+			matchRe, err := regexp.Compile(crawler.MatchRe)
+			if err != nil {
+				return nil, err
+			}
+
+			subNetsTrie, err := makeTrie([]Network{{Name: crawler.Name, Subnets: crawler.Subnets}})
+			if err != nil {
+				return nil, err
+			}
+
+			bots.VerifiedCrawlers = append(bots.VerifiedCrawlers, VerifiedCrawler{
+				Name:        crawler.Name,
+				MatchRe:     matchRe,
+				SubnetsTrie: subNetsTrie,
+			})
+		}
+	}
+
+	if err := compileFilters(cfg.Global.Filters); err != nil {
+		return nil, err
+	}
+	for _, source := range cfg.Sources {
+		if err := compileFilters(source.Filters); err != nil {
+			return nil, fmt.Errorf("source %q: %s", source.Host, err)
+		}
+	}
+
+	cfg.Global.ComputedLabels, err = compileComputedLabels(cfg.Global.ComputedLabelsRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, metric := range cfg.Global.CustomMetrics {
+		if metric == nil {
+			return nil, fmt.Errorf("custom metric is empty")
+		}
+		if names[metric.Name] {
+			return nil, fmt.Errorf("custom metric %q is specified more than once", metric.Name)
+		}
+		names[metric.Name] = true
+
+		if err := metric.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, relabelConfig := range cfg.Global.RelabelConfigs {
+		if relabelConfig == nil {
+			return nil, fmt.Errorf("relabel config is empty")
+		}
+		if err := relabelConfig.Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Global.Outcome == nil {
+		cfg.Global.Outcome = &Outcome{}
+	}
+	if cfg.Global.Outcome.ClientAbortCodes == nil {
+		cfg.Global.Outcome.ClientAbortCodes = defaultClientAbortCodes
+	}
+	if cfg.Global.Outcome.UpstreamTimeoutCodes == nil {
+		cfg.Global.Outcome.UpstreamTimeoutCodes = defaultUpstreamTimeoutCodes
+	}
+
+	if cfg.Global.ParseErrors == nil {
+		cfg.Global.ParseErrors = &ParseErrors{}
+	}
+	if cfg.Global.ParseErrors.BufferSize < 0 || cfg.Global.ParseErrors.LogInterval < 0 {
+		return nil, fmt.Errorf("buffer_size and log_interval of parse_errors should be positive")
+	}
+
+	if topK := cfg.Global.TopK; topK != nil {
+		if len(topK.DimensionsRaw) == 0 {
+			return nil, fmt.Errorf("dimensions of top_k are not specified")
+		}
+		if topK.Window == 0 {
+			topK.Window = defaultTopKWindow
+		}
+		if topK.Capacity == 0 {
+			topK.Capacity = defaultTopKCapacity
+		}
+		if topK.Window < time.Second {
+			return nil, fmt.Errorf("window of top_k should be at least 1s")
+		}
+		if topK.Capacity < 0 || topK.ExportTop < 0 {
+			return nil, fmt.Errorf("capacity and export_top of top_k should not be negative")
+		}
+
+		if topK.Dimensions, err = compileDimensions(topK.DimensionsRaw); err != nil {
+			return nil, fmt.Errorf("top_k: %s", err)
+		}
+	}
+
+	if uniques := cfg.Global.UniqueVisitors; uniques != nil {
+		if len(uniques.Windows) == 0 {
+			uniques.Windows = defaultUniqueVisitorsWindows
+		}
+		for _, window := range uniques.Windows {
+			if window < time.Second {
+				return nil, fmt.Errorf("windows of unique_visitors should be at least 1s")
+			}
+		}
+		if uniques.Precision == 0 {
+			uniques.Precision = defaultUniqueVisitorsPrecision
+		}
+		if uniques.Precision < 4 || uniques.Precision > 18 {
+			return nil, fmt.Errorf("precision of unique_visitors should be from 4 to 18")
+		}
+		if uniques.MaxHosts == 0 {
+			uniques.MaxHosts = defaultUniqueVisitorsMaxHosts
+		}
+		if uniques.MaxHosts < 0 {
+			return nil, fmt.Errorf("max_hosts of unique_visitors should be positive")
+		}
+		if uniques.HostRaw == "" {
+			uniques.HostRaw = hostVariable
+		}
+		if len(uniques.DimensionsRaw) == 0 {
+			uniques.DimensionsRaw = defaultUniqueVisitorsDimensions
+		}
+
+		if uniques.Host, err = expr.Compile(uniques.HostRaw); err != nil {
+			return nil, fmt.Errorf("host of unique_visitors: %s", err)
+		}
+		if uniques.Dimensions, err = compileDimensions(uniques.DimensionsRaw); err != nil {
+			return nil, fmt.Errorf("unique_visitors: %s", err)
+		}
+	}
+
+	objectives := make(map[string]bool)
+	for _, objective := range cfg.Global.SLOObjectives {
+		if objective == nil {
+			return nil, fmt.Errorf("SLO objective is empty")
+		}
+		if objective.Name == "" {
+			return nil, fmt.Errorf("name of SLO objective is not specified")
+		}
+		if objectives[objective.Name] {
+			return nil, fmt.Errorf("SLO objective %q is specified more than once", objective.Name)
+		}
+		objectives[objective.Name] = true
+
+		if objective.LatencyThreshold < 0 {
+			return nil, fmt.Errorf("latency threshold of SLO objective %q should not be negative", objective.Name)
+		}
+		if len(objective.SuccessCodes) == 0 {
+			objective.SuccessCodes = defaultSLOSuccessCodes
+		}
+		for _, code := range objective.SuccessCodes {
+			if !successCodeRe.MatchString(code) {
+				return nil, fmt.Errorf("invalid success code %q of SLO objective %q", code, objective.Name)
+			}
+		}
+		if objective.ApdexThreshold < 0 {
+			return nil, fmt.Errorf("apdex threshold of SLO objective %q should not be negative", objective.Name)
+		}
+		if objective.ApdexThreshold == 0 {
+			objective.ApdexThreshold = objective.LatencyThreshold
+		}
+	}
+
+	rules := make(map[string]bool)
+	for _, rule := range cfg.Global.AbuseRules {
+		if rule == nil {
+			return nil, fmt.Errorf("abuse rule is empty")
+		}
+		if rule.Name == "" {
+			return nil, fmt.Errorf("name of abuse rule is not specified")
+		}
+		if rules[rule.Name] {
+			return nil, fmt.Errorf("abuse rule %q is specified more than once", rule.Name)
+		}
+		rules[rule.Name] = true
+
+		switch rule.Key {
+		case "":
+			rule.Key = AbuseKeyIP
+		case AbuseKeyIP, AbuseKeyPrefix, AbuseKeyUserAgent:
+		default:
+			return nil, fmt.Errorf("unknown key %q of abuse rule %q", rule.Key, rule.Name)
+		}
+		for i, method := range rule.Methods {
+			rule.Methods[i] = strings.ToUpper(method)
+		}
+		if rule.Window == 0 {
+			rule.Window = defaultAbuseWindow
+		}
+		if rule.Window < time.Second {
+			return nil, fmt.Errorf("window of abuse rule %q should be at least 1s", rule.Name)
+		}
+		if rule.Threshold <= 0 {
+			return nil, fmt.Errorf("threshold of abuse rule %q should be positive", rule.Name)
+		}
+		if rule.MaxKeys == 0 {
+			rule.MaxKeys = defaultAbuseMaxKeys
+		}
+		if rule.MaxKeys < 0 {
+			return nil, fmt.Errorf("max keys of abuse rule %q should be positive", rule.Name)
+		}
+	}
+
+	if sampling := cfg.Global.Sampling; sampling != nil {
+		if sampling.Output == "" {
+			sampling.Output = SamplingOutputStdout
+		}
+		if sampling.MaxSizeMB == 0 {
+			sampling.MaxSizeMB = defaultSamplingMaxSizeMB
+		}
+		if sampling.MaxBackups == nil {
+			maxBackups := defaultSamplingMaxBackups
+			sampling.MaxBackups = &maxBackups
+		}
+		if sampling.MaxSizeMB < 0 || *sampling.MaxBackups < 0 {
+			return nil, fmt.Errorf("max_size_mb and max_backups of sampling should be positive")
+		}
+		if sampling.DefaultLatencyThreshold < 0 {
+			return nil, fmt.Errorf("default latency threshold of sampling should be positive")
+		}
+		for uri, threshold := range sampling.LatencyThresholds {
+			if threshold < 0 {
+				return nil, fmt.Errorf("latency threshold of uri %q of sampling should be positive", uri)
+			}
+		}
+		if sampling.RateLimit == 0 {
+			sampling.RateLimit = defaultSamplingRateLimit
+		}
+		if sampling.RateLimit < 0 {
+			return nil, fmt.Errorf("rate_limit of sampling should be positive")
+		}
+		if sampling.Burst == 0 {
+			sampling.Burst = int(math.Ceil(sampling.RateLimit))
+		}
+		if sampling.Burst < 0 {
+			return nil, fmt.Errorf("burst of sampling should be positive")
+		}
+	}
+
+	if tap := cfg.Global.Tap; tap != nil {
+		if tap.BufferSize == 0 {
+			tap.BufferSize = defaultTapBufferSize
+		}
+		if tap.IdleTimeout == 0 {
+			tap.IdleTimeout = defaultTapIdleTimeout
+		}
+		if tap.MaxSubscribers == 0 {
+			tap.MaxSubscribers = defaultTapMaxSubscribers
+		}
+		if tap.BufferSize < 0 || tap.IdleTimeout < 0 || tap.MaxSubscribers < 0 {
+			return nil, fmt.Errorf("buffer_size, idle_timeout and max_subscribers of tap should be positive")
+		}
+	}
+
+	if exemplars := cfg.Global.Exemplars; exemplars != nil {
+		if len(exemplars.Variables) == 0 {
+			exemplars.Variables = []string{defaultExemplarVariable}
+		}
+		if exemplars.LabelName == "" {
+			exemplars.LabelName = defaultExemplarLabelName
+		}
+	}
+
+	if cfg.Global.GeoIP != nil {
+		if cfg.Global.GeoIP.CacheSize == 0 {
+			cfg.Global.GeoIP.CacheSize = defaultGeoIPCacheSize
+		}
+		if cfg.Global.GeoIP.ReloadInterval == 0 {
+			cfg.Global.GeoIP.ReloadInterval = defaultGeoIPReloadInterval
+		}
+		if cfg.Global.GeoIP.ReloadInterval < 0 {
+			return nil, fmt.Errorf("reload_interval of geoip should be positive")
+		}
+	}
+
+	if statsd := cfg.Global.StatsD; statsd != nil {
+		if statsd.Address == "" {
+			return nil, fmt.Errorf("statsd address is not specified")
+		}
+		for name, rate := range statsd.SampleRates {
+			if rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("statsd sample rate of metric %q should be in (0, 1], got %v", name, rate)
+			}
+		}
+		if statsd.Prefix == "" {
+			statsd.Prefix = cfg.Global.Namespace
+		}
+		if statsd.PacketSize == 0 {
+			statsd.PacketSize = defaultStatsDPacketSize
+		}
+		if statsd.FlushInterval == 0 {
+			statsd.FlushInterval = defaultStatsDFlushInterval
+		}
+		if statsd.PacketSize < 0 || statsd.FlushInterval < 0 {
+			return nil, fmt.Errorf("packet_size and flush_interval of statsd should be positive")
+		}
+	}
+
+	if remoteWrite := cfg.Global.RemoteWrite; remoteWrite != nil {
+		if remoteWrite.URL == "" {
+			return nil, fmt.Errorf("remote write url is not specified")
+		}
+		if remoteWrite.BasicAuth != nil && remoteWrite.BearerToken != "" {
+			return nil, fmt.Errorf("remote write basic_auth and bearer_token are mutually exclusive")
+		}
+		if remoteWrite.Interval == 0 {
+			remoteWrite.Interval = defaultRemoteWriteInterval
+		}
+		if remoteWrite.Timeout == 0 {
+			remoteWrite.Timeout = defaultRemoteWriteTimeout
+		}
+		if remoteWrite.MaxRetries == nil {
+			maxRetries := defaultRemoteWriteMaxRetries
+			remoteWrite.MaxRetries = &maxRetries
+		}
+		if remoteWrite.MinBackoff == 0 {
+			remoteWrite.MinBackoff = defaultRemoteWriteMinBackoff
+		}
+		if remoteWrite.MaxBackoff == 0 {
+			remoteWrite.MaxBackoff = defaultRemoteWriteMaxBackoff
+		}
+		if remoteWrite.BufferSize == 0 {
+			remoteWrite.BufferSize = defaultRemoteWriteBufferSize
+		}
+		if remoteWrite.Interval < 0 || remoteWrite.Timeout < 0 || *remoteWrite.MaxRetries < 0 || remoteWrite.BufferSize < 0 {
+			return nil, fmt.Errorf("interval, timeout, max_retries and buffer_size of remote write should be positive")
+		}
+		if remoteWrite.MinBackoff < 0 || remoteWrite.MinBackoff > remoteWrite.MaxBackoff {
+			return nil, fmt.Errorf("min_backoff of remote write should be positive and not greater than max_backoff")
+		}
+	}
+
+	if otlp := cfg.Global.OTLP; otlp != nil {
+		if otlp.Endpoint == "" {
+			return nil, fmt.Errorf("otlp endpoint is not specified")
+		}
+		if otlp.Protocol == "" {
+			otlp.Protocol = defaultOTLPProtocol
+		}
+		if otlp.Interval == 0 {
+			otlp.Interval = defaultOTLPInterval
+		}
+		if otlp.Timeout == 0 {
+			otlp.Timeout = defaultOTLPTimeout
+		}
+		if otlp.Interval < 0 || otlp.Timeout < 0 {
+			return nil, fmt.Errorf("interval and timeout of otlp should be positive")
+		}
+	}
+
+	for name, histogram := range cfg.Global.Histograms {
+		if histogram == nil {
+			return nil, fmt.Errorf("histogram settings of metric %q are empty", name)
+		}
+
+		switch histogram.Type {
+		case "", HistogramTypeClassic:
+			histogram.Type = HistogramTypeClassic
+		case HistogramTypeNative:
+			if histogram.NativeBucketFactor == 0 {
+				histogram.NativeBucketFactor = defaultNativeHistogramBucketFactor
+			}
+			if histogram.NativeBucketFactor <= 1 {
+				return nil, fmt.Errorf("native bucket factor of metric %q should be greater than 1", name)
+			}
+			if histogram.NativeMaxBuckets == 0 {
+				histogram.NativeMaxBuckets = defaultNativeHistogramMaxBuckets
+			}
+			if histogram.NativeMinResetDuration == 0 {
+				histogram.NativeMinResetDuration = defaultNativeHistogramMinResetDuration
+			}
+		case HistogramTypeSummary:
+			if len(histogram.Buckets) > 0 {
+				return nil, fmt.Errorf("summary %q could not have buckets", name)
+			}
+			if len(histogram.Objectives) == 0 {
+				histogram.Objectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+			}
+			for quantile, epsilon := range histogram.Objectives {
+				if quantile < 0 || quantile > 1 || epsilon < 0 || epsilon > 1 {
+					return nil, fmt.Errorf("objective %v: %v of summary %q is out of [0, 1]", quantile, epsilon, name)
+				}
+			}
+			if histogram.MaxAge == 0 {
+				histogram.MaxAge = defaultSummaryMaxAge
+			}
+			if histogram.AgeBuckets == 0 {
+				histogram.AgeBuckets = defaultSummaryAgeBuckets
+			}
+		default:
+			return nil, fmt.Errorf("unknown histogram type %q of metric %q", histogram.Type, name)
+		}
+	}
+
+	if influx := cfg.Global.Influx; influx != nil {
+		if influx.Address == "" {
+			return nil, fmt.Errorf("influx address is not specified")
+		}
+		if influx.Prefix == "" {
+			influx.Prefix = cfg.Global.Namespace
+		}
+		if influx.PacketSize == 0 {
+			influx.PacketSize = defaultInfluxPacketSize
+		}
+		if influx.FlushInterval == 0 {
+			influx.FlushInterval = defaultFlushInterval
+		}
+		if influx.Timeout == 0 {
+			influx.Timeout = defaultSinkTimeout
+		}
+		if influx.PacketSize < 0 || influx.FlushInterval < 0 || influx.Timeout < 0 {
+			return nil, fmt.Errorf("packet_size, flush_interval and timeout of influx should be positive")
+		}
+	}
+
+	if graphite := cfg.Global.Graphite; graphite != nil {
+		if graphite.Address == "" {
+			return nil, fmt.Errorf("graphite address is not specified")
+		}
+		if graphite.Tags && len(graphite.Templates) > 0 {
+			return nil, fmt.Errorf("graphite tags and templates are mutually exclusive")
+		}
+		if graphite.Prefix == "" {
+			graphite.Prefix = cfg.Global.Namespace
+		}
+		if graphite.FlushInterval == 0 {
+			graphite.FlushInterval = defaultFlushInterval
+		}
+		if graphite.Timeout == 0 {
+			graphite.Timeout = defaultSinkTimeout
+		}
+		if graphite.FlushInterval < 0 || graphite.Timeout < 0 {
+			return nil, fmt.Errorf("flush_interval and timeout of graphite should be positive")
+		}
+	}
+
 	return cfg, err
 }
+
+// compileSourceLabels collects sorted names of labels of all sources and their values by source host,
+// sources without some label have empty value of it
+func (c *Config) compileSourceLabels() error {
+	seen := make(map[string]bool)
+	for _, source := range c.Sources {
+		for name := range source.Labels {
+			if _, ok := c.Global.ConstLabels[name]; ok {
+				return fmt.Errorf("label %q of source %q is already specified as const label", name, source.Host)
+			}
+
+			if !seen[name] {
+				seen[name] = true
+				c.SourceLabelNames = append(c.SourceLabelNames, name)
+			}
+		}
+	}
+	sort.Strings(c.SourceLabelNames)
+
+	c.SourceLabelValues = make(map[string][]string, len(c.Sources))
+	for _, source := range c.Sources {
+		values := make([]string, 0, len(c.SourceLabelNames))
+		for _, name := range c.SourceLabelNames {
+			values = append(values, source.Labels[name])
+		}
+
+		c.SourceLabelValues[source.Host] = values
+	}
+
+	return nil
+}
+
+// WithSourceLabels appends values of source labels of host to label values,
+// values are empty if host is not a source
+func (c *Config) WithSourceLabels(host string, labels ...string) []string {
+	if len(c.SourceLabelNames) == 0 {
+		return labels
+	}
+
+	values, ok := c.SourceLabelValues[host]
+	if !ok {
+		values = make([]string, len(c.SourceLabelNames))
+	}
+
+	return append(append(make([]string, 0, len(labels)+len(values)), labels...), values...)
+}
+
+// compileComputedLabels compiles expressions of computed labels sorted by name
+func compileComputedLabels(raw map[string]string) ([]ComputedLabel, error) {
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		if !labelNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid name of computed label %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := make([]ComputedLabel, 0, len(names))
+	for _, name := range names {
+		expression, err := expr.Compile(raw[name])
+		if err != nil {
+			return nil, fmt.Errorf("computed label %q: %s", name, err)
+		}
+
+		labels = append(labels, ComputedLabel{Name: name, Expression: expression})
+	}
+
+	return labels, nil
+}
+
+// compile checks settings of custom metric and compiles its expressions
+func (m *CustomMetric) compile() error {
+	if !metricNameRe.MatchString(m.Name) {
+		return fmt.Errorf("invalid name of custom metric %q", m.Name)
+	}
+
+	switch m.Type {
+	case CustomMetricTypeCounter:
+	case CustomMetricTypeGauge, CustomMetricTypeHistogram:
+		if m.ValueRaw == "" {
+			return fmt.Errorf("value of custom %s %q is not specified", m.Type, m.Name)
+		}
+	default:
+		return fmt.Errorf("unknown type %q of custom metric %q", m.Type, m.Name)
+	}
+
+	if len(m.Buckets) > 0 && m.Type != CustomMetricTypeHistogram {
+		return fmt.Errorf("custom %s %q could not have buckets", m.Type, m.Name)
+	}
+
+	for name := range m.LabelsRaw {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("invalid label %q of custom metric %q", name, m.Name)
+		}
+		m.LabelNames = append(m.LabelNames, name)
+	}
+	sort.Strings(m.LabelNames)
+
+	for _, name := range m.LabelNames {
+		expression, err := expr.Compile(m.LabelsRaw[name])
+		if err != nil {
+			return fmt.Errorf("label %q of custom metric %q: %s", name, m.Name, err)
+		}
+		m.Labels = append(m.Labels, expression)
+	}
+
+	var err error
+	if m.ValueRaw != "" {
+		if m.Value, err = expr.Compile(m.ValueRaw); err != nil {
+			return fmt.Errorf("value of custom metric %q: %s", m.Name, err)
+		}
+	}
+	if m.ConditionRaw != "" {
+		if m.Condition, err = expr.Compile(m.ConditionRaw); err != nil {
+			return fmt.Errorf("condition of custom metric %q: %s", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// compileDimensions compiles expressions of dimensions sorted by name
+func compileDimensions(raw map[string]string) ([]Dimension, error) {
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dimensions := make([]Dimension, 0, len(names))
+	for _, name := range names {
+		value, err := expr.Compile(raw[name])
+		if err != nil {
+			return nil, fmt.Errorf("dimension %q: %s", name, err)
+		}
+		dimensions = append(dimensions, Dimension{Name: name, Value: value})
+	}
+
+	return dimensions, nil
+}
+
+// compileFilters compiles filters checking that their names are unique
+func compileFilters(filters []*filter.Filter) error {
+	names := make(map[string]bool)
+	for _, f := range filters {
+		if f == nil {
+			return fmt.Errorf("filter is empty")
+		}
+		if err := f.Compile(); err != nil {
+			return err
+		}
+		if names[f.Name] {
+			return fmt.Errorf("filter %q is specified more than once", f.Name)
+		}
+		names[f.Name] = true
+	}
+
+	return nil
+}
+
+// makeTrie builds prefix tree of named groups of subnets. The same subnet can't belong to different groups,
+// otherwise the group of address would be ambiguous.
+func makeTrie(networks []Network) (*pkgnet.Trie, error) {
+	trie := pkgnet.NewTrie()
+	names := make(map[string]string)
+	for _, network := range networks {
+		IPNets, err := pkgnet.ParseCIDRs(network.Subnets)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, IPNet := range IPNets {
+			subNet := IPNet.String()
+			if name, ok := names[subNet]; ok && name != network.Name {
+				return nil, fmt.Errorf("subnet %s belongs to both %q and %q", subNet, name, network.Name)
+			}
+
+			names[subNet] = network.Name
+			trie.Insert(IPNet, network.Name)
+		}
+	}
+
+	return trie, nil
+}
+
+// compileRegexps compiles list of regular expressions
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// containsString checks if list contains string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -7,16 +7,20 @@ import (
 	"github.com/ozonru/accesslog-exporter/cache"
 	"github.com/ozonru/accesslog-exporter/config"
 	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/geoip"
 	"github.com/ozonru/accesslog-exporter/input"
 	"github.com/ozonru/accesslog-exporter/parser"
+	"github.com/ozonru/accesslog-exporter/relabel"
 )
 
 type Exporter struct {
 	syslogInput input.Input
-	exposeFunc  exposer.Exposer
+	metrics     *metrics
+	cfg         *config.Config
 
 	workersPool pool
 	lines       chan *input.LogLine
+	parseErrors *ParseErrors
 }
 
 func NewExporter(
@@ -25,37 +29,124 @@ func NewExporter(
 	logLinePsr parser.LogLineParser,
 	userAgentPsr parser.UserAgentParser,
 	cc cache.Cache,
-	exposeFunc exposer.Exposer,
+	geoResolver geoip.Resolver,
+	registry *exposer.Registry,
+	observers ...interface{},
 ) (*Exporter, error) {
 
 	if len(cfg.Sources) == 0 {
 		return nil, fmt.Errorf("nothing to parse and export, specify at least one source\n")
 	}
 
+	// check computed labels, they could not replace labels set by exporter
+	computed := make(map[string]bool)
+	for _, label := range cfg.Global.ComputedLabels {
+		switch label.Name {
+		case clientClassLabelName, codeClassLabelName, outcomeLabelName, geoip.CountryLabelName, geoip.ASNLabelName, networkLabelName, hostLabelName,
+			uriLabelName, codeLabelName, userAgentLabelName, osLabelName, deviceLabelName, deviceTypeLabelName, nginxHostLabelName:
+			return nil, fmt.Errorf("computed label %q is set by exporter", label.Name)
+		}
+		computed[label.Name] = true
+	}
+
+	// check extra labels of metrics, computed labels and labels set by relabel configs could be used as well
+	relabeled := make(map[string]bool)
+	for _, label := range relabel.TargetLabels(cfg.Global.RelabelConfigs) {
+		relabeled[label] = true
+	}
+
+	for name, labels := range cfg.Global.MetricLabels {
+		for _, label := range labels {
+			if relabeled[label] || computed[label] {
+				continue
+			}
+
+			switch label {
+			case geoip.CountryLabelName, geoip.ASNLabelName:
+				if geoResolver == nil {
+					return nil, fmt.Errorf("label %q of metric %q requires geoip to be configured", label, name)
+				}
+			case clientClassLabelName, codeClassLabelName, outcomeLabelName:
+			case networkLabelName:
+				if cfg.Global.NetworksTrie == nil {
+					return nil, fmt.Errorf("label %q of metric %q requires networks to be configured", label, name)
+				}
+			default:
+				return nil, fmt.Errorf("unknown label %q of metric %q", label, name)
+			}
+		}
+	}
+
+	// check metrics excluded for networks
+	for _, network := range cfg.Global.Networks {
+		for _, name := range network.ExcludeMetrics {
+			if !exposer.IsRequestMetric(name) {
+				return nil, fmt.Errorf("metric %q could not be excluded for network %q", name, network.Name)
+			}
+		}
+	}
+
+	// get handles of metrics
+	m, err := newMetrics(registry, cfg.Global.MetricLabels, cfg.SourceLabelNames)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.custom, err = newCustomMetrics(registry, cfg.Global.CustomMetrics, cfg.SourceLabelNames); err != nil {
+		return nil, err
+	}
+
+	m.buildInfo.Set(1, exposer.Version, exposer.Revision, exposer.Branch)
+
+	// failed lines are shared by workers, they are kept and logged with rate limit, even if endpoint is disabled
+	settings := cfg.Global.ParseErrors
+	if settings == nil {
+		settings = &config.ParseErrors{}
+	}
+	parseErrors := NewParseErrors(settings.BufferSize, settings.LogInterval)
+
 	// init workers
 	workersPool := make(pool, cfg.Global.ExportWorkers)
 	for i := 0; i < cfg.Global.ExportWorkers; i++ {
-		workersPool <- NewExportWorker(
+		w := newExportWorker(
+			cfg,
 			logLinePsr,
 			userAgentPsr,
 			cc,
-			exposeFunc,
-			&cfg.Global.InternalSubnets,
-			&cfg.Sources,
-			&cfg.Global.UserAgentReplacementSettings,
-			&cfg.Global.RequestURIReplacementSettings,
-			&cfg.Global.Hosts,
+			geoResolver,
+			m,
+			observers...,
 		)
+		w.parseErrors = parseErrors
+
+		workersPool <- w
 	}
 
 	return &Exporter{
 		syslogInput: syslogInput,
 		workersPool: workersPool,
-		exposeFunc:  exposeFunc,
+		metrics:     m,
+		cfg:         cfg,
 		lines:       make(chan *input.LogLine),
+		parseErrors: parseErrors,
 	}, nil
 }
 
+// ParseErrors returns the last failed log lines of sources
+func (s *Exporter) ParseErrors() *ParseErrors {
+	return s.parseErrors
+}
+
+// Process processes log line synchronously by one of workers, it is used to check formats without syslog input
+func (s *Exporter) Process(ctx context.Context, line *input.LogLine) {
+	w := <-s.workersPool
+	defer func() {
+		s.workersPool <- w
+	}()
+
+	w.Process(line, ctx)
+}
+
 // Run runs exporting metrics
 func (s *Exporter) Run(ctx context.Context) {
 	// run syslog server
@@ -75,10 +166,10 @@ func (s *Exporter) Run(ctx context.Context) {
 					s.workersPool <- w
 				}()
 			default:
-				s.exposeFunc(exposer.LogsDroppedTotalName, []string{line.NginxHost}, float64(0))
+				s.metrics.logsDropped.Inc(s.cfg.WithSourceLabels(line.NginxHost, line.NginxHost)...)
 			}
 
-			s.exposeFunc(exposer.LogsTotal, []string{line.NginxHost}, float64(0))
+			s.metrics.logsTotal.Inc(s.cfg.WithSourceLabels(line.NginxHost, line.NginxHost)...)
 		}
 	}()
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/ozonru/accesslog-exporter/config"
 	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/expr"
 
 	. "gopkg.in/check.v1"
 )
@@ -55,7 +56,8 @@ func (s ExporterSuite) TestRun(c *C) {
 		dummyParseFunc,
 		NewDummyUserAgentParser("ustest", "devicetest", "ostest"),
 		&DummyCache{},
-		newDummyExposeFunc(c),
+		nil,
+		newDummyRegistry(c, newDummySink(c), nil),
 	)
 	c.Assert(err, IsNil)
 
@@ -68,12 +70,29 @@ func (s ExporterSuite) TestRun(c *C) {
 	cancel()
 }
 
-// newDummyExposeFunc creates new dummy metric exposer
-func newDummyExposeFunc(c *C) func(name string, labels []string, value float64) {
-	return func(name string, labels []string, value float64) {
-		switch name {
+// newDummyRegistry creates registry with all metrics of exporter, that sends observations to sink
+func newDummyRegistry(c *C, sink exposer.Sink, extraLabels map[string][]string) *exposer.Registry {
+	registry := exposer.NewRegistry()
+	c.Assert(registry.Subscribe(sink), IsNil)
+	c.Assert(exposer.RegisterMetrics(registry, exposer.MetricsOptions{ExtraLabels: extraLabels}), IsNil)
+
+	return registry
+}
+
+// newDummyMetrics creates handles of all metrics of exporter, that send observations to sink
+func newDummyMetrics(c *C, sink exposer.Sink, extraLabels map[string][]string) *metrics {
+	m, err := newMetrics(newDummyRegistry(c, sink, extraLabels), extraLabels, nil)
+	c.Assert(err, IsNil)
+
+	return m
+}
+
+// newDummySink creates new dummy sink, that checks observations of metrics
+func newDummySink(c *C) *DummySink {
+	return NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		switch desc.Name {
 		case exposer.UserAgentCachedTotal:
-			c.Assert(value, Equals, float64(0))
+			c.Assert(value, Equals, float64(1))
 			c.Assert(labels, DeepEquals, []string{"localhost"})
 		case exposer.UserAgentCurrentCachedTotal:
 			c.Assert(value, Equals, float64(0))
@@ -88,14 +107,113 @@ func newDummyExposeFunc(c *C) func(name string, labels []string, value float64)
 			c.Assert(value, Equals, float64(4))
 			c.Assert(labels, DeepEquals, []string{"test_localhost", "", "200"})
 		case exposer.UserAgentRequestsTotalMetricName:
-			c.Assert(value, Equals, float64(0))
+			c.Assert(value, Equals, float64(1))
 			c.Assert(labels, DeepEquals, []string{"test_localhost", "ustest", "200"})
 		case exposer.OsDeviceTypeRequestsTotalMetricName:
-			c.Assert(value, Equals, float64(0))
+			c.Assert(value, Equals, float64(1))
 			c.Assert(labels, DeepEquals, []string{"test_localhost", "Ostest", "desktop"})
 		case exposer.NginxRequestsTotal:
-			c.Assert(value, Equals, float64(0))
+			c.Assert(value, Equals, float64(1))
 			c.Assert(labels, DeepEquals, []string{"localhost"})
 		}
+	})
+}
+
+func (s ExporterSuite) TestNewExporter_UnknownMetricLabel(c *C) {
+	cfg := &config.Config{
+		Global: config.Global{
+			ExportWorkers: 1,
+			MetricLabels: map[string][]string{
+				exposer.HostResponseTimeSecondsMetricName: {"country"},
+			},
+		},
+		Sources: []config.Source{{Host: "localhost"}},
+	}
+
+	_, err := NewExporter(cfg, nil, nil, nil, nil, nil, exposer.NewRegistry())
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `label "country" of metric "host_response_time_seconds" requires geoip to be configured`)
+
+	cfg.Global.MetricLabels[exposer.HostResponseTimeSecondsMetricName] = []string{"unknown_label"}
+
+	_, err = NewExporter(cfg, nil, nil, nil, nil, nil, exposer.NewRegistry())
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `unknown label "unknown_label" of metric "host_response_time_seconds"`)
+
+	// computed labels could be added to metrics, but they could not replace labels set by exporter
+	cfg.Global.ComputedLabels = []config.ComputedLabel{{Name: "unknown_label", Expression: expr.MustCompile(`$scheme`)}}
+
+	_, err = NewExporter(cfg, nil, nil, nil, nil, nil, exposer.NewRegistry())
+	c.Assert(err, ErrorMatches, `metric "host_response_time_seconds" is not registered`)
+
+	cfg.Global.ComputedLabels = []config.ComputedLabel{{Name: "uri", Expression: expr.MustCompile(`$scheme`)}}
+
+	_, err = NewExporter(cfg, nil, nil, nil, nil, nil, exposer.NewRegistry())
+	c.Assert(err, ErrorMatches, `computed label "uri" is set by exporter`)
+}
+
+func (s ExporterSuite) TestNewExporter_UnknownExcludedMetric(c *C) {
+	cfg := &config.Config{
+		Global: config.Global{
+			ExportWorkers: 1,
+			Networks: []config.Network{{
+				Name:           "monitoring",
+				ExcludeMetrics: []string{exposer.LogsTotal},
+			}},
+		},
+		Sources: []config.Source{{Host: "localhost"}},
 	}
+
+	_, err := NewExporter(cfg, nil, nil, nil, nil, nil, exposer.NewRegistry())
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `metric "logs_total" could not be excluded for network "monitoring"`)
+}
+
+func (s ExporterSuite) TestNewExporter_MetricsMismatch(c *C) {
+	cfg := &config.Config{
+		Global: config.Global{
+			ExportWorkers: 1,
+		},
+		Sources: []config.Source{{Host: "localhost"}},
+	}
+
+	// metrics are not registered
+	_, err := NewExporter(cfg, nil, nil, nil, nil, nil, exposer.NewRegistry())
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `metric "host_response_time_seconds" is not registered`)
+
+	// metric is registered with another labels
+	registry := exposer.NewRegistry()
+	c.Assert(registry.Register(exposer.Desc{
+		Name:   exposer.HostResponseTimeSecondsMetricName,
+		Type:   exposer.HistogramType,
+		Labels: []string{"host"},
+	}), IsNil)
+
+	_, err = newMetrics(registry, nil, nil)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `metric "host_response_time_seconds" has labels [host], but [host code] are expected`)
+
+	// metric is registered with another type
+	registry = exposer.NewRegistry()
+	c.Assert(registry.Register(exposer.Desc{
+		Name:   exposer.HostResponseTimeSecondsMetricName,
+		Type:   exposer.CounterType,
+		Labels: []string{"host", "code"},
+	}), IsNil)
+
+	_, err = newMetrics(registry, nil, nil)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `metric "host_response_time_seconds" is counter, not histogram`)
+
+	// metric labels are extended
+	extraLabels := map[string][]string{exposer.HostResponseTimeSecondsMetricName: {"client_class"}}
+	cfg.Global.MetricLabels = extraLabels
+
+	_, err = NewExporter(cfg, nil, nil, nil, nil, nil, newDummyRegistry(c, NewDummySink(nil), nil))
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, `metric "host_response_time_seconds" has labels [host code], but [host code client_class] are expected`)
+
+	_, err = NewExporter(cfg, nil, nil, nil, nil, nil, newDummyRegistry(c, NewDummySink(nil), extraLabels))
+	c.Assert(err, IsNil)
 }
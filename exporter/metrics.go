@@ -0,0 +1,172 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exposer"
+)
+
+// metrics contains handles of metrics exposed by exporter
+type metrics struct {
+	hostResponseTimeSeconds      *exposer.Histogram
+	userAgentResponseTimeSeconds *exposer.Histogram
+	URIResponseTimeSeconds       *exposer.Histogram
+	userAgentRequestsTotal       *exposer.Counter
+	osDeviceTypeRequestsTotal    *exposer.Counter
+	nginxRequestsTotal           *exposer.Counter
+
+	buildInfo                   *exposer.Gauge
+	logsDropped                 *exposer.Counter
+	logsFailParsedTotal         *exposer.Counter
+	logsTotal                   *exposer.Counter
+	logsFilteredTotal           *exposer.Counter
+	userAgentCachedTotal        *exposer.Counter
+	userAgentCurrentCachedTotal *exposer.Gauge
+	invalidClientAddressesTotal *exposer.Counter
+	logsFilterDroppedTotal      *exposer.Counter
+	sloRequestsTotal            *exposer.Counter
+	sloGoodRequestsTotal        *exposer.Counter
+	apdexRequestsTotal          *exposer.Counter
+
+	custom []customMetric
+}
+
+// newMetrics gets handles of registered metrics, it fails if some metric is not registered or has another type or
+// labels, so that label values always match label names.
+func newMetrics(registry *exposer.Registry, extraLabels map[string][]string, sourceLabels []string) (*metrics, error) {
+	m := &metrics{}
+
+	histograms := []struct {
+		name   string
+		handle **exposer.Histogram
+	}{
+		{exposer.HostResponseTimeSecondsMetricName, &m.hostResponseTimeSeconds},
+		{exposer.UserAgentResponseTimeSecondsMetricName, &m.userAgentResponseTimeSeconds},
+		{exposer.URIResponseTimeSecondsMetricName, &m.URIResponseTimeSeconds},
+	}
+	for _, h := range histograms {
+		histogram, err := registry.Histogram(h.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLabels(histogram.Metric, extraLabels[h.name], sourceLabels); err != nil {
+			return nil, err
+		}
+		*h.handle = histogram
+	}
+
+	counters := []struct {
+		name   string
+		handle **exposer.Counter
+	}{
+		{exposer.UserAgentRequestsTotalMetricName, &m.userAgentRequestsTotal},
+		{exposer.OsDeviceTypeRequestsTotalMetricName, &m.osDeviceTypeRequestsTotal},
+		{exposer.NginxRequestsTotal, &m.nginxRequestsTotal},
+		{exposer.LogsDroppedTotalName, &m.logsDropped},
+		{exposer.LogsFailParsedTotalName, &m.logsFailParsedTotal},
+		{exposer.LogsTotal, &m.logsTotal},
+		{exposer.LogsFilteredTotal, &m.logsFilteredTotal},
+		{exposer.UserAgentCachedTotal, &m.userAgentCachedTotal},
+		{exposer.InvalidClientAddressesTotal, &m.invalidClientAddressesTotal},
+		{exposer.LogsFilterDroppedTotal, &m.logsFilterDroppedTotal},
+		{exposer.SLORequestsTotal, &m.sloRequestsTotal},
+		{exposer.SLOGoodRequestsTotal, &m.sloGoodRequestsTotal},
+		{exposer.ApdexRequestsTotal, &m.apdexRequestsTotal},
+	}
+	for _, cnt := range counters {
+		counter, err := registry.Counter(cnt.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLabels(counter.Metric, extraLabels[cnt.name], sourceLabels); err != nil {
+			return nil, err
+		}
+		*cnt.handle = counter
+	}
+
+	gauges := []struct {
+		name   string
+		handle **exposer.Gauge
+	}{
+		{exposer.BuildInfoName, &m.buildInfo},
+		{exposer.UserAgentCurrentCachedTotal, &m.userAgentCurrentCachedTotal},
+	}
+	for _, g := range gauges {
+		gauge, err := registry.Gauge(g.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLabels(gauge.Metric, extraLabels[g.name], sourceLabels); err != nil {
+			return nil, err
+		}
+		*g.handle = gauge
+	}
+
+	return m, nil
+}
+
+// customMetric is a handle of custom metric with its settings
+type customMetric struct {
+	*config.CustomMetric
+	observe func(value float64, labels ...string)
+}
+
+// newCustomMetrics gets handles of registered custom metrics, it fails if some metric is not registered or has
+// another type or labels.
+func newCustomMetrics(registry *exposer.Registry, customMetrics []*config.CustomMetric, sourceLabels []string) ([]customMetric, error) {
+	handles := make([]customMetric, 0, len(customMetrics))
+	for _, cm := range customMetrics {
+		var (
+			metric  *exposer.Metric
+			observe func(value float64, labels ...string)
+		)
+
+		switch cm.Type {
+		case config.CustomMetricTypeCounter:
+			counter, err := registry.Counter(cm.Name)
+			if err != nil {
+				return nil, err
+			}
+			metric, observe = counter.Metric, counter.Add
+		case config.CustomMetricTypeGauge:
+			gauge, err := registry.Gauge(cm.Name)
+			if err != nil {
+				return nil, err
+			}
+			metric, observe = gauge.Metric, gauge.Set
+		case config.CustomMetricTypeHistogram:
+			histogram, err := registry.Histogram(cm.Name)
+			if err != nil {
+				return nil, err
+			}
+			metric, observe = histogram.Metric, histogram.Observe
+		default:
+			return nil, fmt.Errorf("unknown type %q of custom metric %q", cm.Type, cm.Name)
+		}
+
+		if err := checkLabels(metric, cm.LabelNames, sourceLabels); err != nil {
+			return nil, err
+		}
+
+		handles = append(handles, customMetric{CustomMetric: cm, observe: observe})
+	}
+
+	return handles, nil
+}
+
+// checkLabels checks that metric has labels, which values are passed by exporter: labels of exporter metric
+// followed by extra labels and labels of sources.
+func checkLabels(m *exposer.Metric, extraLabels, sourceLabels []string) error {
+	expected := append(exposer.MetricLabels(m.Name()), extraLabels...)
+	if exposer.IsSourceMetric(m.Name()) {
+		expected = append(expected, sourceLabels...)
+	}
+
+	if strings.Join(m.Labels(), ",") != strings.Join(expected, ",") {
+		return fmt.Errorf("metric %q has labels %v, but %v are expected", m.Name(), m.Labels(), expected)
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package exporter
 import (
 	"context"
 
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/geoip"
 	"github.com/ozonru/accesslog-exporter/input"
 
 	"github.com/ua-parser/uap-go/uaparser"
@@ -57,3 +59,54 @@ func (p *DummyUserAgentParser) Parse(line string) *uaparser.Client {
 
 	return client
 }
+
+type DummyGeoResolver struct {
+	locations map[string]geoip.Location
+}
+
+func NewDummyGeoResolver(locations map[string]geoip.Location) *DummyGeoResolver {
+	return &DummyGeoResolver{locations: locations}
+}
+
+func (r *DummyGeoResolver) Resolve(ip string) geoip.Location {
+	if location, ok := r.locations[ip]; ok {
+		return location
+	}
+
+	return geoip.Location{Country: unknownLabelValue, ASN: unknownLabelValue}
+}
+
+type DummySink struct {
+	observe func(desc *exposer.Desc, labels []string, value float64)
+}
+
+func NewDummySink(observe func(desc *exposer.Desc, labels []string, value float64)) *DummySink {
+	return &DummySink{observe: observe}
+}
+
+func (s *DummySink) Register(desc *exposer.Desc) error {
+	return nil
+}
+
+func (s *DummySink) Observe(desc *exposer.Desc, labels []string, value float64) {
+	if s.observe != nil {
+		s.observe(desc, labels, value)
+	}
+}
+
+type DummyObserver struct {
+	hosts []string
+}
+
+func (o *DummyObserver) Observe(nginxHost string, data map[string]string) {
+	o.hosts = append(o.hosts, nginxHost)
+}
+
+type DummyRequestObserver struct {
+	DummyObserver
+	requests []*Request
+}
+
+func (o *DummyRequestObserver) ObserveRequest(request *Request) {
+	o.requests = append(o.requests, request)
+}
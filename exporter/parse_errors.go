@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// Reasons of parse failures of log lines
+const (
+	reasonFieldCountMismatch = "field_count_mismatch"
+	reasonBadStatus          = "bad_status"
+	reasonBadDuration        = "bad_duration"
+	reasonOther              = "other"
+)
+
+const (
+	// maxParseErrorSources limits number of sources with kept lines, lines of the least recently failed are forgotten
+	maxParseErrorSources = 1000
+
+	defaultParseErrorsSize        = 100
+	defaultParseErrorsLogInterval = 10 * time.Second
+)
+
+// ParseError is a log line, that could not be parsed
+type ParseError struct {
+	Time    time.Time `json:"time"`
+	Format  string    `json:"format"`
+	Content string    `json:"content"`
+	Reason  string    `json:"reason"`
+	Error   string    `json:"error"`
+}
+
+// ParseErrors keeps the last failed log lines of sources and limits logging of failures to one message
+// by source in interval
+type ParseErrors struct {
+	size        int
+	logInterval time.Duration
+
+	// now is the clock of failure timestamps and log interval, tests set it to check rate limiting of log messages
+	now func() time.Time
+
+	mu      sync.Mutex
+	sources *simplelru.LRU
+}
+
+// parseErrorRing is a ring buffer of failed lines of source
+type parseErrorRing struct {
+	lines []ParseError
+	next  int
+
+	logged     time.Time
+	suppressed int
+}
+
+// NewParseErrors creates buffers of size lines by source, failure is logged, if failures of its source
+// were not logged in interval. Default size and interval are used instead of zero ones.
+func NewParseErrors(size int, logInterval time.Duration) *ParseErrors {
+	if size <= 0 {
+		size = defaultParseErrorsSize
+	}
+	if logInterval <= 0 {
+		logInterval = defaultParseErrorsLogInterval
+	}
+
+	sources, _ := simplelru.NewLRU(maxParseErrorSources, nil)
+
+	return &ParseErrors{size: size, logInterval: logInterval, now: time.Now, sources: sources}
+}
+
+// add keeps failed line of source. It returns true, if failure should be logged, and number of failures
+// of source, that were not logged since the last logged one.
+func (p *ParseErrors) add(nginxHost, format, content, reason string, err error) (int, bool) {
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var ring *parseErrorRing
+	if value, ok := p.sources.Get(nginxHost); ok {
+		ring = value.(*parseErrorRing)
+	} else {
+		ring = &parseErrorRing{lines: make([]ParseError, 0, p.size)}
+		p.sources.Add(nginxHost, ring)
+	}
+
+	line := ParseError{Time: now, Format: format, Content: content, Reason: reason, Error: err.Error()}
+	if len(ring.lines) < p.size {
+		ring.lines = append(ring.lines, line)
+	} else {
+		ring.lines[ring.next] = line
+		ring.next = (ring.next + 1) % p.size
+	}
+
+	if !ring.logged.IsZero() && now.Sub(ring.logged) < p.logInterval {
+		ring.suppressed++
+
+		return 0, false
+	}
+
+	suppressed := ring.suppressed
+	ring.logged, ring.suppressed = now, 0
+
+	return suppressed, true
+}
+
+// Lines returns failed lines by source from the oldest to the newest
+func (p *ParseErrors) Lines() map[string][]ParseError {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines := make(map[string][]ParseError, p.sources.Len())
+	for _, key := range p.sources.Keys() {
+		value, _ := p.sources.Peek(key)
+		ring := value.(*parseErrorRing)
+
+		lines[key.(string)] = append(append([]ParseError{}, ring.lines[ring.next:]...), ring.lines[:ring.next]...)
+	}
+
+	return lines
+}
+
+// ServeHTTP serves failed lines by source as JSON, lines of one source are served, if source parameter is set
+func (p *ParseErrors) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lines := p.Lines()
+	if source := r.URL.Query().Get("source"); source != "" {
+		lines = map[string][]ParseError{source: append([]ParseError{}, lines[source]...)}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Sources map[string][]ParseError `json:"sources"`
+	}{
+		Sources: lines,
+	})
+}
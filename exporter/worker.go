@@ -2,16 +2,22 @@ package exporter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/ozonru/accesslog-exporter/cache"
 	"github.com/ozonru/accesslog-exporter/config"
-	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/filter"
+	"github.com/ozonru/accesslog-exporter/geoip"
 	"github.com/ozonru/accesslog-exporter/input"
 	"github.com/ozonru/accesslog-exporter/parser"
 	"github.com/ozonru/accesslog-exporter/pkg/logging"
 	"github.com/ozonru/accesslog-exporter/pkg/net"
+	"github.com/ozonru/accesslog-exporter/relabel"
 )
 
 const (
@@ -24,19 +30,54 @@ const (
 	requestTimeVar   = "$request_time"
 	requestVar       = "$request"
 	hostVar          = "$host"
+	requestMethodVar = "$request_method"
+	// upstreamStatusVar contains statuses of all upstreams tried, for example "504, 200" or "502 : 200"
+	upstreamStatusVar = "$upstream_status"
 
 	unknownLabelValue  = "unknown"
 	internalLabelValue = "internal"
-
-	userAgentLabelName = "user_agent"
-	osLabelName        = "os"
-	deviceLabelName    = "device"
+	externalLabelValue = "external"
+
+	networkLabelName     = "network"
+	clientClassLabelName = "client_class"
+	codeClassLabelName   = "code_class"
+	outcomeLabelName     = "outcome"
+
+	outcomeSuccess         = "success"
+	outcomeClientError     = "client_error"
+	outcomeServerError     = "server_error"
+	outcomeClientAbort     = "client_abort"
+	outcomeUpstreamTimeout = "upstream_timeout"
+
+	apdexSatisfied  = "satisfied"
+	apdexTolerating = "tolerating"
+	apdexFrustrated = "frustrated"
+
+	clientClassHuman         = "human"
+	clientClassBotVerified   = "bot_verified"
+	clientClassBotUnverified = "bot_unverified"
+	clientClassMonitoring    = "monitoring"
+
+	// spiderDeviceFamily is a device family of bots and crawlers detected by user agent parser
+	spiderDeviceFamily = "Spider"
+
+	userAgentLabelName  = "user_agent"
+	osLabelName         = "os"
+	deviceLabelName     = "device"
+	deviceTypeLabelName = "device_type"
+	hostLabelName       = "host"
+	uriLabelName        = "uri"
+	codeLabelName       = "code"
+	nginxHostLabelName  = "nginx_host"
 
 	deviceTypeMobile  = "mobile"
 	deviceTypeTablet  = "tablet"
 	deviceTypeDesktop = "desktop"
 )
 
+// traceparentRe matches W3C traceparent header value version-traceid-parentid-flags
+var traceparentRe = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
 // pool contains set of workers
 type pool chan IWorker
 
@@ -46,43 +87,156 @@ type IWorker interface {
 }
 
 type ExportWorker struct {
+	cfg *config.Config
+
 	logLinePsr   parser.LogLineParser
 	userAgentPsr parser.UserAgentParser
 
-	cc cache.Cache
+	cc          cache.Cache
+	geoResolver geoip.Resolver
+
+	// clientClassUsed is set if client class is used by metrics or relabel configs, it is not detected otherwise
+	clientClassUsed bool
 
-	exposeFunc exposer.Exposer
+	metrics *metrics
+	// parseErrors keeps failed lines and limits logging of failures, it is shared by workers of exporter
+	parseErrors *ParseErrors
 
-	internalSubNets *[]string
-	sources         *[]config.Source
-	hosts           *[]config.Host
+	observers        []Observer
+	requestObservers []RequestObserver
+}
+
+// Observer observes variables of log lines, that are parsed and not dropped by filters and relabel configs
+type Observer interface {
+	Observe(nginxHost string, data map[string]string)
+}
 
-	userAgentReplacementSettings  *[]config.UserAgentReplacementSetting
-	requestURIReplacementSettings *[]config.RequestURIReplacementSetting
+// RequestObserver observes requests of log lines with labels detected by exporter, log lines are selected
+// as for Observer
+type RequestObserver interface {
+	ObserveRequest(request *Request)
 }
 
+// Request contains labels of request detected by exporter after relabeling, client address is nil if it is invalid.
+// Response time is zero, if it is not logged.
+type Request struct {
+	NginxHost    string
+	Host         string
+	URI          string
+	Method       string
+	Code         string
+	ClientIP     stdnet.IP
+	UserAgent    string
+	ResponseTime float64
+
+	// labels of parsed user agent
+	UserAgentLabel string
+	OSLabel        string
+	DeviceLabel    string
+	DeviceType     string
+
+	// Content is a raw log line and Data contains its variables, they should not be modified
+	Content string
+	Data    map[string]string
+}
+
+// NewExportWorker creates worker with settings of subnets, sources, user agents, URIs and hosts, other settings
+// are empty. Invalid internal subnets are ignored, they are validated on loading of config.
 func NewExportWorker(
 	logLinePsr parser.LogLineParser,
 	userAgentPsr parser.UserAgentParser,
 	cc cache.Cache,
-	exposeFunc exposer.Exposer,
+	metrics *metrics,
 	internalSubNets *[]string,
-	source *[]config.Source,
+	sources *[]config.Source,
 	userAgentReplacementSettings *[]config.UserAgentReplacementSetting,
 	requestURIReplacements *[]config.RequestURIReplacementSetting,
 	hosts *[]config.Host,
 ) *ExportWorker {
-	return &ExportWorker{
-		logLinePsr:                    logLinePsr,
-		userAgentPsr:                  userAgentPsr,
-		cc:                            cc,
-		exposeFunc:                    exposeFunc,
-		internalSubNets:               internalSubNets,
-		sources:                       source,
-		userAgentReplacementSettings:  userAgentReplacementSettings,
-		requestURIReplacementSettings: requestURIReplacements,
-		hosts:                         hosts,
+	cfg := &config.Config{}
+	if internalSubNets != nil {
+		cfg.Global.InternalSubnets = *internalSubNets
+		cfg.Global.InternalSubnetsTrie = net.NewTrie()
+		for _, subNet := range *internalSubNets {
+			if IPNets, err := net.ParseCIDRs([]string{subNet}); err == nil {
+				cfg.Global.InternalSubnetsTrie.Insert(IPNets[0], internalLabelValue)
+			}
+		}
+	}
+	if sources != nil {
+		cfg.Sources = *sources
+	}
+	if userAgentReplacementSettings != nil {
+		cfg.Global.UserAgentReplacementSettings = *userAgentReplacementSettings
+	}
+	if requestURIReplacements != nil {
+		cfg.Global.RequestURIReplacementSettings = *requestURIReplacements
+	}
+	if hosts != nil {
+		cfg.Global.Hosts = *hosts
+	}
+
+	return newExportWorker(cfg, logLinePsr, userAgentPsr, cc, nil, metrics)
+}
+
+// newExportWorker creates worker with all settings of config. Observers implement Observer, RequestObserver
+// or both, other values are ignored.
+func newExportWorker(
+	cfg *config.Config,
+	logLinePsr parser.LogLineParser,
+	userAgentPsr parser.UserAgentParser,
+	cc cache.Cache,
+	geoResolver geoip.Resolver,
+	metrics *metrics,
+	observers ...interface{},
+) *ExportWorker {
+	w := &ExportWorker{
+		cfg:          cfg,
+		logLinePsr:   logLinePsr,
+		userAgentPsr: userAgentPsr,
+		cc:           cc,
+		geoResolver:  geoResolver,
+		metrics:      metrics,
+		parseErrors:  NewParseErrors(0, 0),
+
+		clientClassUsed: isLabelUsed(cfg, clientClassLabelName),
 	}
+
+	for _, observer := range observers {
+		if o, ok := observer.(Observer); ok {
+			w.observers = append(w.observers, o)
+		}
+		if o, ok := observer.(RequestObserver); ok {
+			w.requestObservers = append(w.requestObservers, o)
+		}
+	}
+
+	return w
+}
+
+// isLabelUsed checks if label is added to some metric or could be read by relabel configs
+func isLabelUsed(cfg *config.Config, name string) bool {
+	for _, labels := range cfg.Global.MetricLabels {
+		for _, label := range labels {
+			if label == name {
+				return true
+			}
+		}
+	}
+
+	for _, c := range cfg.Global.RelabelConfigs {
+		if c.Action == relabel.LabelMap {
+			return true
+		}
+
+		for _, label := range c.SourceLabels {
+			if label == name {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 // Process processes log lines and exports metrics
@@ -90,39 +244,74 @@ func (e *ExportWorker) Process(line *input.LogLine, ctx context.Context) {
 	format := e.detectFormat(ctx, line.NginxHost)
 
 	data, err := e.logLinePsr(format, line.Content)
-	if err != nil {
-		logging.WithContext(ctx).Sugar().With(
-			"format", format,
-			"content", line.Content,
-		).Warnf("could not parse log line: %s", err)
+	parsed := err == nil
+	if !parsed {
+		reason := reasonOther
+		if errors.Is(err, parser.ErrFieldCountMismatch) {
+			reason = reasonFieldCountMismatch
+		}
+
+		e.reportParseError(ctx, line, format, reason, err)
+	}
+
+	if name, dropped := e.filterLine(data, line.NginxHost); dropped {
+		e.metrics.logsFilterDroppedTotal.Inc(e.cfg.WithSourceLabels(line.NginxHost, line.NginxHost, name)...)
 
-		e.exposeFunc(exposer.LogsFailParsedTotalName, []string{line.NginxHost}, float64(0))
+		return
 	}
 
-	e.exportMetrics(data, line.NginxHost, ctx)
+	e.exportMetrics(data, line, format, parsed, ctx)
 }
 
-// exportMetrics exports defined metrics.
-func (e *ExportWorker) exportMetrics(data map[string]string, nginxHost string, ctx context.Context) {
+// reportParseError counts failure of log line by reason, keeps it for /debug/parse-errors and logs it,
+// unless failures of its source were logged recently
+func (e *ExportWorker) reportParseError(ctx context.Context, line *input.LogLine, format, reason string, err error) {
+	e.metrics.logsFailParsedTotal.Inc(e.cfg.WithSourceLabels(line.NginxHost, line.NginxHost, reason)...)
+
+	suppressed, log := e.parseErrors.add(line.NginxHost, format, line.Content, reason, err)
+	if !log {
+		return
+	}
+
+	logging.WithContext(ctx).Sugar().With(
+		"format", format,
+		"content", line.Content,
+		"reason", reason,
+		"suppressed", suppressed,
+	).Warnf("could not parse log line: %s", err)
+}
+
+// exportMetrics exports defined metrics. At most one failure is reported by log line, failures of detection
+// of labels are not reported, if line could not be parsed.
+func (e *ExportWorker) exportMetrics(data map[string]string, line *input.LogLine, format string, parsed bool, ctx context.Context) {
+	nginxHost := line.NginxHost
+
+	// detect client address
+	clientIP, err := e.detectClientIP(data)
+	if err != nil {
+		e.metrics.invalidClientAddressesTotal.Inc(e.cfg.WithSourceLabels(nginxHost, nginxHost)...)
+	}
+
 	// try to detect user agent, os, device using custom settings from config
 	uaLbs := e.tryDetectCustomUserAgentLabels(data)
 	if uaLbs == nil {
 		uaLbs = &uaLabels{internalLabelValue, internalLabelValue, internalLabelValue}
 		// check if it is needed to parse user agent labels
-		if e.needParseUserAgent(data, ctx) {
+		if e.needParseUserAgent(clientIP) {
 			uaLbs = e.detectUserAgentLabels(data, nginxHost)
 		} else {
-			e.exposeFunc(exposer.LogsFilteredTotal, []string{nginxHost}, float64(0))
+			e.metrics.logsFilteredTotal.Inc(e.cfg.WithSourceLabels(nginxHost, nginxHost)...)
 		}
 	}
 
 	// detect device type label
 	deviceType := e.detectDeviceType(data, uaLbs.userAgent, uaLbs.os, uaLbs.device)
 
-	// detect http code label
+	// detect http code label, the first failure of line is reported
+	reason, failure := "", error(nil)
 	httpCode, err := e.detectHttpCodeLabel(data)
 	if err != nil {
-		logging.WithContext(ctx).Sugar().Errorf("could not parse http code: %s", err)
+		reason, failure = reasonBadStatus, fmt.Errorf("could not parse http code: %s", err)
 	}
 
 	// detect host label
@@ -131,28 +320,358 @@ func (e *ExportWorker) exportMetrics(data map[string]string, nginxHost string, c
 	// detect URI label
 	URI := e.detectURILabel(data)
 
+	// detect extra labels, that can be added to metrics
+	extraLbs := e.detectExtraLabels(data, clientIP, uaLbs)
+
 	// detect response duration metric value
 	responseDuration, ok, err := e.detectResponseDuration(data)
-	if err != nil {
-		logging.WithContext(ctx).Sugar().Warnf("could not detect response duration: %s", err)
+	if err != nil && failure == nil {
+		reason, failure = reasonBadDuration, fmt.Errorf("could not detect response duration: %s", err)
+	}
+
+	if parsed && failure != nil {
+		e.reportParseError(ctx, line, format, reason, failure)
+	}
+
+	// apply relabel configs to nginx variables and computed labels
+	if len(e.cfg.Global.RelabelConfigs) > 0 {
+		labels := map[string]string{
+			hostLabelName:       host,
+			uriLabelName:        URI,
+			codeLabelName:       httpCode,
+			userAgentLabelName:  uaLbs.userAgent,
+			osLabelName:         uaLbs.os,
+			deviceLabelName:     uaLbs.device,
+			deviceTypeLabelName: deviceType,
+			nginxHostLabelName:  nginxHost,
+		}
+		for name, value := range data {
+			labels[name] = value
+		}
+		for name, value := range extraLbs {
+			labels[name] = value
+		}
+
+		if !relabel.Process(labels, e.cfg.Global.RelabelConfigs) {
+			e.metrics.logsFilterDroppedTotal.Inc(e.cfg.WithSourceLabels(nginxHost, nginxHost, filter.RelabelName)...)
+
+			return
+		}
+
+		// user agent labels could be cached, so they are not modified
+		host, URI, httpCode, deviceType = labels[hostLabelName], labels[uriLabelName], labels[codeLabelName], labels[deviceTypeLabelName]
+		uaLbs = &uaLabels{labels[userAgentLabelName], labels[osLabelName], labels[deviceLabelName]}
+		extraLbs = labels
+	}
+
+	// detect exemplar linking response time to request
+	exemplar := e.detectExemplar(data)
+
+	// pass variables and request with detected labels to observers, lines that could not be parsed are not observed
+	if parsed {
+		e.observe(nginxHost, data, &Request{
+			NginxHost:    nginxHost,
+			Host:         host,
+			URI:          URI,
+			Method:       e.detectMethod(data),
+			Code:         httpCode,
+			ClientIP:     clientIP,
+			UserAgent:    data[httpUserAgentVar],
+			ResponseTime: responseDuration,
+
+			UserAgentLabel: uaLbs.userAgent,
+			OSLabel:        uaLbs.os,
+			DeviceLabel:    uaLbs.device,
+			DeviceType:     deviceType,
+
+			Content: line.Content,
+			Data:    data,
+		})
 	}
 
 	// expose metrics
+	m := e.metrics
 	if ok {
 		// response time by host and http code
-		e.exposeFunc(exposer.HostResponseTimeSecondsMetricName, []string{host, httpCode}, float64(responseDuration))
+		if labels, ok := e.requestLabels(m.hostResponseTimeSeconds.Name(), nginxHost, extraLbs, host, httpCode); ok {
+			m.hostResponseTimeSeconds.ObserveWithExemplar(responseDuration, exemplar, labels...)
+		}
 		// response time by host, user agent and http code
-		e.exposeFunc(exposer.UserAgentResponseTimeSecondsMetricName, []string{host, uaLbs.userAgent, httpCode}, float64(responseDuration))
+		if labels, ok := e.requestLabels(m.userAgentResponseTimeSeconds.Name(), nginxHost, extraLbs, host, uaLbs.userAgent, httpCode); ok {
+			m.userAgentResponseTimeSeconds.ObserveWithExemplar(responseDuration, exemplar, labels...)
+		}
 		// response time by host, URI and http code
-		e.exposeFunc(exposer.URIResponseTimeSecondsMetricName, []string{host, URI, httpCode}, float64(responseDuration))
+		if labels, ok := e.requestLabels(m.URIResponseTimeSeconds.Name(), nginxHost, extraLbs, host, URI, httpCode); ok {
+			m.URIResponseTimeSeconds.ObserveWithExemplar(responseDuration, exemplar, labels...)
+		}
 	}
 
+	// good requests and apdex of SLO objectives, requests without response time are counted as well
+	e.exportSLO(nginxHost, host, URI, httpCode, responseDuration, ok)
+
 	// requests count by host, user agent and http code
-	e.exposeFunc(exposer.UserAgentRequestsTotalMetricName, []string{host, uaLbs.userAgent, httpCode}, float64(0))
+	if labels, ok := e.requestLabels(m.userAgentRequestsTotal.Name(), nginxHost, extraLbs, host, uaLbs.userAgent, httpCode); ok {
+		m.userAgentRequestsTotal.Inc(labels...)
+	}
 	// requests count by host, os and device type
-	e.exposeFunc(exposer.OsDeviceTypeRequestsTotalMetricName, []string{host, uaLbs.os, deviceType}, float64(0))
+	if labels, ok := e.requestLabels(m.osDeviceTypeRequestsTotal.Name(), nginxHost, extraLbs, host, uaLbs.os, deviceType); ok {
+		m.osDeviceTypeRequestsTotal.Inc(labels...)
+	}
 	// requests by nginx host
-	e.exposeFunc(exposer.NginxRequestsTotal, []string{nginxHost}, float64(0))
+	m.nginxRequestsTotal.Inc(e.cfg.WithSourceLabels(nginxHost, nginxHost)...)
+
+	e.exportCustomMetrics(data, nginxHost)
+}
+
+// observe passes variables of log line and its request to observers. It is the only point of observation,
+// so observers receive only lines, that are parsed and not dropped by filters and relabel configs.
+func (e *ExportWorker) observe(nginxHost string, data map[string]string, request *Request) {
+	for _, observer := range e.observers {
+		observer.Observe(nginxHost, data)
+	}
+	for _, observer := range e.requestObservers {
+		observer.ObserveRequest(request)
+	}
+}
+
+// exportCustomMetrics exports custom metrics, that are not exposed if their condition or value could not
+// be evaluated. Labels, that could not be evaluated, are empty.
+func (e *ExportWorker) exportCustomMetrics(data map[string]string, nginxHost string) {
+	for _, metric := range e.metrics.custom {
+		if metric.Condition != nil {
+			if match, err := metric.Condition.EvalBool(data); err != nil || !match {
+				continue
+			}
+		}
+
+		value := 1.0
+		if metric.Value != nil {
+			var err error
+			if value, err = metric.Value.EvalFloat(data); err != nil {
+				continue
+			}
+		}
+		if metric.Type == config.CustomMetricTypeCounter && value < 0 {
+			continue
+		}
+
+		labels := make([]string, 0, len(metric.Labels))
+		for _, label := range metric.Labels {
+			value, _ := label.EvalString(data)
+			labels = append(labels, value)
+		}
+
+		metric.observe(value, e.cfg.WithSourceLabels(nginxHost, labels...)...)
+	}
+}
+
+// exportSLO exports total and good requests and apdex zones of SLO objectives, that select request.
+// Request without response time is good, if it succeeds and objective has no latency threshold. It is counted
+// in apdex zones only if it fails.
+func (e *ExportWorker) exportSLO(nginxHost, host, URI, httpCode string, responseDuration float64, hasDuration bool) {
+	for _, objective := range e.cfg.Global.SLOObjectives {
+		if !objective.Matches(host, URI) {
+			continue
+		}
+
+		labels := e.cfg.WithSourceLabels(nginxHost, objective.Name, host, URI)
+		success := objective.IsSuccess(httpCode)
+
+		e.metrics.sloRequestsTotal.Inc(labels...)
+
+		latencyThreshold := objective.LatencyThreshold.Seconds()
+		if success && (latencyThreshold == 0 || hasDuration && responseDuration <= latencyThreshold) {
+			e.metrics.sloGoodRequestsTotal.Inc(labels...)
+		}
+
+		apdexThreshold := objective.ApdexThreshold.Seconds()
+		if apdexThreshold == 0 || success && !hasDuration {
+			continue
+		}
+
+		zone := apdexFrustrated
+		switch {
+		case !success:
+		case responseDuration <= apdexThreshold:
+			zone = apdexSatisfied
+		case responseDuration <= 4*apdexThreshold:
+			zone = apdexTolerating
+		}
+
+		e.metrics.apdexRequestsTotal.Inc(e.cfg.WithSourceLabels(nginxHost, objective.Name, host, URI, zone)...)
+	}
+}
+
+// detectExemplar returns exemplar labels from the first non-empty configured variable. Trace id is extracted
+// from W3C traceparent header value. Nil is returned if exemplars are not configured or value is not found.
+func (e *ExportWorker) detectExemplar(data map[string]string) map[string]string {
+	exemplars := e.cfg.Global.Exemplars
+	if exemplars == nil {
+		return nil
+	}
+
+	for _, variable := range exemplars.Variables {
+		value := data[variable]
+		if value == "" || value == "-" {
+			continue
+		}
+
+		if match := traceparentRe.FindStringSubmatch(value); match != nil {
+			value = match[1]
+		}
+
+		return map[string]string{exemplars.LabelName: value}
+	}
+
+	return nil
+}
+
+// requestLabels returns labels of request metric extended by extra labels configured for the metric and labels
+// of source. The metric should not be exposed if it is excluded for the network of client.
+func (e *ExportWorker) requestLabels(name, nginxHost string, extraLbs map[string]string, labels ...string) ([]string, bool) {
+	if e.isExcludedForNetwork(name, extraLbs[networkLabelName]) {
+		return nil, false
+	}
+
+	for _, label := range e.cfg.Global.MetricLabels[name] {
+		labels = append(labels, extraLbs[label])
+	}
+
+	return e.cfg.WithSourceLabels(nginxHost, labels...), true
+}
+
+// detectExtraLabels detects labels that can be added to metrics using metric_labels config.
+func (e *ExportWorker) detectExtraLabels(data map[string]string, clientIP stdnet.IP, uaLbs *uaLabels) map[string]string {
+	extraLbs := map[string]string{
+		codeClassLabelName: e.detectCodeClass(data),
+		outcomeLabelName:   e.detectOutcome(data),
+	}
+
+	if e.clientClassUsed {
+		extraLbs[clientClassLabelName] = e.detectClientClass(data, clientIP, uaLbs)
+	}
+
+	if e.geoResolver != nil {
+		extraLbs[geoip.CountryLabelName] = unknownLabelValue
+		extraLbs[geoip.ASNLabelName] = unknownLabelValue
+
+		if clientIP != nil {
+			location := e.geoResolver.Resolve(clientIP.String())
+			extraLbs[geoip.CountryLabelName] = location.Country
+			extraLbs[geoip.ASNLabelName] = location.ASN
+		}
+	}
+
+	if e.cfg.Global.NetworksTrie != nil {
+		extraLbs[networkLabelName] = e.detectNetworkLabel(clientIP)
+	}
+
+	// label is empty, if its expression could not be evaluated
+	for _, label := range e.cfg.Global.ComputedLabels {
+		extraLbs[label.Name], _ = label.Expression.EvalString(data)
+	}
+
+	return extraLbs
+}
+
+// detectNetworkLabel detects name of network, that contains client address.
+func (e *ExportWorker) detectNetworkLabel(clientIP stdnet.IP) string {
+	if clientIP == nil {
+		return unknownLabelValue
+	}
+
+	if network, ok := e.cfg.Global.NetworksTrie.Lookup(clientIP); ok {
+		return network
+	}
+
+	return externalLabelValue
+}
+
+// detectClientClass classifies client as human, monitoring or bot, the bot is verified if it comes from subnets
+// of known crawler.
+func (e *ExportWorker) detectClientClass(data map[string]string, clientIP stdnet.IP, uaLbs *uaLabels) string {
+	bots := e.cfg.Global.Bots
+	userAgent := data[httpUserAgentVar]
+
+	isBot := uaLbs.device == spiderDeviceFamily
+	if bots == nil {
+		if isBot {
+			return clientClassBotUnverified
+		}
+
+		return clientClassHuman
+	}
+
+	if matchAny(bots.MonitoringUserAgents, userAgent) {
+		return clientClassMonitoring
+	}
+
+	for _, crawler := range bots.VerifiedCrawlers {
+		if !crawler.MatchRe.MatchString(userAgent) {
+			continue
+		}
+
+		if clientIP != nil {
+			if _, ok := crawler.SubnetsTrie.Lookup(clientIP); ok {
+				return clientClassBotVerified
+			}
+		}
+
+		isBot = true
+	}
+
+	if isBot || matchAny(bots.UserAgents, userAgent) {
+		return clientClassBotUnverified
+	}
+
+	return clientClassHuman
+}
+
+// matchAny checks if the value matches any of regular expressions.
+func matchAny(res []*regexp.Regexp, value string) bool {
+	for _, re := range res {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isExcludedForNetwork checks whether metric is excluded for network.
+func (e *ExportWorker) isExcludedForNetwork(name, network string) bool {
+	if network == "" {
+		return false
+	}
+
+	for _, n := range e.cfg.Global.Networks {
+		if n.Name != network {
+			continue
+		}
+
+		for _, excluded := range n.ExcludeMetrics {
+			if excluded == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// detectClientIP detects ip address of client, taking into account trusted proxies.
+// The nil address without error is returned, if log line doesn't contain remote address.
+func (e *ExportWorker) detectClientIP(data map[string]string) (stdnet.IP, error) {
+	rAddr, ok := data[remoteAddrVar]
+	if !ok {
+		return nil, nil
+	}
+
+	if realIP := e.cfg.Global.RealIP; realIP != nil {
+		rAddr = net.RealIP(rAddr, data[realIP.Header], realIP.TrustedProxyNets, realIP.Recursive)
+	}
+
+	return net.NormalizeIP(rAddr)
 }
 
 // tryDetectCustomUserAgentLabels tries to detect user agent using custom settings from config.
@@ -161,7 +680,7 @@ func (e *ExportWorker) tryDetectCustomUserAgentLabels(data map[string]string) *u
 
 	if v, ok := data[httpUserAgentVar]; ok {
 		// detect custom user agents
-		for _, rep := range *e.userAgentReplacementSettings {
+		for _, rep := range e.cfg.Global.UserAgentReplacementSettings {
 			if rep.MatchRe != nil && rep.MatchRe.MatchString(v) {
 				uaLbs = &uaLabels{
 					rep.MatchRe.ReplaceAllString(rep.MatchRe.FindString(v), rep.Replacements.UserAgent),
@@ -181,9 +700,33 @@ func (e *ExportWorker) tryDetectCustomUserAgentLabels(data map[string]string) *u
 	return uaLbs
 }
 
+// filterLine applies global filters and filters of source to variables of log line. It returns name of filter,
+// that drops the line.
+func (e *ExportWorker) filterLine(data map[string]string, nginxHost string) (string, bool) {
+	for _, f := range e.cfg.Global.Filters {
+		if f.Drops(data) {
+			return f.Name, true
+		}
+	}
+
+	for _, source := range e.cfg.Sources {
+		if source.Host != nginxHost {
+			continue
+		}
+
+		for _, f := range source.Filters {
+			if f.Drops(data) {
+				return f.Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
 // detectFormat tries to detect log format according config.
 func (e *ExportWorker) detectFormat(ctx context.Context, nginxHost string) string {
-	for _, source := range *e.sources {
+	for _, source := range e.cfg.Sources {
 		if source.Host == nginxHost {
 			return source.LogFormat
 		}
@@ -211,8 +754,8 @@ func (e *ExportWorker) detectUserAgentLabels(data map[string]string, nginxHost s
 
 			e.cc.Set(v, labels)
 
-			e.exposeFunc(exposer.UserAgentCachedTotal, []string{nginxHost}, float64(0))
-			e.exposeFunc(exposer.UserAgentCurrentCachedTotal, []string{nginxHost}, float64(e.cc.Len()))
+			e.metrics.userAgentCachedTotal.Inc(e.cfg.WithSourceLabels(nginxHost, nginxHost)...)
+			e.metrics.userAgentCurrentCachedTotal.Set(float64(e.cc.Len()), e.cfg.WithSourceLabels(nginxHost, nginxHost)...)
 		}
 
 		uaLbs.userAgent = labels[userAgentLabelName]
@@ -224,20 +767,14 @@ func (e *ExportWorker) detectUserAgentLabels(data map[string]string, nginxHost s
 }
 
 // needParseUserAgent detects whether it is needed to parse user agent.
-func (e *ExportWorker) needParseUserAgent(data map[string]string, ctx context.Context) bool {
-	rAddr, ok := data[remoteAddrVar]
-	if !ok {
+func (e *ExportWorker) needParseUserAgent(clientIP stdnet.IP) bool {
+	if clientIP == nil || e.cfg.Global.InternalSubnetsTrie == nil {
 		return true
 	}
 
-	contains, err := net.IsSubnetContainsIP(rAddr, *e.internalSubNets)
-	if err != nil {
-		logging.WithContext(ctx).Sugar().Warnf("could not detect if ip belongs to subnet: %s", err)
-
-		return true
-	}
+	_, internal := e.cfg.Global.InternalSubnetsTrie.Lookup(clientIP)
 
-	return !contains
+	return !internal
 }
 
 // detectHttpCodeLabel tries to detect http code.
@@ -254,6 +791,68 @@ func (e *ExportWorker) detectHttpCodeLabel(data map[string]string) (string, erro
 	return unknownLabelValue, nil
 }
 
+// detectCodeClass detects class of http code: 1xx, 2xx, 3xx, 4xx or 5xx.
+func (e *ExportWorker) detectCodeClass(data map[string]string) string {
+	code, err := strconv.Atoi(data[statusVar])
+	if err != nil || code < 100 || code > 599 {
+		return unknownLabelValue
+	}
+
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// detectOutcome categorizes request as success, client_error, server_error, client_abort or upstream_timeout.
+// Timeouts are detected by the last status of upstream, if request was proxied.
+func (e *ExportWorker) detectOutcome(data map[string]string) string {
+	code, err := strconv.Atoi(data[statusVar])
+	if err != nil || code < 100 || code > 599 {
+		return unknownLabelValue
+	}
+
+	outcome := e.cfg.Global.Outcome
+	if outcome == nil {
+		outcome = &config.Outcome{}
+	}
+
+	if containsCode(outcome.ClientAbortCodes, code) {
+		return outcomeClientAbort
+	}
+
+	if code >= 500 {
+		upstreamCode := code
+		if statuses := strings.FieldsFunc(data[upstreamStatusVar], func(r rune) bool {
+			return r == ',' || r == ':' || r == ' '
+		}); len(statuses) > 0 {
+			if upstreamCode, err = strconv.Atoi(statuses[len(statuses)-1]); err != nil {
+				upstreamCode = code
+			}
+		}
+
+		if containsCode(outcome.UpstreamTimeoutCodes, upstreamCode) {
+			return outcomeUpstreamTimeout
+		}
+
+		return outcomeServerError
+	}
+
+	if code >= 400 {
+		return outcomeClientError
+	}
+
+	return outcomeSuccess
+}
+
+// containsCode checks if list contains http code
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
 // detectURILabel detects URI label.
 func (e *ExportWorker) detectURILabel(data map[string]string) string {
 	if v, ok := data[requestVar]; ok {
@@ -265,7 +864,7 @@ func (e *ExportWorker) detectURILabel(data map[string]string) string {
 		method := request[0]
 		URI := request[1]
 
-		for _, rep := range *e.requestURIReplacementSettings {
+		for _, rep := range e.cfg.Global.RequestURIReplacementSettings {
 			if rep.Method != "" && rep.Method != method {
 				return ""
 			}
@@ -278,15 +877,28 @@ func (e *ExportWorker) detectURILabel(data map[string]string) string {
 	return ""
 }
 
+// detectMethod detects method of request by $request_method or by request line
+func (e *ExportWorker) detectMethod(data map[string]string) string {
+	if v, ok := data[requestMethodVar]; ok {
+		return v
+	}
+
+	if v, ok := data[requestVar]; ok {
+		if i := strings.IndexByte(v, ' '); i > 0 {
+			return v[:i]
+		}
+	}
+
+	return ""
+}
+
 // detectHostLabel detects host of request
 func (e *ExportWorker) detectHostLabel(data map[string]string) string {
 	if v, ok := data[hostVar]; ok {
 		// check if there is replacement for host label
-		if e.hosts != nil {
-			for _, repl := range *e.hosts {
-				if repl.Match == v {
-					return repl.Replacement
-				}
+		for _, repl := range e.cfg.Global.Hosts {
+			if repl.Match == v {
+				return repl.Replacement
 			}
 		}
 
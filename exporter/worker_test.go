@@ -2,10 +2,25 @@ package exporter
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/expr"
+	"github.com/ozonru/accesslog-exporter/filter"
+	"github.com/ozonru/accesslog-exporter/geoip"
+	"github.com/ozonru/accesslog-exporter/input"
+	"github.com/ozonru/accesslog-exporter/parser"
+	"github.com/ozonru/accesslog-exporter/pkg/net"
+	"github.com/ozonru/accesslog-exporter/relabel"
 
 	. "gopkg.in/check.v1"
 )
@@ -102,7 +117,7 @@ func (s WorkerSuite) TestDetectUserAgentLabels(c *C) {
 		nil,
 		NewDummyUserAgentParser("ustest", "devicetest", "ostest"),
 		&DummyCache{},
-		newDummyExposeFunc(c),
+		newDummyMetrics(c, newDummySink(c), nil),
 		nil,
 		nil,
 		nil,
@@ -135,9 +150,57 @@ func (s WorkerSuite) TestNeedParseUserAgent(c *C) {
 		nil,
 	)
 
-	c.Assert(w.needParseUserAgent(map[string]string{"$remote_addr": "30.2.2.1"}, context.Background()), Equals, false)
-	c.Assert(w.needParseUserAgent(map[string]string{}, context.Background()), Equals, true)
-	c.Assert(w.needParseUserAgent(map[string]string{"$remote_addr": "33.1.1.1"}, context.Background()), Equals, true)
+	c.Assert(w.needParseUserAgent(stdnet.ParseIP("30.2.2.1")), Equals, false)
+	c.Assert(w.needParseUserAgent(nil), Equals, true)
+	c.Assert(w.needParseUserAgent(stdnet.ParseIP("33.1.1.1")), Equals, true)
+}
+
+func (s WorkerSuite) TestDetectClientIP(c *C) {
+	w := newExportWorker(
+		&config.Config{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	data := map[string]string{
+		"$remote_addr":          "10.1.1.1",
+		"$http_x_forwarded_for": "81.2.69.142, 10.2.2.2",
+		"$proxy_protocol_addr":  "89.160.20.1",
+	}
+
+	assertClientIP := func(data map[string]string, expected string) {
+		clientIP, err := w.detectClientIP(data)
+		c.Assert(err, IsNil)
+		c.Assert(clientIP.String(), Equals, expected)
+	}
+
+	assertClientIP(data, "10.1.1.1")
+
+	clientIP, err := w.detectClientIP(map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(clientIP, IsNil)
+
+	clientIP, err = w.detectClientIP(map[string]string{"$remote_addr": "unix:"})
+	c.Assert(err, ErrorMatches, `invalid ip address: "unix:"`)
+	c.Assert(clientIP, IsNil)
+
+	trustedProxyNets, err := net.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	w.cfg.Global.RealIP = &config.RealIP{Header: "$http_x_forwarded_for", TrustedProxyNets: trustedProxyNets}
+	assertClientIP(data, "10.2.2.2")
+
+	w.cfg.Global.RealIP.Recursive = true
+	assertClientIP(data, "81.2.69.142")
+
+	// forwarded address with port
+	assertClientIP(map[string]string{"$remote_addr": "10.1.1.1", "$http_x_forwarded_for": "81.2.69.142:51234"}, "81.2.69.142")
+
+	w.cfg.Global.RealIP = &config.RealIP{Header: "$proxy_protocol_addr", TrustedProxyNets: trustedProxyNets}
+	assertClientIP(data, "89.160.20.1")
 }
 
 func (s WorkerSuite) TestDetectHttpCodeLabel(c *C) {
@@ -170,6 +233,62 @@ func (s WorkerSuite) TestDetectHttpCodeLabel(c *C) {
 	c.Assert(httpCode, Equals, "unknown")
 }
 
+func (s WorkerSuite) TestDetectCodeClass(c *C) {
+	w := newExportWorker(&config.Config{}, nil, nil, nil, nil, nil)
+
+	c.Assert(w.detectCodeClass(map[string]string{"$status": "101"}), Equals, "1xx")
+	c.Assert(w.detectCodeClass(map[string]string{"$status": "204"}), Equals, "2xx")
+	c.Assert(w.detectCodeClass(map[string]string{"$status": "499"}), Equals, "4xx")
+	c.Assert(w.detectCodeClass(map[string]string{"$status": "503"}), Equals, "5xx")
+	c.Assert(w.detectCodeClass(map[string]string{"$status": "0"}), Equals, "unknown")
+	c.Assert(w.detectCodeClass(map[string]string{"$status": "-"}), Equals, "unknown")
+	c.Assert(w.detectCodeClass(map[string]string{}), Equals, "unknown")
+}
+
+func (s WorkerSuite) TestDetectOutcome(c *C) {
+	w := newExportWorker(
+		&config.Config{Global: config.Global{Outcome: &config.Outcome{
+			ClientAbortCodes:     []int{499, 444},
+			UpstreamTimeoutCodes: []int{504},
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	testCases := []struct {
+		data     map[string]string
+		expected string
+	}{
+		{data: map[string]string{"$status": "200"}, expected: "success"},
+		{data: map[string]string{"$status": "304"}, expected: "success"},
+		{data: map[string]string{"$status": "404"}, expected: "client_error"},
+		{data: map[string]string{"$status": "499"}, expected: "client_abort"},
+		{data: map[string]string{"$status": "444"}, expected: "client_abort"},
+		{data: map[string]string{"$status": "500"}, expected: "server_error"},
+		{data: map[string]string{"$status": "504"}, expected: "upstream_timeout"},
+		{data: map[string]string{"$status": "504", "$upstream_status": "-"}, expected: "upstream_timeout"},
+		// the last upstream status is used
+		{data: map[string]string{"$status": "502", "$upstream_status": "502, 504"}, expected: "upstream_timeout"},
+		{data: map[string]string{"$status": "504", "$upstream_status": "504 : 502"}, expected: "server_error"},
+		// upstream timeout with successful retry is a success
+		{data: map[string]string{"$status": "200", "$upstream_status": "504, 200"}, expected: "success"},
+		{data: map[string]string{"$status": "invalid"}, expected: "unknown"},
+		{data: map[string]string{}, expected: "unknown"},
+	}
+
+	for _, tc := range testCases {
+		c.Assert(w.detectOutcome(tc.data), Equals, tc.expected, Commentf("%v", tc.data))
+	}
+
+	// without settings only classes of codes are used
+	w = newExportWorker(&config.Config{}, nil, nil, nil, nil, nil)
+	c.Assert(w.detectOutcome(map[string]string{"$status": "499"}), Equals, "client_error")
+	c.Assert(w.detectOutcome(map[string]string{"$status": "504"}), Equals, "server_error")
+}
+
 func (s WorkerSuite) TestDetectURILabel(c *C) {
 	replacements := []config.RequestURIReplacementSetting{{
 		Method:       "POST",
@@ -387,3 +506,738 @@ func (s WorkerSuite) TestDetectDeviceType(c *C) {
 	)
 	c.Assert(deviceType, Equals, "desktop")
 }
+
+func (s WorkerSuite) TestDetectExtraLabels(c *C) {
+	humanUaLbs := &uaLabels{userAgent: "Chrome", os: "Mac OS X", device: "Other"}
+
+	w := newExportWorker(
+		&config.Config{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	extraLbs := w.detectExtraLabels(map[string]string{}, stdnet.ParseIP("81.2.69.142"), humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"code_class": "unknown", "outcome": "unknown"})
+
+	w = newExportWorker(
+		&config.Config{},
+		nil,
+		nil,
+		nil,
+		NewDummyGeoResolver(map[string]geoip.Location{"81.2.69.142": {Country: "GB", ASN: "20712"}}),
+		nil,
+	)
+
+	extraLbs = w.detectExtraLabels(map[string]string{}, stdnet.ParseIP("81.2.69.142"), humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"country": "GB", "asn": "20712", "code_class": "unknown", "outcome": "unknown"})
+
+	extraLbs = w.detectExtraLabels(map[string]string{}, nil, humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"country": "unknown", "asn": "unknown", "code_class": "unknown", "outcome": "unknown"})
+
+	// computed label is empty, if its expression fails
+	w = newExportWorker(
+		&config.Config{Global: config.Global{ComputedLabels: []config.ComputedLabel{
+			{Name: "api_version", Expression: expr.MustCompile(`split($request_uri, "/")[2]`)},
+			{Name: "slow", Expression: expr.MustCompile(`$request_time > 1 ? "yes" : "no"`)},
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	extraLbs = w.detectExtraLabels(map[string]string{"$request_uri": "/api/v2/users", "$request_time": "-"}, nil, humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"code_class": "unknown", "outcome": "unknown", "api_version": "v2", "slow": ""})
+
+	// client class is detected only if it is used
+	w = newExportWorker(
+		&config.Config{Global: config.Global{MetricLabels: map[string][]string{
+			exposer.UserAgentRequestsTotalMetricName: {"client_class"},
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	extraLbs = w.detectExtraLabels(map[string]string{}, nil, humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"client_class": "human", "code_class": "unknown", "outcome": "unknown"})
+
+	w = newExportWorker(
+		&config.Config{Global: config.Global{RelabelConfigs: []*relabel.Config{
+			{SourceLabels: []string{"client_class"}, Regex: "bot_.*", Action: relabel.Drop},
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	extraLbs = w.detectExtraLabels(map[string]string{}, nil, humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"client_class": "human", "code_class": "unknown", "outcome": "unknown"})
+}
+
+func (s WorkerSuite) TestDetectNetworkLabel(c *C) {
+	humanUaLbs := &uaLabels{userAgent: "Chrome", os: "Mac OS X", device: "Other"}
+
+	networksTrie := net.NewTrie()
+	for subNet, network := range map[string]string{"10.0.0.0/8": "datacenter", "10.1.0.0/16": "office"} {
+		IPNets, err := net.ParseCIDRs([]string{subNet})
+		c.Assert(err, IsNil)
+		networksTrie.Insert(IPNets[0], network)
+	}
+
+	w := newExportWorker(
+		&config.Config{Global: config.Global{NetworksTrie: networksTrie}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	c.Assert(w.detectNetworkLabel(stdnet.ParseIP("10.2.0.1")), Equals, "datacenter")
+	c.Assert(w.detectNetworkLabel(stdnet.ParseIP("10.1.0.1")), Equals, "office")
+	c.Assert(w.detectNetworkLabel(stdnet.ParseIP("81.2.69.142")), Equals, "external")
+	c.Assert(w.detectNetworkLabel(nil), Equals, "unknown")
+
+	extraLbs := w.detectExtraLabels(map[string]string{}, stdnet.ParseIP("10.1.0.1"), humanUaLbs)
+	c.Assert(extraLbs, DeepEquals, map[string]string{"network": "office", "code_class": "unknown", "outcome": "unknown"})
+}
+
+func (s WorkerSuite) TestDetectClientClass(c *C) {
+	humanUaLbs := &uaLabels{userAgent: "Chrome", os: "Mac OS X", device: "Other"}
+	spiderUaLbs := &uaLabels{userAgent: "Googlebot", os: "Other", device: "Spider"}
+
+	googlebotData := map[string]string{"$http_user_agent": "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"}
+
+	w := newExportWorker(
+		&config.Config{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	// bots are detected by user agent parser without config
+	c.Assert(w.detectClientClass(map[string]string{}, nil, humanUaLbs), Equals, "human")
+	c.Assert(w.detectClientClass(googlebotData, stdnet.ParseIP("66.249.66.1"), spiderUaLbs), Equals, "bot_unverified")
+
+	googleSubnets, err := net.ParseCIDRs([]string{"66.249.64.0/19"})
+	c.Assert(err, IsNil)
+	googleSubnetsTrie := net.NewTrie()
+	googleSubnetsTrie.Insert(googleSubnets[0], "googlebot")
+
+	w.cfg.Global.Bots = &config.Bots{
+		UserAgents:           []*regexp.Regexp{regexp.MustCompile(`(?i)(bot|crawler|spider|curl)`)},
+		MonitoringUserAgents: []*regexp.Regexp{regexp.MustCompile(`^Pingdom`), regexp.MustCompile(`(?i)uptime`)},
+		VerifiedCrawlers: []config.VerifiedCrawler{{
+			Name:        "googlebot",
+			MatchRe:     regexp.MustCompile(`Googlebot`),
+			SubnetsTrie: googleSubnetsTrie,
+		}},
+	}
+
+	// verified by subnet
+	c.Assert(w.detectClientClass(googlebotData, stdnet.ParseIP("66.249.66.1"), spiderUaLbs), Equals, "bot_verified")
+	c.Assert(w.detectClientClass(googlebotData, stdnet.ParseIP("66.249.66.1"), humanUaLbs), Equals, "bot_verified")
+
+	// fake googlebot
+	c.Assert(w.detectClientClass(googlebotData, stdnet.ParseIP("81.2.69.142"), humanUaLbs), Equals, "bot_unverified")
+	c.Assert(w.detectClientClass(googlebotData, nil, humanUaLbs), Equals, "bot_unverified")
+
+	// detected by regex
+	c.Assert(w.detectClientClass(map[string]string{"$http_user_agent": "curl/7.64.1"}, nil, humanUaLbs), Equals, "bot_unverified")
+	c.Assert(w.detectClientClass(map[string]string{"$http_user_agent": "YandexBot/3.0"}, nil, humanUaLbs), Equals, "bot_unverified")
+
+	// monitoring
+	c.Assert(w.detectClientClass(map[string]string{"$http_user_agent": "Pingdom.com_bot_version_1.4"}, nil, spiderUaLbs), Equals, "monitoring")
+	c.Assert(w.detectClientClass(map[string]string{"$http_user_agent": "Site24x7 Uptime checker"}, nil, humanUaLbs), Equals, "monitoring")
+
+	// human
+	c.Assert(w.detectClientClass(map[string]string{"$http_user_agent": "Mozilla/5.0 (Macintosh)"}, nil, humanUaLbs), Equals, "human")
+	c.Assert(w.detectClientClass(map[string]string{}, nil, humanUaLbs), Equals, "human")
+}
+
+func (s WorkerSuite) TestRequestLabels(c *C) {
+	w := newExportWorker(
+		&config.Config{Global: config.Global{MetricLabels: map[string][]string{
+			exposer.HostResponseTimeSecondsMetricName: {"country", "asn"},
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	extraLbs := map[string]string{"country": "GB", "asn": "20712"}
+
+	labels, ok := w.requestLabels(exposer.HostResponseTimeSecondsMetricName, "localhost", extraLbs, "localhost", "200")
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, []string{"localhost", "200", "GB", "20712"})
+
+	labels, ok = w.requestLabels(exposer.UserAgentRequestsTotalMetricName, "localhost", extraLbs, "localhost", "Chrome", "200")
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, []string{"localhost", "Chrome", "200"})
+
+	// metric is excluded for network
+	w.cfg.Global.Networks = []config.Network{{
+		Name:           "monitoring",
+		ExcludeMetrics: []string{exposer.UserAgentRequestsTotalMetricName},
+	}}
+	extraLbs["network"] = "monitoring"
+
+	labels, ok = w.requestLabels(exposer.UserAgentRequestsTotalMetricName, "localhost", extraLbs, "localhost", "Chrome", "200")
+	c.Assert(ok, Equals, false)
+	c.Assert(labels, IsNil)
+
+	labels, ok = w.requestLabels(exposer.HostResponseTimeSecondsMetricName, "localhost", extraLbs, "localhost", "200")
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, []string{"localhost", "200", "GB", "20712"})
+
+	extraLbs["network"] = "office"
+
+	labels, ok = w.requestLabels(exposer.UserAgentRequestsTotalMetricName, "localhost", extraLbs, "localhost", "Chrome", "200")
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, []string{"localhost", "Chrome", "200"})
+
+	// labels of source are appended, they are empty for unknown source
+	w.cfg.SourceLabelNames = []string{"dc", "team"}
+	w.cfg.SourceLabelValues = map[string][]string{"nginx1": {"eu", "search"}}
+
+	labels, ok = w.requestLabels(exposer.UserAgentRequestsTotalMetricName, "nginx1", extraLbs, "localhost", "Chrome", "200")
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, []string{"localhost", "Chrome", "200", "eu", "search"})
+
+	labels, ok = w.requestLabels(exposer.UserAgentRequestsTotalMetricName, "nginx2", extraLbs, "localhost", "Chrome", "200")
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, []string{"localhost", "Chrome", "200", "", ""})
+}
+
+func (s WorkerSuite) TestProcess(c *C) {
+	observed := make(map[string][]string)
+
+	sink := NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		observed[desc.Name] = labels
+	})
+
+	extraLabels := map[string][]string{
+		exposer.HostResponseTimeSecondsMetricName: {"client_class"},
+	}
+
+	w := newExportWorker(
+		&config.Config{
+			Global:  config.Global{MetricLabels: extraLabels},
+			Sources: []config.Source{{Host: "localhost"}},
+		},
+		NewDummyParseFunc(map[string]string{
+			"$remote_addr":     "unix:",
+			"$request_time":    "0.5",
+			"$host":            "test_localhost",
+			"$status":          "200",
+			"$http_user_agent": "Googlebot/2.1",
+		}),
+		NewDummyUserAgentParser("Googlebot", "Spider", "Other"),
+		&DummyCache{},
+		nil,
+		newDummyMetrics(c, sink, extraLabels),
+	)
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+
+	c.Assert(observed, DeepEquals, map[string][]string{
+		exposer.InvalidClientAddressesTotal:            {"localhost"},
+		exposer.UserAgentCachedTotal:                   {"localhost"},
+		exposer.UserAgentCurrentCachedTotal:            {"localhost"},
+		exposer.HostResponseTimeSecondsMetricName:      {"test_localhost", "200", "bot_unverified"},
+		exposer.UserAgentResponseTimeSecondsMetricName: {"test_localhost", "Googlebot", "200"},
+		exposer.URIResponseTimeSecondsMetricName:       {"test_localhost", "", "200"},
+		exposer.UserAgentRequestsTotalMetricName:       {"test_localhost", "Googlebot", "200"},
+		exposer.OsDeviceTypeRequestsTotalMetricName:    {"test_localhost", "Other", "desktop"},
+		exposer.NginxRequestsTotal:                     {"localhost"},
+	})
+}
+
+func (s WorkerSuite) TestProcess_Relabel(c *C) {
+	observed := make(map[string][]string)
+
+	sink := NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		observed[desc.Name] = labels
+	})
+
+	relabelConfigs := []*relabel.Config{
+		{SourceLabels: []string{"$http_user_agent"}, Regex: "kube-probe.*", Action: relabel.Drop},
+		{SourceLabels: []string{"host"}, Regex: "www\\.(.*)", TargetLabel: "host", Replacement: "$1", Action: relabel.Replace},
+		{SourceLabels: []string{"$http_x_tenant"}, Regex: "(.*)", TargetLabel: "tenant", Replacement: "$1", Action: relabel.Lowercase},
+	}
+	for _, relabelConfig := range relabelConfigs {
+		c.Assert(relabelConfig.Compile(), IsNil)
+	}
+
+	extraLabels := map[string][]string{
+		exposer.HostResponseTimeSecondsMetricName: {"tenant"},
+	}
+
+	data := map[string]string{
+		"$request_time":    "0.5",
+		"$host":            "www.site.com",
+		"$status":          "200",
+		"$http_user_agent": "Go-http-client/1.1",
+		"$http_x_tenant":   "Team1",
+	}
+
+	w := newExportWorker(
+		&config.Config{
+			Global:  config.Global{MetricLabels: extraLabels, RelabelConfigs: relabelConfigs},
+			Sources: []config.Source{{Host: "localhost"}},
+		},
+		NewDummyParseFunc(data),
+		NewDummyUserAgentParser("Go-http-client", "Other", "Other"),
+		&DummyCache{},
+		nil,
+		newDummyMetrics(c, sink, extraLabels),
+	)
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+
+	c.Assert(observed[exposer.HostResponseTimeSecondsMetricName], DeepEquals, []string{"site.com", "200", "team1"})
+	c.Assert(observed[exposer.UserAgentRequestsTotalMetricName], DeepEquals, []string{"site.com", "Go-http-client", "200"})
+
+	// request dropped by relabel configs is counted as dropped by filter "relabel"
+	observed = make(map[string][]string)
+	data["$http_user_agent"] = "kube-probe/1.28"
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+
+	c.Assert(observed, DeepEquals, map[string][]string{
+		exposer.UserAgentCachedTotal:        {"localhost"},
+		exposer.UserAgentCurrentCachedTotal: {"localhost"},
+		exposer.LogsFilterDroppedTotal:      {"localhost", "relabel"},
+	})
+}
+
+func (s WorkerSuite) TestProcess_Filters(c *C) {
+	observed := make(map[string][]string)
+
+	sink := NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		observed[desc.Name] = labels
+	})
+
+	healthChecks := &filter.Filter{Name: "health_checks", Condition: filter.Condition{Variable: "$request", Regex: "^GET /ping "}}
+	errorsOnly := &filter.Filter{Name: "errors_only", Action: filter.Keep, Condition: filter.Condition{Variable: "$status", Regex: "^5"}}
+	for _, f := range []*filter.Filter{healthChecks, errorsOnly} {
+		c.Assert(f.Compile(), IsNil)
+	}
+
+	data := map[string]string{
+		"$request_time": "0.5",
+		"$request":      "GET /ping HTTP/1.1",
+		"$status":       "200",
+	}
+	observer := &DummyObserver{}
+
+	w := newExportWorker(
+		&config.Config{
+			Global: config.Global{Filters: []*filter.Filter{healthChecks}},
+			Sources: []config.Source{
+				{Host: "localhost"},
+				{Host: "backend", Filters: []*filter.Filter{errorsOnly}},
+			},
+		},
+		NewDummyParseFunc(data),
+		NewDummyUserAgentParser("Other", "Other", "Other"),
+		&DummyCache{},
+		nil,
+		newDummyMetrics(c, sink, nil),
+		observer,
+	)
+
+	// global filter drops line of any source
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observed, DeepEquals, map[string][]string{exposer.LogsFilterDroppedTotal: {"localhost", "health_checks"}})
+	c.Assert(observer.hosts, HasLen, 0)
+
+	// filter of source is applied only to its lines
+	observed = make(map[string][]string)
+	data["$request"] = "GET /api HTTP/1.1"
+
+	w.Process(input.NewLogLine("backend", "line"), context.Background())
+	c.Assert(observed, DeepEquals, map[string][]string{exposer.LogsFilterDroppedTotal: {"backend", "errors_only"}})
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observed[exposer.NginxRequestsTotal], DeepEquals, []string{"localhost"})
+
+	// observers receive only lines, that are not dropped
+	c.Assert(observer.hosts, DeepEquals, []string{"localhost"})
+}
+
+func (s WorkerSuite) TestProcess_RequestObserver(c *C) {
+	relabelConfigs := []*relabel.Config{
+		{SourceLabels: []string{"$http_user_agent"}, Regex: "kube-probe.*", Action: relabel.Drop},
+		{SourceLabels: []string{"host"}, Regex: "www\\.(.*)", TargetLabel: "host", Replacement: "$1", Action: relabel.Replace},
+	}
+	for _, relabelConfig := range relabelConfigs {
+		c.Assert(relabelConfig.Compile(), IsNil)
+	}
+
+	replacements := []config.RequestURIReplacementSetting{{
+		Regexp:       regexp.MustCompile(`^/login`),
+		Replacements: config.RequestURIReplacement{RequestURI: "login"},
+	}}
+
+	data := map[string]string{
+		"$request_time":    "0.5",
+		"$request":         "POST /login?next=/ HTTP/1.1",
+		"$host":            "www.site.com",
+		"$status":          "401",
+		"$remote_addr":     "10.0.0.1:5555",
+		"$http_user_agent": "python-requests/2.31",
+	}
+	observer := &DummyRequestObserver{}
+
+	w := newExportWorker(
+		&config.Config{
+			Global:  config.Global{RelabelConfigs: relabelConfigs, RequestURIReplacementSettings: replacements},
+			Sources: []config.Source{{Host: "localhost"}},
+		},
+		NewDummyParseFunc(data),
+		NewDummyUserAgentParser("Other", "Other", "Other"),
+		&DummyCache{},
+		nil,
+		newDummyMetrics(c, NewDummySink(nil), nil),
+		observer,
+	)
+
+	// request observers receive labels after relabeling
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observer.hosts, DeepEquals, []string{"localhost"})
+	c.Assert(observer.requests, DeepEquals, []*Request{{
+		NginxHost:    "localhost",
+		Host:         "site.com",
+		URI:          "login",
+		Method:       "POST",
+		Code:         "401",
+		ClientIP:     stdnet.ParseIP("10.0.0.1").To4(),
+		UserAgent:    "python-requests/2.31",
+		ResponseTime: 0.5,
+
+		UserAgentLabel: "Other",
+		OSLabel:        "Other",
+		DeviceLabel:    "Other",
+		DeviceType:     "desktop",
+
+		Content: "line",
+		Data:    data,
+	}})
+
+	// method is taken from $request_method, invalid client address is nil
+	observer.requests = nil
+	data["$request_method"] = "PUT"
+	data["$remote_addr"] = "invalid"
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observer.requests, HasLen, 1)
+	c.Assert(observer.requests[0].Method, Equals, "PUT")
+	c.Assert(observer.requests[0].ClientIP, IsNil)
+
+	// lines dropped by relabel configs are not observed
+	observer.hosts, observer.requests = nil, nil
+	data["$http_user_agent"] = "kube-probe/1.28"
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observer.hosts, HasLen, 0)
+	c.Assert(observer.requests, HasLen, 0)
+}
+
+func (s WorkerSuite) TestProcess_ParseErrors(c *C) {
+	failed := make(map[string]float64)
+
+	sink := NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		if desc.Name == exposer.LogsFailParsedTotalName {
+			failed[strings.Join(labels, ",")] += value
+		}
+	})
+
+	observer := &DummyObserver{}
+	w := newExportWorker(
+		&config.Config{Sources: []config.Source{{Host: "localhost", LogFormat: "$request_time $status"}}},
+		parser.ParseSpacedFormat,
+		NewDummyUserAgentParser("Other", "Other", "Other"),
+		&DummyCache{},
+		nil,
+		newDummyMetrics(c, sink, nil),
+		observer,
+	)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	w.parseErrors = NewParseErrors(2, time.Minute)
+	w.parseErrors.now = func() time.Time { return now }
+
+	// failures are counted by reason, only the first failure of line is counted
+	w.Process(input.NewLogLine("localhost", "broken"), context.Background())
+	w.Process(input.NewLogLine("localhost", "abc -"), context.Background())
+	w.Process(input.NewLogLine("localhost", "abc 200"), context.Background())
+	c.Assert(failed, DeepEquals, map[string]float64{
+		"localhost,field_count_mismatch": 1,
+		"localhost,bad_status":           1,
+		"localhost,bad_duration":         1,
+	})
+
+	// lines that could not be parsed are not observed
+	c.Assert(observer.hosts, DeepEquals, []string{"localhost", "localhost"})
+
+	// only the last lines of source are kept
+	c.Assert(w.parseErrors.Lines(), DeepEquals, map[string][]ParseError{"localhost": {
+		{
+			Time:    now,
+			Format:  "$request_time $status",
+			Content: "abc -",
+			Reason:  "bad_status",
+			Error:   `could not parse http code: strconv.Atoi: parsing "-": invalid syntax`,
+		},
+		{
+			Time:    now,
+			Format:  "$request_time $status",
+			Content: "abc 200",
+			Reason:  "bad_duration",
+			Error:   `could not detect response duration: strconv.ParseFloat: parsing "abc": invalid syntax`,
+		},
+	}})
+
+	// only the first failure of source is logged in interval, number of suppressed failures is logged with the next one
+	suppressed, log := w.parseErrors.add("localhost", "", "", reasonOther, fmt.Errorf("error"))
+	c.Assert(log, Equals, false)
+
+	now = now.Add(time.Minute)
+	suppressed, log = w.parseErrors.add("localhost", "", "", reasonOther, fmt.Errorf("error"))
+	c.Assert(log, Equals, true)
+	c.Assert(suppressed, Equals, 3)
+
+	suppressed, log = w.parseErrors.add("backend", "", "", reasonOther, fmt.Errorf("error"))
+	c.Assert(log, Equals, true)
+	c.Assert(suppressed, Equals, 0)
+
+	// failed lines are served by source
+	recorder := httptest.NewRecorder()
+	w.parseErrors.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/parse-errors?source=backend", nil))
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), Equals, "application/json")
+
+	var response struct {
+		Sources map[string][]ParseError `json:"sources"`
+	}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Sources, HasLen, 1)
+	c.Assert(response.Sources["backend"], HasLen, 1)
+	c.Assert(response.Sources["backend"][0].Reason, Equals, "other")
+}
+
+func (s WorkerSuite) TestProcess_CustomMetrics(c *C) {
+	type observation struct {
+		labels []string
+		value  float64
+	}
+	observed := make(map[string][]observation)
+
+	sink := NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		observed[desc.Name] = append(observed[desc.Name], observation{labels, value})
+	})
+
+	customMetrics := []*config.CustomMetric{
+		{
+			Name:       "api_requests_total",
+			Type:       config.CustomMetricTypeCounter,
+			LabelNames: []string{"method", "version"},
+			Labels:     []*expr.Expression{expr.MustCompile(`lower($request_method)`), expr.MustCompile(`split($request_uri, "/")[2]`)},
+			Condition:  expr.MustCompile(`starts_with($request_uri, "/api/")`),
+		},
+		{
+			Name:  "upstream_response_time_seconds",
+			Type:  config.CustomMetricTypeHistogram,
+			Value: expr.MustCompile(`$upstream_response_time`),
+		},
+		{
+			Name:  "response_size_bytes",
+			Type:  config.CustomMetricTypeCounter,
+			Value: expr.MustCompile(`$body_bytes_sent - 100`),
+		},
+	}
+
+	registry := exposer.NewRegistry()
+	c.Assert(registry.Subscribe(sink), IsNil)
+	c.Assert(exposer.RegisterMetrics(registry, exposer.MetricsOptions{
+		SourceLabels: []string{"team"},
+		CustomMetrics: []exposer.Desc{
+			{Name: "api_requests_total", Type: exposer.CounterType, Labels: []string{"method", "version"}},
+			{Name: "upstream_response_time_seconds", Type: exposer.HistogramType},
+			{Name: "response_size_bytes", Type: exposer.CounterType},
+		},
+	}), IsNil)
+
+	m, err := newMetrics(registry, nil, []string{"team"})
+	c.Assert(err, IsNil)
+	m.custom, err = newCustomMetrics(registry, customMetrics, []string{"team"})
+	c.Assert(err, IsNil)
+
+	data := map[string]string{
+		"$request_time":           "0.5",
+		"$request_method":         "GET",
+		"$request_uri":            "/api/v1/users",
+		"$upstream_response_time": "0.25",
+		"$body_bytes_sent":        "612",
+	}
+
+	w := newExportWorker(
+		&config.Config{
+			SourceLabelNames:  []string{"team"},
+			SourceLabelValues: map[string][]string{"localhost": {"search"}},
+		},
+		NewDummyParseFunc(data),
+		NewDummyUserAgentParser("Other", "Other", "Other"),
+		&DummyCache{},
+		nil,
+		m,
+	)
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observed["api_requests_total"], DeepEquals, []observation{{[]string{"get", "v1", "search"}, 1}})
+	c.Assert(observed["upstream_response_time_seconds"], DeepEquals, []observation{{[]string{"search"}, 0.25}})
+	c.Assert(observed["response_size_bytes"], DeepEquals, []observation{{[]string{"search"}, 512}})
+
+	// metrics are not exposed, if condition doesn't match, value could not be extracted or counter decreases
+	observed = make(map[string][]observation)
+	data["$request_uri"] = "/ping"
+	data["$upstream_response_time"] = "-"
+	data["$body_bytes_sent"] = "0"
+
+	w.Process(input.NewLogLine("localhost", "line"), context.Background())
+	c.Assert(observed["api_requests_total"], IsNil)
+	c.Assert(observed["upstream_response_time_seconds"], IsNil)
+	c.Assert(observed["response_size_bytes"], IsNil)
+
+	// custom metric should have labels evaluated by exporter
+	_, err = newCustomMetrics(registry, []*config.CustomMetric{{Name: "api_requests_total", Type: config.CustomMetricTypeCounter}}, []string{"team"})
+	c.Assert(err, ErrorMatches, `metric "api_requests_total" has labels \[method version team\], but \[team\] are expected`)
+}
+
+func (s WorkerSuite) TestExportSLO(c *C) {
+	observed := make(map[string]map[string]float64)
+
+	sink := NewDummySink(func(desc *exposer.Desc, labels []string, value float64) {
+		if observed[desc.Name] == nil {
+			observed[desc.Name] = make(map[string]float64)
+		}
+		observed[desc.Name][strings.Join(labels, ",")] += value
+	})
+
+	w := newExportWorker(
+		&config.Config{Global: config.Global{SLOObjectives: []*config.SLOObjective{
+			{
+				Name:             "search",
+				URIs:             []string{"search"},
+				LatencyThreshold: 300 * time.Millisecond,
+				SuccessCodes:     []string{"2xx", "404"},
+				ApdexThreshold:   100 * time.Millisecond,
+			},
+			{
+				Name:             "shop",
+				Hosts:            []string{"shop.example.com"},
+				LatencyThreshold: time.Second,
+				SuccessCodes:     []string{"1xx", "2xx", "3xx", "4xx"},
+				ApdexThreshold:   time.Second,
+			},
+			{
+				Name:         "availability",
+				Hosts:        []string{"shop.example.com"},
+				SuccessCodes: []string{"1xx", "2xx", "3xx", "4xx"},
+			},
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		newDummyMetrics(c, sink, nil),
+	)
+
+	w.exportSLO("lb", "shop.example.com", "search", "200", 0.05, true)
+	w.exportSLO("lb", "shop.example.com", "search", "404", 0.2, true)
+	w.exportSLO("lb", "shop.example.com", "search", "200", 0.5, true)
+	w.exportSLO("lb", "shop.example.com", "search", "503", 0.01, true)
+	w.exportSLO("lb", "example.com", "catalog", "200", 0.01, true)
+
+	// requests without response time are good only for objective without latency threshold,
+	// they are counted in apdex zones if they fail
+	w.exportSLO("lb", "shop.example.com", "search", "200", 0, false)
+	w.exportSLO("lb", "shop.example.com", "search", "502", 0, false)
+
+	c.Assert(observed, DeepEquals, map[string]map[string]float64{
+		exposer.SLORequestsTotal: {
+			"search,shop.example.com,search":       6,
+			"shop,shop.example.com,search":         6,
+			"availability,shop.example.com,search": 6,
+		},
+		exposer.SLOGoodRequestsTotal: {
+			"search,shop.example.com,search":       2,
+			"shop,shop.example.com,search":         3,
+			"availability,shop.example.com,search": 4,
+		},
+		exposer.ApdexRequestsTotal: {
+			"search,shop.example.com,search,satisfied":  1,
+			"search,shop.example.com,search,tolerating": 1,
+			"search,shop.example.com,search,frustrated": 3,
+			"shop,shop.example.com,search,satisfied":    3,
+			"shop,shop.example.com,search,frustrated":   2,
+		},
+	})
+}
+
+func (s WorkerSuite) TestDetectExemplar(c *C) {
+	w := newExportWorker(&config.Config{}, nil, nil, nil, nil, nil)
+	c.Assert(w.detectExemplar(map[string]string{"$request_id": "abc"}), IsNil)
+
+	w = newExportWorker(
+		&config.Config{Global: config.Global{Exemplars: &config.Exemplars{
+			Variables: []string{"$http_traceparent", "$request_id"},
+			LabelName: "trace_id",
+		}}},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	testCases := []struct {
+		data     map[string]string
+		expected map[string]string
+	}{
+		{
+			data:     map[string]string{"$http_traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "$request_id": "abc"},
+			expected: map[string]string{"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"},
+		},
+		{
+			data:     map[string]string{"$http_traceparent": "-", "$request_id": "7f2c1a"},
+			expected: map[string]string{"trace_id": "7f2c1a"},
+		},
+		{
+			data:     map[string]string{"$http_traceparent": "custom-trace"},
+			expected: map[string]string{"trace_id": "custom-trace"},
+		},
+		{
+			data:     map[string]string{"$request_id": ""},
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		c.Assert(w.detectExemplar(tc.data), DeepEquals, tc.expected)
+	}
+}
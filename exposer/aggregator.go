@@ -0,0 +1,136 @@
+package exposer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxIdleFlushes is a number of flushes, after which aggregate that is not updated is removed. Values of removed
+// aggregate start from zero, if it is observed again.
+const maxIdleFlushes = 10
+
+// field is a named value of aggregate
+type field struct {
+	name  string
+	value float64
+}
+
+// aggregate is a value of metric with label values accumulated since start
+type aggregate struct {
+	desc   *Desc
+	labels []string
+
+	// value is a sum of counter or a last value of gauge
+	value float64
+
+	// count, sum and buckets are cumulative counters of histogram
+	count   uint64
+	sum     float64
+	buckets []uint64
+
+	// idle is a number of flushes since the last observation
+	idle int
+}
+
+// fields returns values of aggregate, counters and gauges have a single value field
+func (a *aggregate) fields() []field {
+	if a.desc.Type != HistogramType {
+		return []field{{name: "value", value: a.value}}
+	}
+
+	fields := make([]field, 0, len(a.buckets)+2)
+	fields = append(fields, field{name: "count", value: float64(a.count)}, field{name: "sum", value: a.sum})
+	for i, bound := range a.desc.Buckets {
+		fields = append(fields, field{name: "le_" + formatFloat(bound), value: float64(a.buckets[i])})
+	}
+
+	return fields
+}
+
+// aggregator accumulates observations of metrics for sinks that periodically flush values. Values are cumulative
+// the same way as values of Prometheus metrics, aggregates that are not observed for maxIdleFlushes are removed
+// to keep memory bounded for labels with high cardinality.
+type aggregator struct {
+	mu         sync.Mutex
+	aggregates map[string]*aggregate
+}
+
+// newAggregator creates empty aggregator
+func newAggregator() *aggregator {
+	return &aggregator{aggregates: make(map[string]*aggregate)}
+}
+
+// observe adds observation to aggregate of metric with label values
+func (a *aggregator) observe(desc *Desc, labels []string, value float64) {
+	key := desc.Name + "\xff" + strings.Join(labels, "\xff")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	agg, ok := a.aggregates[key]
+	if !ok {
+		agg = &aggregate{desc: desc, labels: append([]string{}, labels...)}
+		if desc.Type == HistogramType {
+			agg.buckets = make([]uint64, len(desc.Buckets))
+		}
+
+		a.aggregates[key] = agg
+	}
+	agg.idle = 0
+
+	switch desc.Type {
+	case CounterType:
+		agg.value += value
+	case GaugeType:
+		agg.value = value
+	case HistogramType:
+		agg.count++
+		agg.sum += value
+		for i, bound := range desc.Buckets {
+			if value <= bound {
+				agg.buckets[i]++
+			}
+		}
+	}
+}
+
+// Reset removes all aggregates of metric
+func (a *aggregator) Reset(desc *Desc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, agg := range a.aggregates {
+		if agg.desc == desc {
+			delete(a.aggregates, key)
+		}
+	}
+}
+
+// snapshot returns copies of all aggregates sorted by metric name and label values, it is called once per flush.
+// Aggregates that are idle for more than maxIdleFlushes are removed.
+func (a *aggregator) snapshot() []aggregate {
+	a.mu.Lock()
+	keys := make([]string, 0, len(a.aggregates))
+	for key, agg := range a.aggregates {
+		if agg.idle >= maxIdleFlushes {
+			delete(a.aggregates, key)
+
+			continue
+		}
+
+		agg.idle++
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	snapshot := make([]aggregate, 0, len(keys))
+	for _, key := range keys {
+		agg := *a.aggregates[key]
+		agg.buckets = append([]uint64{}, agg.buckets...)
+		snapshot = append(snapshot, agg)
+	}
+	a.mu.Unlock()
+
+	return snapshot
+}
@@ -1,34 +1,93 @@
 package exposer
 
-// Exposer is an interface for service that exposes metrics
-type Exposer func(name string, labels []string, value float64)
-
-// NewPromExposer return function that exposes metrics for Prometheus
-func PromExposer(name string, labels []string, value float64) {
-	switch name {
-	case HostResponseTimeSecondsMetricName:
-		hostResponseTimeSeconds.WithLabelValues(labels...).Observe(value)
-	case UserAgentResponseTimeSecondsMetricName:
-		userAgentResponseTimeSeconds.WithLabelValues(labels...).Observe(value)
-	case UserAgentRequestsTotalMetricName:
-		userAgentRequestsTotal.WithLabelValues(labels...).Inc()
-	case OsDeviceTypeRequestsTotalMetricName:
-		osDeviceTypeRequestsTotal.WithLabelValues(labels...).Inc()
-	case URIResponseTimeSecondsMetricName:
-		URIResponseTimeSeconds.WithLabelValues(labels...).Observe(value)
-	case NginxRequestsTotal:
-		nginxRequestsTotal.WithLabelValues(labels...).Inc()
-	case LogsDroppedTotalName:
-		logsDropped.WithLabelValues(labels...).Inc()
-	case LogsFailParsedTotalName:
-		logsFailParsedTotal.WithLabelValues(labels...).Inc()
-	case LogsTotal:
-		logsTotal.WithLabelValues(labels...).Inc()
-	case LogsFilteredTotal:
-		logsFilteredTotal.WithLabelValues(labels...).Inc()
-	case UserAgentCachedTotal:
-		userAgentCachedTotal.WithLabelValues(labels...).Inc()
-	case UserAgentCurrentCachedTotal:
-		userAgentCurrentCachedTotal.WithLabelValues(labels...).Set(value)
+import "time"
+
+// MetricType is a type of metric
+type MetricType int
+
+const (
+	// CounterType is a metric that accumulates increments
+	CounterType MetricType = iota
+	// GaugeType is a metric that is set to the current value
+	GaugeType
+	// HistogramType is a metric that samples observed values into buckets
+	HistogramType
+)
+
+// String returns name of metric type
+func (t MetricType) String() string {
+	switch t {
+	case CounterType:
+		return "counter"
+	case GaugeType:
+		return "gauge"
+	case HistogramType:
+		return "histogram"
 	}
+
+	return "unknown"
+}
+
+// Desc describes registered metric
+type Desc struct {
+	Name    string
+	Help    string
+	Type    MetricType
+	Labels  []string
+	Buckets []float64
+
+	// DropLabels are labels, which values are passed to metric handle, but are not exposed
+	DropLabels []string
+	// ConstLabels are labels with the same values for all observations
+	ConstLabels map[string]string
+
+	// NativeHistogram and Summary are alternative representations of histogram, sinks that don't support them
+	// use Buckets
+	NativeHistogram *NativeHistogramOpts
+	Summary         *SummaryOpts
+}
+
+// NativeHistogramOpts contains settings of native(sparse) histogram with exponential buckets
+type NativeHistogramOpts struct {
+	BucketFactor     float64
+	MaxBuckets       uint32
+	MinResetDuration time.Duration
+}
+
+// SummaryOpts contains settings of summary with quantiles calculated over sliding time window
+type SummaryOpts struct {
+	Objectives map[float64]float64
+	MaxAge     time.Duration
+	AgeBuckets uint32
+}
+
+// HistogramOpts contains representation of histogram metric. Classic buckets are used when neither native
+// histogram nor summary is set, they are also kept with native histogram when buckets are specified.
+type HistogramOpts struct {
+	Buckets         []float64
+	NativeHistogram *NativeHistogramOpts
+	Summary         *SummaryOpts
+}
+
+// Sink is an interface for service that exposes metrics, for example Prometheus. The sink receives descriptions of
+// all metrics before observations.
+type Sink interface {
+	// Register prepares sink to receive observations of metric
+	Register(desc *Desc) error
+	// Observe receives observation of metric, for counters the value is an increment
+	Observe(desc *Desc, labels []string, value float64)
+}
+
+// ResetSink is a sink that can remove all series of metric, for example of gauges with series replaced periodically
+type ResetSink interface {
+	Sink
+	// Reset removes all series of metric
+	Reset(desc *Desc)
+}
+
+// ExemplarSink is a sink that can link observations to exemplars, for example to trace ids
+type ExemplarSink interface {
+	Sink
+	// ObserveWithExemplar receives observation of metric with exemplar labels
+	ObserveWithExemplar(desc *Desc, labels []string, value float64, exemplar map[string]string)
 }
@@ -0,0 +1,263 @@
+package exposer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+)
+
+var (
+	// graphiteTemplatePlaceholderRe matches placeholders {name} and {label} of path template
+	graphiteTemplatePlaceholderRe = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+	// graphitePathRe matches characters that could not be used in path segments
+	graphitePathRe = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+	// graphiteTagReplacer replaces characters that could not be used in tag values
+	graphiteTagReplacer = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\n", "_")
+)
+
+// graphiteTemplate is a compiled path template, segments are literal strings and label indexes
+type graphiteTemplate struct {
+	literals []string
+	indexes  []int
+}
+
+// GraphiteSink is a sink that aggregates metrics and periodically sends them to Graphite using plaintext protocol
+// over TCP. Label values are appended to metric path as segments or formatted with path template, or they are
+// sent as Graphite tags. Histograms are sent as paths with suffixes "count", "sum" and a cumulative count for each bucket.
+type GraphiteSink struct {
+	*aggregator
+
+	address      string
+	prefix       string
+	tags         bool
+	rawTemplates map[string]string
+	timeout      time.Duration
+
+	mu        sync.Mutex
+	templates map[string]*graphiteTemplate
+	conn      net.Conn
+}
+
+// NewGraphiteSink creates sink that sends metrics to address host:port. Templates are path templates by metric name,
+// for example "nginx.{host}.{code}.response_time", which are used instead of metric name and label values.
+func NewGraphiteSink(address, prefix string, tags bool, templates map[string]string, timeout time.Duration) *GraphiteSink {
+	if prefix == "" {
+		prefix = defaultNamespace
+	}
+
+	return &GraphiteSink{
+		aggregator:   newAggregator(),
+		address:      address,
+		prefix:       prefix,
+		tags:         tags,
+		rawTemplates: templates,
+		timeout:      timeout,
+		templates:    make(map[string]*graphiteTemplate),
+	}
+}
+
+// Register compiles path template of metric checking that all placeholders are labels of metric
+func (s *GraphiteSink) Register(desc *Desc) error {
+	switch desc.Type {
+	case CounterType, GaugeType, HistogramType:
+	default:
+		return fmt.Errorf("unsupported type of metric %q", desc.Name)
+	}
+
+	raw, ok := s.rawTemplates[desc.Name]
+	if !ok {
+		return nil
+	}
+
+	template := &graphiteTemplate{}
+	last := 0
+	for _, loc := range graphiteTemplatePlaceholderRe.FindAllStringSubmatchIndex(raw, -1) {
+		name := raw[loc[2]:loc[3]]
+
+		index := -1
+		for i, label := range desc.Labels {
+			if label == name {
+				index = i
+			}
+		}
+		if index < 0 && name != "name" {
+			return fmt.Errorf("unknown label %q in graphite template of metric %q", name, desc.Name)
+		}
+
+		template.literals = append(template.literals, raw[last:loc[0]])
+		template.indexes = append(template.indexes, index)
+		last = loc[1]
+	}
+	template.literals = append(template.literals, raw[last:])
+
+	s.mu.Lock()
+	s.templates[desc.Name] = template
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Observe adds observation to aggregated values
+func (s *GraphiteSink) Observe(desc *Desc, labels []string, value float64) {
+	s.observe(desc, labels, value)
+}
+
+// Run sends aggregated values every interval until context is done
+func (s *GraphiteSink) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				logging.WithContext(ctx).Sugar().Warnf("could not send metrics to graphite: %s", err)
+			}
+		}
+	}
+}
+
+// Flush sends aggregated values, connection is reopened on the next flush after error
+func (s *GraphiteSink) Flush() error {
+	lines := s.makeLines(time.Now())
+	if len(lines) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	if s.timeout > 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+
+	w := bufio.NewWriter(s.conn)
+	for _, line := range lines {
+		if _, err := w.WriteString(line); err != nil {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		s.conn.Close()
+		s.conn = nil
+
+		return err
+	}
+
+	return nil
+}
+
+// Close closes connection
+func (s *GraphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// makeLines formats aggregated values as lines of plaintext protocol
+func (s *GraphiteSink) makeLines(now time.Time) []string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	s.mu.Lock()
+	templates := s.templates
+	s.mu.Unlock()
+
+	var lines []string
+	for _, agg := range s.snapshot() {
+		path, tags := s.makePath(&agg, templates[agg.desc.Name])
+
+		for _, f := range agg.fields() {
+			if math.IsNaN(f.value) || math.IsInf(f.value, 0) {
+				continue
+			}
+
+			fieldPath := path
+			if f.name != "value" {
+				fieldPath += "." + graphitePathRe.ReplaceAllString(f.name, "_")
+			}
+
+			lines = append(lines, fieldPath+tags+" "+strconv.FormatFloat(f.value, 'f', -1, 64)+" "+timestamp+"\n")
+		}
+	}
+
+	return lines
+}
+
+// makePath returns metric path and tags of aggregate
+func (s *GraphiteSink) makePath(agg *aggregate, template *graphiteTemplate) (string, string) {
+	if s.tags {
+		var tags strings.Builder
+		for i, value := range agg.labels {
+			if value == "" {
+				continue
+			}
+
+			tags.WriteString(";")
+			tags.WriteString(agg.desc.Labels[i])
+			tags.WriteString("=")
+			tags.WriteString(graphiteTagReplacer.Replace(value))
+		}
+
+		return s.prefix + "." + agg.desc.Name, tags.String()
+	}
+
+	segments := []string{s.prefix}
+	if template == nil {
+		segments = append(segments, agg.desc.Name)
+		for _, value := range agg.labels {
+			segments = append(segments, graphiteSegment(value))
+		}
+
+		return strings.Join(segments, "."), ""
+	}
+
+	var path strings.Builder
+	for i, index := range template.indexes {
+		path.WriteString(template.literals[i])
+		if index < 0 {
+			path.WriteString(agg.desc.Name)
+		} else {
+			path.WriteString(graphiteSegment(agg.labels[index]))
+		}
+	}
+	path.WriteString(template.literals[len(template.literals)-1])
+
+	return s.prefix + "." + path.String(), ""
+}
+
+// graphiteSegment escapes value to be used as path segment
+func graphiteSegment(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return graphitePathRe.ReplaceAllString(value, "_")
+}
@@ -0,0 +1,122 @@
+package exposer
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type GraphiteSinkSuite struct{}
+
+var _ = Suite(&GraphiteSinkSuite{})
+
+// receiveGraphite flushes sink and returns lines received by TCP listener without timestamps
+func receiveGraphite(c *C, sink *GraphiteSink, listener net.Listener) string {
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- err.Error()
+
+			return
+		}
+		defer conn.Close()
+
+		raw, _ := ioutil.ReadAll(conn)
+		received <- string(raw)
+	}()
+
+	c.Assert(sink.Flush(), IsNil)
+	c.Assert(sink.Close(), IsNil)
+
+	return timestampRe.ReplaceAllString(<-received, "$1")
+}
+
+func (s GraphiteSinkSuite) TestFlush(c *C) {
+	testCases := []struct {
+		tags      bool
+		templates map[string]string
+		expected  []string
+	}{
+		{
+			expected: []string{
+				"accesslog.cached 10",
+				"accesslog.requests_total.www_site_com.unknown 1",
+				"accesslog.requests_total.www_site_com.Chrome_68__Mac_OS 3",
+				"accesslog.response_time_seconds.www_site_com.count 3",
+				"accesslog.response_time_seconds.www_site_com.sum 2.55",
+				"accesslog.response_time_seconds.www_site_com.le_0_1 1",
+				"accesslog.response_time_seconds.www_site_com.le_1 2",
+			},
+		},
+		{
+			templates: map[string]string{
+				"requests_total":        "sites.{host}.{name}",
+				"response_time_seconds": "sites.{host}.response_time",
+			},
+			expected: []string{
+				"accesslog.cached 10",
+				"accesslog.sites.www_site_com.requests_total 1",
+				"accesslog.sites.www_site_com.requests_total 3",
+				"accesslog.sites.www_site_com.response_time.count 3",
+				"accesslog.sites.www_site_com.response_time.sum 2.55",
+				"accesslog.sites.www_site_com.response_time.le_0_1 1",
+				"accesslog.sites.www_site_com.response_time.le_1 2",
+			},
+		},
+		{
+			tags: true,
+			expected: []string{
+				"accesslog.cached 10",
+				"accesslog.requests_total;host=www.site.com 1",
+				"accesslog.requests_total;host=www.site.com;user_agent=Chrome_68,_Mac=OS 3",
+				"accesslog.response_time_seconds.count;host=www.site.com 3",
+				"accesslog.response_time_seconds.sum;host=www.site.com 2.55",
+				"accesslog.response_time_seconds.le_0_1;host=www.site.com 1",
+				"accesslog.response_time_seconds.le_1;host=www.site.com 2",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+
+		sink := NewGraphiteSink(listener.Addr().String(), "", tc.tags, tc.templates, time.Second)
+		observeAggregated(c, sink)
+
+		c.Assert(receiveGraphite(c, sink, listener), Equals, strings.Join(tc.expected, "\n")+"\n")
+		c.Assert(listener.Close(), IsNil)
+	}
+}
+
+func (s GraphiteSinkSuite) TestFlush_Reconnect(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	address := listener.Addr().String()
+	c.Assert(listener.Close(), IsNil)
+
+	sink := NewGraphiteSink(address, "", false, nil, time.Second)
+	observeAggregated(c, sink)
+
+	// graphite is unavailable
+	c.Assert(sink.Flush(), NotNil)
+
+	listener, err = net.Listen("tcp", address)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	c.Assert(receiveGraphite(c, sink, listener), Matches, "(?s)accesslog.cached 10\n.*")
+}
+
+func (s GraphiteSinkSuite) TestRegister_UnknownTemplateLabel(c *C) {
+	sink := NewGraphiteSink("127.0.0.1:2003", "", false, map[string]string{
+		"requests_total": "sites.{host}.{code}",
+	}, time.Second)
+
+	err := sink.Register(&Desc{Name: "requests_total", Type: CounterType, Labels: []string{"host"}})
+	c.Assert(err, ErrorMatches, `unknown label "code" in graphite template of metric "requests_total"`)
+}
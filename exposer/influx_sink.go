@@ -0,0 +1,215 @@
+package exposer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+)
+
+var (
+	// influxMeasurementReplacer escapes measurement of line protocol
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	// influxKeyReplacer escapes tag keys, tag values and field keys of line protocol
+	influxKeyReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// InfluxSink is a sink that aggregates metrics and periodically writes them to InfluxDB using line protocol.
+// Labels are written as tags, counters and gauges have a single field "value", histograms have fields
+// "count", "sum" and a cumulative count for each bucket.
+type InfluxSink struct {
+	*aggregator
+
+	prefix     string
+	packetSize int
+
+	// url is set for HTTP, conn is set for UDP
+	url    string
+	client *http.Client
+	conn   net.Conn
+}
+
+// NewInfluxSink creates sink that writes metrics to address http(s)://host:port/write?db=name or udp://host:port.
+// Lines sent over UDP are batched into packets not larger than packet size.
+func NewInfluxSink(address, prefix string, packetSize int, timeout time.Duration) (*InfluxSink, error) {
+	if prefix == "" {
+		prefix = defaultNamespace
+	}
+
+	s := &InfluxSink{aggregator: newAggregator(), prefix: prefix, packetSize: packetSize}
+
+	switch {
+	case strings.HasPrefix(address, "http://"), strings.HasPrefix(address, "https://"):
+		s.url = address
+		s.client = &http.Client{Timeout: timeout}
+	case strings.HasPrefix(address, "udp://"):
+		conn, err := net.Dial("udp", strings.TrimPrefix(address, "udp://"))
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	default:
+		return nil, fmt.Errorf("unsupported influx address %q, http(s):// or udp:// is expected", address)
+	}
+
+	return s, nil
+}
+
+// Register checks that metric could be written to InfluxDB
+func (s *InfluxSink) Register(desc *Desc) error {
+	switch desc.Type {
+	case CounterType, GaugeType, HistogramType:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported type of metric %q", desc.Name)
+}
+
+// Observe adds observation to aggregated values
+func (s *InfluxSink) Observe(desc *Desc, labels []string, value float64) {
+	s.observe(desc, labels, value)
+}
+
+// Run writes aggregated values every interval until context is done
+func (s *InfluxSink) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				logging.WithContext(ctx).Sugar().Warnf("could not write metrics to influx: %s", err)
+			}
+		}
+	}
+}
+
+// Flush writes aggregated values
+func (s *InfluxSink) Flush(ctx context.Context) error {
+	lines := s.makeLines(time.Now())
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if s.conn != nil {
+		return s.writeUDP(lines)
+	}
+
+	return s.writeHTTP(ctx, lines)
+}
+
+// Close closes UDP connection
+func (s *InfluxSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+
+	return nil
+}
+
+// makeLines formats aggregated values as lines of line protocol
+func (s *InfluxSink) makeLines(now time.Time) [][]byte {
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+
+	snapshot := s.snapshot()
+	lines := make([][]byte, 0, len(snapshot))
+	for _, agg := range snapshot {
+		line := make([]byte, 0, 256)
+		line = append(line, influxMeasurementReplacer.Replace(s.prefix+"_"+agg.desc.Name)...)
+
+		for i, value := range agg.labels {
+			// tags with empty values are not allowed
+			if value == "" {
+				continue
+			}
+
+			line = append(line, ',')
+			line = append(line, influxKeyReplacer.Replace(agg.desc.Labels[i])...)
+			line = append(line, '=')
+			line = append(line, influxKeyReplacer.Replace(value)...)
+		}
+
+		separator := byte(' ')
+		for _, f := range agg.fields() {
+			// NaN and Inf are not supported by line protocol
+			if math.IsNaN(f.value) || math.IsInf(f.value, 0) {
+				continue
+			}
+
+			line = append(line, separator)
+			line = append(line, influxKeyReplacer.Replace(f.name)...)
+			line = append(line, '=')
+			line = strconv.AppendFloat(line, f.value, 'f', -1, 64)
+			separator = ','
+		}
+
+		// line without fields is not valid
+		if separator == ' ' {
+			continue
+		}
+
+		line = append(line, ' ')
+		line = append(line, timestamp...)
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// writeHTTP writes all lines with one request
+func (s *InfluxSink) writeHTTP(ctx context.Context, lines [][]byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(bytes.Join(lines, []byte{'\n'})))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// writeUDP writes lines batched into packets
+func (s *InfluxSink) writeUDP(lines [][]byte) error {
+	packet := make([]byte, 0, s.packetSize)
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > s.packetSize {
+			if _, err := s.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	_, err := s.conn.Write(packet)
+
+	return err
+}
@@ -0,0 +1,136 @@
+package exposer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type InfluxSinkSuite struct{}
+
+var _ = Suite(&InfluxSinkSuite{})
+
+// timestampRe matches timestamps at the end of lines
+var timestampRe = regexp.MustCompile(` [0-9]+(\n|$)`)
+
+// observeAggregated registers metrics of all types in registry with sink and observes values
+func observeAggregated(c *C, sink Sink) {
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(sink), IsNil)
+	c.Assert(registry.Register(Desc{Name: "requests_total", Type: CounterType, Labels: []string{"host", "user_agent"}}), IsNil)
+	c.Assert(registry.Register(Desc{Name: "cached", Type: GaugeType}), IsNil)
+	c.Assert(registry.Register(Desc{
+		Name: "response_time_seconds", Type: HistogramType, Labels: []string{"host"}, Buckets: []float64{0.1, 1},
+	}), IsNil)
+
+	counter, err := registry.Counter("requests_total")
+	c.Assert(err, IsNil)
+	gauge, err := registry.Gauge("cached")
+	c.Assert(err, IsNil)
+	histogram, err := registry.Histogram("response_time_seconds")
+	c.Assert(err, IsNil)
+
+	counter.Inc("www.site.com", "Chrome 68, Mac=OS")
+	counter.Add(2, "www.site.com", "Chrome 68, Mac=OS")
+	counter.Inc("www.site.com", "")
+	gauge.Set(5)
+	gauge.Set(10)
+	histogram.Observe(0.05, "www.site.com")
+	histogram.Observe(0.5, "www.site.com")
+	histogram.Observe(2, "www.site.com")
+}
+
+func (s InfluxSinkSuite) TestFlush_HTTP(c *C) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Query().Get("db"), Equals, "accesslog")
+
+		raw, _ := ioutil.ReadAll(r.Body)
+		body = string(raw)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=accesslog", "", 1432, time.Second)
+	c.Assert(err, IsNil)
+
+	observeAggregated(c, sink)
+	c.Assert(sink.Flush(context.Background()), IsNil)
+
+	c.Assert(timestampRe.ReplaceAllString(body, "$1"), Equals, strings.Join([]string{
+		`accesslog_cached value=10`,
+		`accesslog_requests_total,host=www.site.com value=1`,
+		`accesslog_requests_total,host=www.site.com,user_agent=Chrome\ 68\,\ Mac\=OS value=3`,
+		`accesslog_response_time_seconds,host=www.site.com count=3,sum=2.55,le_0.1=1,le_1=2`,
+	}, "\n"))
+}
+
+func (s InfluxSinkSuite) TestFlush_HTTPError(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=unknown", "", 1432, time.Second)
+	c.Assert(err, IsNil)
+
+	observeAggregated(c, sink)
+	c.Assert(sink.Flush(context.Background()), ErrorMatches, "influx returned HTTP status 404.*: database not found")
+}
+
+func (s InfluxSinkSuite) TestFlush_UDP(c *C) {
+	listener := listenStatsD(c)
+	defer listener.Close()
+
+	// each line is sent with a separate packet
+	sink, err := NewInfluxSink("udp://"+listener.LocalAddr().String(), "nginx", 10, time.Second)
+	c.Assert(err, IsNil)
+	defer sink.Close()
+
+	observeAggregated(c, sink)
+	c.Assert(sink.Flush(context.Background()), IsNil)
+
+	packets := readPackets(c, listener)
+	c.Assert(packets, HasLen, 4)
+	c.Assert(timestampRe.ReplaceAllString(packets[0], "$1"), Equals, "nginx_cached value=10")
+}
+
+func (s InfluxSinkSuite) TestNewInfluxSink_UnsupportedAddress(c *C) {
+	_, err := NewInfluxSink("tcp://127.0.0.1:8089", "", 1432, time.Second)
+	c.Assert(err, ErrorMatches, `unsupported influx address "tcp://127.0.0.1:8089".*`)
+}
+
+func (s InfluxSinkSuite) TestFlush_IdleAggregates(c *C) {
+	sink, err := NewInfluxSink("http://127.0.0.1:8086/write", "", 1432, time.Second)
+	c.Assert(err, IsNil)
+
+	active := &Desc{Name: "active_total", Type: CounterType}
+	idle := &Desc{Name: "idle_total", Type: CounterType}
+	sink.Observe(active, nil, 1)
+	sink.Observe(idle, nil, 1)
+
+	// aggregate is flushed while it is idle for less than max number of flushes
+	for i := 0; i < maxIdleFlushes; i++ {
+		sink.Observe(active, nil, 1)
+		c.Assert(sink.snapshot(), HasLen, 2)
+	}
+
+	snapshot := sink.snapshot()
+	c.Assert(snapshot, HasLen, 1)
+	c.Assert(snapshot[0].desc, Equals, active)
+	c.Assert(snapshot[0].value, Equals, float64(maxIdleFlushes+1))
+
+	// value of removed aggregate starts from zero
+	sink.Observe(idle, nil, 1)
+	snapshot = sink.snapshot()
+	c.Assert(snapshot, HasLen, 2)
+	c.Assert(snapshot[1].desc, Equals, idle)
+	c.Assert(snapshot[1].value, Equals, float64(1))
+}
@@ -1,18 +1,29 @@
 package exposer
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
+	"fmt"
 )
 
 const (
-	namespace = "accesslog"
+	// defaultNamespace is a default prefix of metric names
+	defaultNamespace = "accesslog"
 
+	BuildInfoName                          = "build_info"
 	LogsDroppedTotalName                   = "logs_dropped_total"
 	LogsFailParsedTotalName                = "logs_fail_parsed_total"
 	LogsTotal                              = "logs_total"
 	LogsFilteredTotal                      = "logs_filtered_total"
 	UserAgentCachedTotal                   = "user_agent_cached_total"
 	UserAgentCurrentCachedTotal            = "user_agent_current_cached_total"
+	InvalidClientAddressesTotal            = "invalid_client_addresses_total"
+	LogsFilterDroppedTotal                 = "logs_filter_dropped_total"
+	SLORequestsTotal                       = "slo_requests_total"
+	SLOGoodRequestsTotal                   = "slo_good_requests_total"
+	ApdexRequestsTotal                     = "apdex_requests_total"
+	TopKRequests                           = "top_k_requests"
+	UniqueVisitors                         = "unique_visitors"
+	AbuseEventsTotal                       = "abuse_events_total"
+	SampledLinesTotal                      = "sampled_lines_total"
 	HostResponseTimeSecondsMetricName      = "host_response_time_seconds"
 	UserAgentResponseTimeSecondsMetricName = "user_agent_response_time_seconds"
 	UserAgentRequestsTotalMetricName       = "user_agent_requests_total"
@@ -27,94 +38,307 @@ var (
 	Branch   string
 )
 
-var (
-	// business metrics
-	hostResponseTimeSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: namespace,
-		Name:      HostResponseTimeSecondsMetricName,
-		Help:      "Response time by host in seconds",
-	}, []string{"host", "code"})
-	userAgentResponseTimeSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: namespace,
-		Name:      UserAgentResponseTimeSecondsMetricName,
-		Help:      "Response time by user agent in seconds",
-	}, []string{"host", "user_agent", "code"})
-	userAgentRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      UserAgentRequestsTotalMetricName,
-		Help:      "Requests total by user agent",
-	}, []string{"host", "user_agent", "code"})
-	osDeviceTypeRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      OsDeviceTypeRequestsTotalMetricName,
-		Help:      "Requests total by os and device type",
-	}, []string{"host", "os", "device_type"})
-	URIResponseTimeSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: namespace,
-		Name:      URIResponseTimeSecondsMetricName,
-		Help:      "Response time by uri in seconds",
-	}, []string{"host", "uri", "code"})
-	nginxRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      NginxRequestsTotal,
-		Help:      "Total requests by nginx host",
-	}, []string{"host"})
-
-	// internal accesslog exporter metrics
-	accesslogBuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "build_info",
-		Help:      "A metric with a constant '1' value labeled by version, revision, and branch from which the node_exporter was built.",
-	}, []string{"version", "revision", "branch"})
-	logsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      LogsDroppedTotalName,
-		Help:      "Logs that were dropped",
-	}, []string{"nginx_host"})
-	logsFailParsedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      LogsFailParsedTotalName,
-		Help:      "Total fail parsed logs",
-	}, []string{"nginx_host"})
-	logsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      LogsTotal,
-		Help:      "Total log lines",
-	}, []string{"nginx_host"})
-	logsFilteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      LogsFilteredTotal,
-		Help:      "Total filtered logs by subnet",
-	}, []string{"nginx_host"})
-	userAgentCachedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      UserAgentCachedTotal,
-		Help:      "Total cached user agents",
-	}, []string{"nginx_host"})
-	userAgentCurrentCachedTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      UserAgentCurrentCachedTotal,
-		Help:      "Total current cached user agents",
-	}, []string{"nginx_host"})
-)
+// defaultBuckets are default buckets of response time histograms
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestMetrics are metrics that are exposed for every request, their labels can be extended with extra labels
+var requestMetrics = []Desc{
+	{
+		Name:    HostResponseTimeSecondsMetricName,
+		Help:    "Response time by host in seconds",
+		Type:    HistogramType,
+		Labels:  []string{"host", "code"},
+		Buckets: defaultBuckets,
+	},
+	{
+		Name:    UserAgentResponseTimeSecondsMetricName,
+		Help:    "Response time by user agent in seconds",
+		Type:    HistogramType,
+		Labels:  []string{"host", "user_agent", "code"},
+		Buckets: defaultBuckets,
+	},
+	{
+		Name:   UserAgentRequestsTotalMetricName,
+		Help:   "Requests total by user agent",
+		Type:   CounterType,
+		Labels: []string{"host", "user_agent", "code"},
+	},
+	{
+		Name:   OsDeviceTypeRequestsTotalMetricName,
+		Help:   "Requests total by os and device type",
+		Type:   CounterType,
+		Labels: []string{"host", "os", "device_type"},
+	},
+	{
+		Name:    URIResponseTimeSecondsMetricName,
+		Help:    "Response time by uri in seconds",
+		Type:    HistogramType,
+		Labels:  []string{"host", "uri", "code"},
+		Buckets: defaultBuckets,
+	},
+}
+
+// internalMetrics are metrics of nginx hosts and accesslog exporter itself
+var internalMetrics = []Desc{
+	{
+		Name:   NginxRequestsTotal,
+		Help:   "Total requests by nginx host",
+		Type:   CounterType,
+		Labels: []string{"host"},
+	},
+	{
+		Name:   BuildInfoName,
+		Help:   "A metric with a constant '1' value labeled by version, revision, and branch from which the node_exporter was built.",
+		Type:   GaugeType,
+		Labels: []string{"version", "revision", "branch"},
+	},
+	{
+		Name:   LogsDroppedTotalName,
+		Help:   "Logs that were dropped",
+		Type:   CounterType,
+		Labels: []string{"nginx_host"},
+	},
+	{
+		Name:   LogsFailParsedTotalName,
+		Help:   "Total fail parsed logs by reason",
+		Type:   CounterType,
+		Labels: []string{"nginx_host", "reason"},
+	},
+	{
+		Name:   LogsTotal,
+		Help:   "Total log lines",
+		Type:   CounterType,
+		Labels: []string{"nginx_host"},
+	},
+	{
+		Name:   LogsFilteredTotal,
+		Help:   "Total filtered logs by subnet",
+		Type:   CounterType,
+		Labels: []string{"nginx_host"},
+	},
+	{
+		Name:   UserAgentCachedTotal,
+		Help:   "Total cached user agents",
+		Type:   CounterType,
+		Labels: []string{"nginx_host"},
+	},
+	{
+		Name:   UserAgentCurrentCachedTotal,
+		Help:   "Total current cached user agents",
+		Type:   GaugeType,
+		Labels: []string{"nginx_host"},
+	},
+	{
+		Name:   InvalidClientAddressesTotal,
+		Help:   "Total logs with client address that could not be parsed",
+		Type:   CounterType,
+		Labels: []string{"nginx_host"},
+	},
+	{
+		Name:   LogsFilterDroppedTotal,
+		Help:   "Total logs dropped by filters",
+		Type:   CounterType,
+		Labels: []string{"nginx_host", "filter"},
+	},
+	{
+		Name:   SLORequestsTotal,
+		Help:   "Total requests selected by SLO objective",
+		Type:   CounterType,
+		Labels: []string{"objective", "host", "uri"},
+	},
+	{
+		Name:   SLOGoodRequestsTotal,
+		Help:   "Total successful requests not slower than latency threshold of SLO objective",
+		Type:   CounterType,
+		Labels: []string{"objective", "host", "uri"},
+	},
+	{
+		Name:   ApdexRequestsTotal,
+		Help:   "Total requests selected by SLO objective by apdex zone: satisfied, tolerating or frustrated",
+		Type:   CounterType,
+		Labels: []string{"objective", "host", "uri", "zone"},
+	},
+	{
+		Name:   TopKRequests,
+		Help:   "Estimated requests of the most frequent values of dimension in sliding window",
+		Type:   GaugeType,
+		Labels: []string{"dimension", "value"},
+	},
+	{
+		Name:   UniqueVisitors,
+		Help:   "Estimated number of distinct values of dimension by host in rolling window",
+		Type:   GaugeType,
+		Labels: []string{"host", "dimension", "window"},
+	},
+	{
+		Name:   AbuseEventsTotal,
+		Help:   "Number of times clients exceeded threshold of abuse rule",
+		Type:   CounterType,
+		Labels: []string{"rule"},
+	},
+	{
+		Name:   SampledLinesTotal,
+		Help:   "Number of slow and failed requests qualified for sampling log by reason and result of writing",
+		Type:   CounterType,
+		Labels: []string{"reason", "result"},
+	},
+}
+
+// IsRequestMetric checks if metric is exposed for every request
+func IsRequestMetric(name string) bool {
+	for _, desc := range requestMetrics {
+		if desc.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MetricsOptions contains settings of exporter metrics
+type MetricsOptions struct {
+	// ExtraLabels are additional labels of request metrics by metric name
+	ExtraLabels map[string][]string
+	// Histograms are representations of response time metrics by metric name
+	Histograms map[string]HistogramOpts
+	// SourceLabels are labels of sources, that are appended to all metrics of sources
+	SourceLabels []string
+	// ConstLabels are labels with the same value for all metrics
+	ConstLabels map[string]string
+	// DropLabels are labels that are not exposed by metric name
+	DropLabels map[string][]string
+	// CustomMetrics are metrics defined by user, histograms without buckets have default ones
+	CustomMetrics []Desc
+}
+
+// RegisterMetrics registers all metrics of exporter. Labels of request metrics are extended with extra labels
+// by metric name, histograms are registered with representation set by metric name.
+func RegisterMetrics(registry *Registry, opts MetricsOptions) error {
+	for name := range opts.ExtraLabels {
+		if !IsRequestMetric(name) {
+			return fmt.Errorf("labels could not be added to metric %q", name)
+		}
+	}
+
+	for name, histogram := range opts.Histograms {
+		if !isRequestHistogram(name) {
+			return fmt.Errorf("metric %q is not a response time histogram", name)
+		}
+		if histogram.NativeHistogram != nil && histogram.Summary != nil {
+			return fmt.Errorf("metric %q could not be both native histogram and summary", name)
+		}
+	}
+
+	customMetrics := make(map[string]bool, len(opts.CustomMetrics))
+	for _, desc := range opts.CustomMetrics {
+		customMetrics[desc.Name] = true
+	}
+
+	for name := range opts.DropLabels {
+		if !isMetric(name) && !customMetrics[name] {
+			return fmt.Errorf("labels could not be dropped from unknown metric %q", name)
+		}
+	}
+
+	for _, desc := range requestMetrics {
+		desc.Labels = append(append([]string{}, desc.Labels...), opts.ExtraLabels[desc.Name]...)
+		desc.Labels = append(desc.Labels, opts.SourceLabels...)
+		desc.ConstLabels = opts.ConstLabels
+		desc.DropLabels = opts.DropLabels[desc.Name]
+
+		if histogram, ok := opts.Histograms[desc.Name]; ok {
+			desc.NativeHistogram = histogram.NativeHistogram
+			desc.Summary = histogram.Summary
+
+			switch {
+			case len(histogram.Buckets) > 0:
+				desc.Buckets = histogram.Buckets
+			case histogram.NativeHistogram != nil, histogram.Summary != nil:
+				// classic buckets are dropped to reduce number of series
+				desc.Buckets = nil
+			}
+		}
+
+		if err := registry.Register(desc); err != nil {
+			return err
+		}
+	}
+
+	for _, desc := range internalMetrics {
+		if IsSourceMetric(desc.Name) {
+			desc.Labels = append(append([]string{}, desc.Labels...), opts.SourceLabels...)
+		}
+		desc.ConstLabels = opts.ConstLabels
+		desc.DropLabels = opts.DropLabels[desc.Name]
+
+		if err := registry.Register(desc); err != nil {
+			return err
+		}
+	}
+
+	for _, desc := range opts.CustomMetrics {
+		desc.Labels = append(append([]string{}, desc.Labels...), opts.SourceLabels...)
+		desc.ConstLabels = opts.ConstLabels
+		desc.DropLabels = opts.DropLabels[desc.Name]
+		if desc.Type == HistogramType && len(desc.Buckets) == 0 {
+			desc.Buckets = defaultBuckets
+		}
+
+		if err := registry.Register(desc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsSourceMetric checks if metric is exposed by source, so labels of source are appended to it
+func IsSourceMetric(name string) bool {
+	switch name {
+	case BuildInfoName, TopKRequests, UniqueVisitors, AbuseEventsTotal, SampledLinesTotal:
+		return false
+	}
+
+	return true
+}
+
+// isMetric checks if metric is exposed by exporter
+func isMetric(name string) bool {
+	_, ok := metricDesc(name)
+
+	return ok
+}
+
+// MetricLabels returns labels of metric exposed by exporter without extra and source labels, label values
+// are passed to metric handle in the same order
+func MetricLabels(name string) []string {
+	if desc, ok := metricDesc(name); ok {
+		return append([]string{}, desc.Labels...)
+	}
+
+	return nil
+}
+
+// metricDesc returns description of metric exposed by exporter
+func metricDesc(name string) (Desc, bool) {
+	for _, descs := range [][]Desc{requestMetrics, internalMetrics} {
+		for _, desc := range descs {
+			if desc.Name == name {
+				return desc, true
+			}
+		}
+	}
+
+	return Desc{}, false
+}
+
+// isRequestHistogram checks if metric is a histogram exposed for every request
+func isRequestHistogram(name string) bool {
+	for _, desc := range requestMetrics {
+		if desc.Name == name {
+			return desc.Type == HistogramType
+		}
+	}
 
-func init() {
-	prometheus.MustRegister(
-		nginxRequestsTotal,
-		hostResponseTimeSeconds,
-		userAgentResponseTimeSeconds,
-		userAgentRequestsTotal,
-		osDeviceTypeRequestsTotal,
-		URIResponseTimeSeconds,
-
-		accesslogBuildInfo,
-		logsDropped,
-		logsFailParsedTotal,
-		logsTotal,
-		logsFilteredTotal,
-		userAgentCachedTotal,
-		userAgentCurrentCachedTotal,
-	)
-
-	accesslogBuildInfo.WithLabelValues(Version, Revision, Branch).Set(1)
+	return false
 }
@@ -0,0 +1,81 @@
+package exposer
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newDummyRegistry creates registry with all metrics registered, that are exposed by returned prometheus registry
+func newDummyRegistry(opts MetricsOptions) (*Registry, *prometheus.Registry, error) {
+	promRegistry := prometheus.NewRegistry()
+
+	registry := NewRegistry()
+	if err := registry.Subscribe(NewPromSink(promRegistry, "")); err != nil {
+		return nil, nil, err
+	}
+	if err := RegisterMetrics(registry, opts); err != nil {
+		return nil, nil, err
+	}
+
+	return registry, promRegistry, nil
+}
+
+// NewDummyCounter returns registered counter and gatherer of its series, it is used in tests of metrics observers
+func NewDummyCounter(name string, opts MetricsOptions) (*Counter, prometheus.Gatherer, error) {
+	registry, promRegistry, err := newDummyRegistry(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	counter, err := registry.Counter(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return counter, promRegistry, nil
+}
+
+// NewDummyGauge returns registered gauge and gatherer of its series, it is used in tests of metrics observers
+func NewDummyGauge(name string, opts MetricsOptions) (*Gauge, prometheus.Gatherer, error) {
+	registry, promRegistry, err := newDummyRegistry(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gauge, err := registry.Gauge(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gauge, promRegistry, nil
+}
+
+// GatherValues returns values of counter or gauge series of metric by label values joined with comma
+func GatherValues(gatherer prometheus.Gatherer, name string) (map[string]float64, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "accesslog_"+name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				labels = append(labels, pair.GetValue())
+			}
+
+			value := metric.GetCounter().GetValue()
+			if metric.Gauge != nil {
+				value = metric.GetGauge().GetValue()
+			}
+			values[strings.Join(labels, ",")] = value
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,422 @@
+package exposer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// OTLPProtocolGRPC is OTLP over gRPC
+	OTLPProtocolGRPC = "grpc"
+	// OTLPProtocolHTTP is OTLP over HTTP with protobuf payload
+	OTLPProtocolHTTP = "http"
+
+	otlpScopeName          = "github.com/ozonru/accesslog-exporter"
+	defaultOTLPServiceName = "accesslog-exporter"
+)
+
+// OTLPOptions contains settings of OTLP exporter
+type OTLPOptions struct {
+	// Endpoint is host:port for gRPC and full URL for HTTP, for example http://collector:4318/v1/metrics
+	Endpoint string
+	Protocol string
+	Insecure bool
+	Headers  map[string]string
+	Timeout  time.Duration
+
+	// ServiceName and HostName are resource attributes service.name and host.name
+	ServiceName string
+	HostName    string
+}
+
+// OTLPExporter periodically gathers metrics and exports them using OpenTelemetry protocol. Counters and histograms
+// are exported with cumulative temporality.
+type OTLPExporter struct {
+	opts      OTLPOptions
+	gatherer  prometheus.Gatherer
+	startTime time.Time
+	resource  *resourcepb.Resource
+
+	httpClient *http.Client
+	grpcConn   *grpc.ClientConn
+	grpcClient collectormetrics.MetricsServiceClient
+}
+
+// NewOTLPExporter creates OTLP exporter of gatherer metrics
+func NewOTLPExporter(gatherer prometheus.Gatherer, opts OTLPOptions) (*OTLPExporter, error) {
+	if opts.ServiceName == "" {
+		opts.ServiceName = defaultOTLPServiceName
+	}
+	if opts.HostName == "" {
+		opts.HostName, _ = os.Hostname()
+	}
+
+	e := &OTLPExporter{
+		opts:      opts,
+		gatherer:  gatherer,
+		startTime: time.Now(),
+		resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			stringAttribute("service.name", opts.ServiceName),
+			stringAttribute("host.name", opts.HostName),
+		}},
+	}
+
+	switch opts.Protocol {
+	case OTLPProtocolGRPC:
+		creds := credentials.NewTLS(nil)
+		if opts.Insecure {
+			creds = insecure.NewCredentials()
+		}
+
+		conn, err := grpc.NewClient(opts.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+
+		e.grpcConn = conn
+		e.grpcClient = collectormetrics.NewMetricsServiceClient(conn)
+	case OTLPProtocolHTTP:
+		e.httpClient = &http.Client{Timeout: opts.Timeout}
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol %q", opts.Protocol)
+	}
+
+	return e, nil
+}
+
+// Run exports metrics every interval until context is done
+func (e *OTLPExporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Export(ctx); err != nil {
+				logging.WithContext(ctx).Sugar().Warnf("could not export metrics via otlp: %s", err)
+			}
+		}
+	}
+}
+
+// Export gathers metrics and sends them to collector
+func (e *OTLPExporter) Export(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	req := &collectormetrics.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: e.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName, Version: Version},
+				Metrics: e.makeMetrics(families, time.Now()),
+			}},
+		}},
+	}
+
+	if e.grpcClient != nil {
+		return e.exportGRPC(ctx, req)
+	}
+
+	return e.exportHTTP(ctx, req)
+}
+
+// Close closes connection to collector
+func (e *OTLPExporter) Close() error {
+	if e.grpcConn != nil {
+		return e.grpcConn.Close()
+	}
+
+	return nil
+}
+
+// exportGRPC sends request via gRPC
+func (e *OTLPExporter) exportGRPC(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) error {
+	if e.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.opts.Timeout)
+		defer cancel()
+	}
+
+	if len(e.opts.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.opts.Headers))
+	}
+
+	resp, err := e.grpcClient.Export(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return partialSuccessError(resp.GetPartialSuccess())
+}
+
+// exportHTTP sends request via HTTP
+func (e *OTLPExporter) exportHTTP(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range e.opts.Headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	resp, err := e.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned HTTP status %s", resp.Status)
+	}
+
+	// response body is optional, partial success is reported only when it could be decoded
+	var exportResp collectormetrics.ExportMetricsServiceResponse
+	if err := proto.Unmarshal(respBody, &exportResp); err != nil {
+		return nil
+	}
+
+	return partialSuccessError(exportResp.GetPartialSuccess())
+}
+
+// makeMetrics converts gathered metric families into OTLP metrics
+func (e *OTLPExporter) makeMetrics(families []*dto.MetricFamily, now time.Time) []*metricspb.Metric {
+	startTime := uint64(e.startTime.UnixNano())
+	timestamp := uint64(now.UnixNano())
+
+	metrics := make([]*metricspb.Metric, 0, len(families))
+	for _, family := range families {
+		metric := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}
+			for _, m := range family.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:        labelAttributes(m),
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      timestamp,
+					Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()},
+				})
+			}
+			metric.Data = &metricspb.Metric_Sum{Sum: sum}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+
+				gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:   labelAttributes(m),
+					TimeUnixNano: timestamp,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				})
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+		case dto.MetricType_HISTOGRAM:
+			if len(family.GetMetric()) > 0 && isNativeHistogram(family.GetMetric()[0].GetHistogram()) {
+				histogram := &metricspb.ExponentialHistogram{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				}
+				for _, m := range family.GetMetric() {
+					point := exponentialHistogramDataPoint(m.GetHistogram())
+					point.Attributes = labelAttributes(m)
+					point.StartTimeUnixNano = startTime
+					point.TimeUnixNano = timestamp
+
+					histogram.DataPoints = append(histogram.DataPoints, point)
+				}
+				metric.Data = &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: histogram}
+
+				break
+			}
+
+			histogram := &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}
+			for _, m := range family.GetMetric() {
+				point := histogramDataPoint(m.GetHistogram())
+				point.Attributes = labelAttributes(m)
+				point.StartTimeUnixNano = startTime
+				point.TimeUnixNano = timestamp
+
+				histogram.DataPoints = append(histogram.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, m := range family.GetMetric() {
+				point := &metricspb.SummaryDataPoint{
+					Attributes:        labelAttributes(m),
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      timestamp,
+					Count:             m.GetSummary().GetSampleCount(),
+					Sum:               m.GetSummary().GetSampleSum(),
+				}
+				for _, q := range m.GetSummary().GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					})
+				}
+
+				summary.DataPoints = append(summary.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Summary{Summary: summary}
+		default:
+			continue
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+// histogramDataPoint converts cumulative Prometheus buckets into explicit bucket histogram
+func histogramDataPoint(histogram *dto.Histogram) *metricspb.HistogramDataPoint {
+	sum := histogram.GetSampleSum()
+	point := &metricspb.HistogramDataPoint{
+		Count: histogram.GetSampleCount(),
+		Sum:   &sum,
+	}
+
+	var prev uint64
+	for _, bucket := range histogram.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), +1) {
+			break
+		}
+
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, bucket.GetCumulativeCount()-prev)
+		prev = bucket.GetCumulativeCount()
+	}
+
+	// the last bucket counts values greater than the last bound
+	point.BucketCounts = append(point.BucketCounts, histogram.GetSampleCount()-prev)
+
+	return point
+}
+
+// isNativeHistogram checks if histogram has only native buckets
+func isNativeHistogram(histogram *dto.Histogram) bool {
+	return histogram.Schema != nil && len(histogram.GetBucket()) == 0
+}
+
+// exponentialHistogramDataPoint converts native Prometheus histogram into exponential histogram. Native histogram
+// bucket with index i covers (base^(i-1), base^i], while exponential bucket covers (base^i, base^(i+1)],
+// so the offsets differ by one.
+func exponentialHistogramDataPoint(histogram *dto.Histogram) *metricspb.ExponentialHistogramDataPoint {
+	sum := histogram.GetSampleSum()
+
+	return &metricspb.ExponentialHistogramDataPoint{
+		Count:         histogram.GetSampleCount(),
+		Sum:           &sum,
+		Scale:         histogram.GetSchema(),
+		ZeroCount:     histogram.GetZeroCount(),
+		ZeroThreshold: histogram.GetZeroThreshold(),
+		Positive:      exponentialBuckets(histogram.GetPositiveSpan(), histogram.GetPositiveDelta()),
+		Negative:      exponentialBuckets(histogram.GetNegativeSpan(), histogram.GetNegativeDelta()),
+	}
+}
+
+// exponentialBuckets converts spans and delta encoded counts of native histogram into dense bucket counts
+func exponentialBuckets(spans []*dto.BucketSpan, deltas []int64) *metricspb.ExponentialHistogramDataPoint_Buckets {
+	buckets := &metricspb.ExponentialHistogramDataPoint_Buckets{}
+	if len(spans) == 0 {
+		return buckets
+	}
+
+	buckets.Offset = spans[0].GetOffset() - 1
+
+	var count int64
+	deltaIndex := 0
+	for i, span := range spans {
+		// offsets of all spans except the first one are gaps after the previous span
+		if i > 0 {
+			for j := int32(0); j < span.GetOffset(); j++ {
+				buckets.BucketCounts = append(buckets.BucketCounts, 0)
+			}
+		}
+
+		for j := uint32(0); j < span.GetLength() && deltaIndex < len(deltas); j++ {
+			count += deltas[deltaIndex]
+			deltaIndex++
+
+			buckets.BucketCounts = append(buckets.BucketCounts, uint64(count))
+		}
+	}
+
+	return buckets
+}
+
+// labelAttributes converts labels of metric into attributes
+func labelAttributes(m *dto.Metric) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		attributes = append(attributes, stringAttribute(l.GetName(), l.GetValue()))
+	}
+
+	return attributes
+}
+
+// stringAttribute creates attribute with string value
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// partialSuccessError returns error if collector rejected some data points
+func partialSuccessError(partialSuccess *collectormetrics.ExportMetricsPartialSuccess) error {
+	if partialSuccess.GetRejectedDataPoints() > 0 {
+		return fmt.Errorf("collector rejected %d data points: %s",
+			partialSuccess.GetRejectedDataPoints(), partialSuccess.GetErrorMessage())
+	}
+
+	return nil
+}
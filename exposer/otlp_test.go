@@ -0,0 +1,229 @@
+package exposer
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	. "gopkg.in/check.v1"
+)
+
+type OTLPSuite struct{}
+
+var _ = Suite(&OTLPSuite{})
+
+// otlpReceiver is an in-process OTLP receiver
+type otlpReceiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	requests []*collectormetrics.ExportMetricsServiceRequest
+	headers  []map[string]string
+}
+
+// Export receives request via gRPC
+func (r *otlpReceiver) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	headers := make(map[string]string)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for name, values := range md {
+			headers[name] = values[0]
+		}
+	}
+
+	r.record(req, headers)
+
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+// ServeHTTP receives request via HTTP
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
+	body, _ := ioutil.ReadAll(httpReq.Body)
+
+	var req collectormetrics.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	r.record(&req, map[string]string{
+		"content-type":  httpReq.Header.Get("Content-Type"),
+		"authorization": httpReq.Header.Get("Authorization"),
+	})
+
+	resp, _ := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+	_, _ = w.Write(resp)
+}
+
+// record saves received request
+func (r *otlpReceiver) record(req *collectormetrics.ExportMetricsServiceRequest, headers map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.headers = append(r.headers, headers)
+}
+
+// assertRequest checks resource attributes and metrics of request created from newRemoteWriteRegistry metrics
+func assertRequest(c *C, req *collectormetrics.ExportMetricsServiceRequest) {
+	c.Assert(req.GetResourceMetrics(), HasLen, 1)
+	resourceMetrics := req.GetResourceMetrics()[0]
+
+	attributes := make(map[string]string)
+	for _, attr := range resourceMetrics.GetResource().GetAttributes() {
+		attributes[attr.GetKey()] = attr.GetValue().GetStringValue()
+	}
+	c.Assert(attributes, DeepEquals, map[string]string{"service.name": "accesslog", "host.name": "node1"})
+
+	c.Assert(resourceMetrics.GetScopeMetrics(), HasLen, 1)
+	metrics := resourceMetrics.GetScopeMetrics()[0].GetMetrics()
+	c.Assert(metrics, HasLen, 2)
+
+	// counter is a cumulative monotonic sum
+	c.Assert(metrics[0].GetName(), Equals, "requests_total")
+	sum := metrics[0].GetSum()
+	c.Assert(sum, NotNil)
+	c.Assert(sum.GetIsMonotonic(), Equals, true)
+	c.Assert(sum.GetAggregationTemporality(), Equals, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE)
+	c.Assert(sum.GetDataPoints(), HasLen, 1)
+	c.Assert(sum.GetDataPoints()[0].GetAsDouble(), Equals, float64(3))
+	c.Assert(sum.GetDataPoints()[0].GetAttributes(), HasLen, 1)
+	c.Assert(sum.GetDataPoints()[0].GetAttributes()[0].GetKey(), Equals, "host")
+	c.Assert(sum.GetDataPoints()[0].GetAttributes()[0].GetValue().GetStringValue(), Equals, "localhost")
+	c.Assert(sum.GetDataPoints()[0].GetStartTimeUnixNano() <= sum.GetDataPoints()[0].GetTimeUnixNano(), Equals, true)
+
+	// histogram has explicit bounds and non-cumulative bucket counts
+	c.Assert(metrics[1].GetName(), Equals, "response_time_seconds")
+	histogram := metrics[1].GetHistogram()
+	c.Assert(histogram, NotNil)
+	c.Assert(histogram.GetAggregationTemporality(), Equals, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE)
+	c.Assert(histogram.GetDataPoints(), HasLen, 1)
+	point := histogram.GetDataPoints()[0]
+	c.Assert(point.GetExplicitBounds(), DeepEquals, []float64{0.1, 1})
+	c.Assert(point.GetBucketCounts(), DeepEquals, []uint64{0, 1, 0})
+	c.Assert(point.GetCount(), Equals, uint64(1))
+	c.Assert(point.GetSum(), Equals, 0.5)
+}
+
+func (s OTLPSuite) TestExport_GRPC(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	receiver := &otlpReceiver{}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exporter, err := NewOTLPExporter(newRemoteWriteRegistry(c), OTLPOptions{
+		Endpoint:    listener.Addr().String(),
+		Protocol:    OTLPProtocolGRPC,
+		Insecure:    true,
+		Headers:     map[string]string{"x-tenant": "team1"},
+		Timeout:     time.Second,
+		ServiceName: "accesslog",
+		HostName:    "node1",
+	})
+	c.Assert(err, IsNil)
+	defer exporter.Close()
+
+	c.Assert(exporter.Export(context.Background()), IsNil)
+
+	c.Assert(receiver.requests, HasLen, 1)
+	c.Assert(receiver.headers[0]["x-tenant"], Equals, "team1")
+	assertRequest(c, receiver.requests[0])
+}
+
+func (s OTLPSuite) TestExport_HTTP(c *C) {
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(newRemoteWriteRegistry(c), OTLPOptions{
+		Endpoint:    server.URL + "/v1/metrics",
+		Protocol:    OTLPProtocolHTTP,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		Timeout:     time.Second,
+		ServiceName: "accesslog",
+		HostName:    "node1",
+	})
+	c.Assert(err, IsNil)
+	defer exporter.Close()
+
+	c.Assert(exporter.Export(context.Background()), IsNil)
+
+	c.Assert(receiver.requests, HasLen, 1)
+	c.Assert(receiver.headers[0]["content-type"], Equals, "application/x-protobuf")
+	c.Assert(receiver.headers[0]["authorization"], Equals, "Bearer token")
+	assertRequest(c, receiver.requests[0])
+}
+
+func (s OTLPSuite) TestExport_HTTPError(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(newRemoteWriteRegistry(c), OTLPOptions{
+		Endpoint: server.URL,
+		Protocol: OTLPProtocolHTTP,
+		Timeout:  time.Second,
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(exporter.Export(context.Background()), ErrorMatches, "collector returned HTTP status 503.*")
+}
+
+func (s OTLPSuite) TestNewOTLPExporter_UnsupportedProtocol(c *C) {
+	_, err := NewOTLPExporter(newRemoteWriteRegistry(c), OTLPOptions{Protocol: "udp"})
+	c.Assert(err, ErrorMatches, `unsupported otlp protocol "udp"`)
+}
+
+func (s OTLPSuite) TestExport_NativeHistogram(c *C) {
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        "response_time_seconds",
+		NativeHistogramBucketFactor: 2,
+	})
+	c.Assert(registry.Register(histogram), IsNil)
+	histogram.Observe(1)
+	histogram.Observe(3)
+	histogram.Observe(3)
+	histogram.Observe(0)
+
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(registry, OTLPOptions{Endpoint: server.URL, Protocol: OTLPProtocolHTTP, Timeout: time.Second})
+	c.Assert(err, IsNil)
+	c.Assert(exporter.Export(context.Background()), IsNil)
+
+	c.Assert(receiver.requests, HasLen, 1)
+	metrics := receiver.requests[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+	c.Assert(metrics, HasLen, 1)
+
+	exponential := metrics[0].GetExponentialHistogram()
+	c.Assert(exponential, NotNil)
+	c.Assert(exponential.GetDataPoints(), HasLen, 1)
+
+	// buckets (0.5, 1] and (2, 4] with scale 0
+	point := exponential.GetDataPoints()[0]
+	c.Assert(point.GetScale(), Equals, int32(0))
+	c.Assert(point.GetCount(), Equals, uint64(4))
+	c.Assert(point.GetSum(), Equals, float64(7))
+	c.Assert(point.GetZeroCount(), Equals, uint64(1))
+	c.Assert(point.GetPositive().GetOffset(), Equals, int32(-1))
+	c.Assert(point.GetPositive().GetBucketCounts(), DeepEquals, []uint64{1, 0, 2})
+}
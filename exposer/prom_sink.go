@@ -0,0 +1,170 @@
+package exposer
+
+import (
+	"fmt"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// PromSink is a sink that exposes metrics for Prometheus
+type PromSink struct {
+	registerer prometheus.Registerer
+	namespace  string
+
+	// vectors contains metric vectors by metric description
+	vectors sync.Map
+}
+
+// NewPromSink creates new sink that registers metrics in Prometheus registerer. Namespace is a prefix of metric names,
+// default namespace is used if it is empty.
+func NewPromSink(registerer prometheus.Registerer, namespace string) *PromSink {
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	return &PromSink{registerer: registerer, namespace: namespace}
+}
+
+// Register creates and registers metric vector
+func (s *PromSink) Register(desc *Desc) error {
+	var collector prometheus.Collector
+
+	switch desc.Type {
+	case CounterType:
+		collector = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: s.namespace,
+			Name:      desc.Name,
+			Help:      desc.Help,
+		}, desc.Labels)
+	case GaugeType:
+		collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: s.namespace,
+			Name:      desc.Name,
+			Help:      desc.Help,
+		}, desc.Labels)
+	case HistogramType:
+		collector = s.newObserverVec(desc)
+	default:
+		return fmt.Errorf("unsupported type of metric %q", desc.Name)
+	}
+
+	if err := s.registerer.Register(collector); err != nil {
+		return fmt.Errorf("could not register metric %q: %s", desc.Name, err)
+	}
+
+	s.vectors.Store(desc, collector)
+
+	return nil
+}
+
+// Observe updates metric of vector with label values
+func (s *PromSink) Observe(desc *Desc, labels []string, value float64) {
+	collector, ok := s.vectors.Load(desc)
+	if !ok {
+		return
+	}
+
+	switch vec := collector.(type) {
+	case *prometheus.CounterVec:
+		if counter, err := vec.GetMetricWithLabelValues(labels...); err == nil && value >= 0 {
+			counter.Add(value)
+		}
+	case *prometheus.GaugeVec:
+		if gauge, err := vec.GetMetricWithLabelValues(labels...); err == nil {
+			gauge.Set(value)
+		}
+	case prometheus.ObserverVec:
+		if observer, err := vec.GetMetricWithLabelValues(labels...); err == nil {
+			observer.Observe(value)
+		}
+	}
+}
+
+// Reset removes all series of metric vector
+func (s *PromSink) Reset(desc *Desc) {
+	collector, ok := s.vectors.Load(desc)
+	if !ok {
+		return
+	}
+
+	if vec, ok := collector.(interface{ Reset() }); ok {
+		vec.Reset()
+	}
+}
+
+// newObserverVec creates summary or histogram vector, the histogram is native when its options are set
+func (s *PromSink) newObserverVec(desc *Desc) prometheus.Collector {
+	if desc.Summary != nil {
+		return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:  s.namespace,
+			Name:       desc.Name,
+			Help:       desc.Help,
+			Objectives: desc.Summary.Objectives,
+			MaxAge:     desc.Summary.MaxAge,
+			AgeBuckets: desc.Summary.AgeBuckets,
+		}, desc.Labels)
+	}
+
+	opts := prometheus.HistogramOpts{
+		Namespace: s.namespace,
+		Name:      desc.Name,
+		Help:      desc.Help,
+		Buckets:   desc.Buckets,
+	}
+
+	// classic buckets are not created for native histogram when they are not set
+	if native := desc.NativeHistogram; native != nil {
+		opts.NativeHistogramBucketFactor = native.BucketFactor
+		opts.NativeHistogramMaxBucketNumber = native.MaxBuckets
+		opts.NativeHistogramMinResetDuration = native.MinResetDuration
+	}
+
+	return prometheus.NewHistogramVec(opts, desc.Labels)
+}
+
+// ObserveWithExemplar updates histogram of vector with label values and attaches exemplar to observation.
+// Exemplar is dropped if it is not valid, for example when it is longer than 128 runes.
+func (s *PromSink) ObserveWithExemplar(desc *Desc, labels []string, value float64, exemplar map[string]string) {
+	collector, ok := s.vectors.Load(desc)
+	if !ok {
+		return
+	}
+
+	vec, ok := collector.(prometheus.ObserverVec)
+	if !ok {
+		s.Observe(desc, labels, value)
+
+		return
+	}
+
+	observer, err := vec.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		return
+	}
+
+	exemplarObserver, ok := observer.(prometheus.ExemplarObserver)
+	if !ok || !isValidExemplar(exemplar) {
+		observer.Observe(value)
+
+		return
+	}
+
+	exemplarObserver.ObserveWithExemplar(value, exemplar)
+}
+
+// isValidExemplar checks exemplar labels the same way as client library does, because invalid exemplar causes panic
+func isValidExemplar(exemplar map[string]string) bool {
+	runes := 0
+	for name, value := range exemplar {
+		if !model.LabelName(name).IsValid() || !utf8.ValidString(value) {
+			return false
+		}
+
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+
+	return runes <= prometheus.ExemplarMaxRunes
+}
@@ -0,0 +1,299 @@
+package exposer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+)
+
+// Registry contains registered metrics and sinks subscribed to their observations
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*Metric
+	order   []*Desc
+
+	// sinks contains []Sink, it is replaced on subscription, so observations don't need locking
+	sinks atomic.Value
+}
+
+// NewRegistry creates new empty registry
+func NewRegistry() *Registry {
+	r := &Registry{metrics: make(map[string]*Metric)}
+	r.sinks.Store([]Sink{})
+
+	return r
+}
+
+// Register registers metric and all subscribed sinks. Label values are passed to metric handles in order
+// of desc labels, dropped labels are removed from them and const labels are appended, so sinks receive descriptions
+// with exposed labels only.
+func (r *Registry) Register(desc Desc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if desc.Name == "" {
+		return fmt.Errorf("metric name is not specified")
+	}
+
+	if _, ok := r.metrics[desc.Name]; ok {
+		return fmt.Errorf("metric %q is already registered", desc.Name)
+	}
+
+	m, err := newMetric(desc, r)
+	if err != nil {
+		return err
+	}
+
+	for _, sink := range r.sinks.Load().([]Sink) {
+		if err := sink.Register(m.desc); err != nil {
+			return err
+		}
+	}
+
+	r.metrics[desc.Name] = m
+	r.order = append(r.order, m.desc)
+
+	return nil
+}
+
+// Subscribe adds sink, that receives observations of all metrics. Already registered metrics are registered in sink.
+func (r *Registry) Subscribe(sink Sink) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, desc := range r.order {
+		if err := sink.Register(desc); err != nil {
+			return err
+		}
+	}
+
+	sinks := r.sinks.Load().([]Sink)
+	r.sinks.Store(append(append([]Sink{}, sinks...), sink))
+
+	return nil
+}
+
+// Descs returns descriptions of all registered metrics in order of registration
+func (r *Registry) Descs() []*Desc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]*Desc{}, r.order...)
+}
+
+// Counter returns handle of registered counter
+func (r *Registry) Counter(name string) (*Counter, error) {
+	m, err := r.metric(name, CounterType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Counter{m}, nil
+}
+
+// Gauge returns handle of registered gauge
+func (r *Registry) Gauge(name string) (*Gauge, error) {
+	m, err := r.metric(name, GaugeType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Gauge{m}, nil
+}
+
+// Histogram returns handle of registered histogram
+func (r *Registry) Histogram(name string) (*Histogram, error) {
+	m, err := r.metric(name, HistogramType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Histogram{m}, nil
+}
+
+// metric returns handle of registered metric checking its type
+func (r *Registry) metric(name string, metricType MetricType) (*Metric, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		return nil, fmt.Errorf("metric %q is not registered", name)
+	}
+
+	if m.desc.Type != metricType {
+		return nil, fmt.Errorf("metric %q is %s, not %s", name, m.desc.Type, metricType)
+	}
+
+	return m, nil
+}
+
+// observe sends observation to all subscribed sinks, exemplar is passed only to sinks that support it
+func (r *Registry) observe(desc *Desc, labels []string, value float64, exemplar map[string]string) {
+	for _, sink := range r.sinks.Load().([]Sink) {
+		if exemplarSink, ok := sink.(ExemplarSink); ok && exemplar != nil {
+			exemplarSink.ObserveWithExemplar(desc, labels, value, exemplar)
+		} else {
+			sink.Observe(desc, labels, value)
+		}
+	}
+}
+
+// reset removes all series of metric from sinks that support it
+func (r *Registry) reset(desc *Desc) {
+	for _, sink := range r.sinks.Load().([]Sink) {
+		if resetSink, ok := sink.(ResetSink); ok {
+			resetSink.Reset(desc)
+		}
+	}
+}
+
+// Metric is a handle of registered metric
+type Metric struct {
+	// desc is a description with exposed labels, that is passed to sinks
+	desc     *Desc
+	registry *Registry
+
+	// labels are names of label values passed to handle, kept are indexes of values that are not dropped
+	labels      []string
+	kept        []int
+	constValues []string
+
+	// mismatchLogged is used to log only the first observation with wrong number of label values
+	mismatchLogged sync.Once
+}
+
+// newMetric checks labels of description and creates handle
+func newMetric(desc Desc, registry *Registry) (*Metric, error) {
+	seen := make(map[string]bool)
+	for _, label := range desc.Labels {
+		if seen[label] {
+			return nil, fmt.Errorf("label %q of metric %q is duplicated", label, desc.Name)
+		}
+		seen[label] = true
+	}
+
+	dropped := make(map[string]bool)
+	for _, label := range desc.DropLabels {
+		if !seen[label] {
+			return nil, fmt.Errorf("label %q of metric %q could not be dropped, because metric doesn't have it", label, desc.Name)
+		}
+		dropped[label] = true
+	}
+
+	m := &Metric{registry: registry, labels: desc.Labels}
+
+	exposed := make([]string, 0, len(desc.Labels)+len(desc.ConstLabels))
+	for i, label := range desc.Labels {
+		if !dropped[label] {
+			exposed = append(exposed, label)
+			m.kept = append(m.kept, i)
+		}
+	}
+
+	constNames := make([]string, 0, len(desc.ConstLabels))
+	for name := range desc.ConstLabels {
+		constNames = append(constNames, name)
+	}
+	sort.Strings(constNames)
+
+	for _, name := range constNames {
+		if seen[name] {
+			return nil, fmt.Errorf("const label %q of metric %q is duplicated", name, desc.Name)
+		}
+
+		exposed = append(exposed, name)
+		m.constValues = append(m.constValues, desc.ConstLabels[name])
+	}
+
+	desc.Labels = exposed
+	desc.DropLabels = nil
+	desc.ConstLabels = nil
+	m.desc = &desc
+
+	return m, nil
+}
+
+// Name returns name of metric
+func (m *Metric) Name() string {
+	return m.desc.Name
+}
+
+// Labels returns names of label values passed to handle
+func (m *Metric) Labels() []string {
+	return m.labels
+}
+
+// observe checks label values and sends observation with exposed label values to sinks. The observation with
+// wrong number of label values is dropped, because label names are checked on startup and it should never happen,
+// so it is logged once to not flood the log on every line.
+func (m *Metric) observe(labels []string, value float64, exemplar map[string]string) {
+	if len(labels) != len(m.labels) {
+		m.mismatchLogged.Do(func() {
+			logging.WithContext(context.Background()).Sugar().Errorf(
+				"metric %q has %d labels, but %d values are passed", m.desc.Name, len(m.labels), len(labels),
+			)
+		})
+
+		return
+	}
+
+	if len(m.kept) != len(labels) || len(m.constValues) > 0 {
+		exposed := make([]string, 0, len(m.desc.Labels))
+		for _, i := range m.kept {
+			exposed = append(exposed, labels[i])
+		}
+		labels = append(exposed, m.constValues...)
+	}
+
+	m.registry.observe(m.desc, labels, value, exemplar)
+}
+
+// Counter is a handle of registered counter
+type Counter struct {
+	*Metric
+}
+
+// Inc increments counter by 1
+func (c *Counter) Inc(labels ...string) {
+	c.observe(labels, 1, nil)
+}
+
+// Add increments counter by value
+func (c *Counter) Add(value float64, labels ...string) {
+	c.observe(labels, value, nil)
+}
+
+// Gauge is a handle of registered gauge
+type Gauge struct {
+	*Metric
+}
+
+// Set sets value of gauge
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.observe(labels, value, nil)
+}
+
+// Reset removes all series of gauge
+func (g *Gauge) Reset() {
+	g.registry.reset(g.desc)
+}
+
+// Histogram is a handle of registered histogram
+type Histogram struct {
+	*Metric
+}
+
+// Observe adds value to histogram
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.observe(labels, value, nil)
+}
+
+// ObserveWithExemplar adds value to histogram linking it to exemplar, nil exemplar is ignored
+func (h *Histogram) ObserveWithExemplar(value float64, exemplar map[string]string, labels ...string) {
+	h.observe(labels, value, exemplar)
+}
@@ -0,0 +1,466 @@
+package exposer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestExposer(t *testing.T) { TestingT(t) }
+
+type RegistrySuite struct{}
+
+var _ = Suite(&RegistrySuite{})
+
+// observation is an observation received by recordingSink
+type observation struct {
+	name   string
+	labels []string
+	value  float64
+}
+
+// recordingSink is a sink that records registered metrics and observations
+type recordingSink struct {
+	registered   []string
+	observations []observation
+}
+
+func (s *recordingSink) Register(desc *Desc) error {
+	s.registered = append(s.registered, desc.Name)
+
+	return nil
+}
+
+func (s *recordingSink) Observe(desc *Desc, labels []string, value float64) {
+	s.observations = append(s.observations, observation{name: desc.Name, labels: labels, value: value})
+}
+
+func (s RegistrySuite) TestRegister(c *C) {
+	testCases := []struct {
+		desc Desc
+		err  string
+	}{
+		{
+			desc: Desc{Name: "requests_total", Type: CounterType, Labels: []string{"host"}},
+		},
+		{
+			desc: Desc{Type: CounterType},
+			err:  `metric name is not specified`,
+		},
+		{
+			desc: Desc{Name: "requests_total", Type: GaugeType},
+			err:  `metric "requests_total" is already registered`,
+		},
+		{
+			desc: Desc{Name: "response_time_seconds", Type: HistogramType, Labels: []string{"host", "host"}},
+			err:  `label "host" of metric "response_time_seconds" is duplicated`,
+		},
+	}
+
+	registry := NewRegistry()
+	for _, tc := range testCases {
+		err := registry.Register(tc.desc)
+		if tc.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, tc.err)
+		}
+	}
+
+	c.Assert(registry.Descs(), HasLen, 1)
+}
+
+func (s RegistrySuite) TestHandles(c *C) {
+	registry := NewRegistry()
+	c.Assert(registry.Register(Desc{Name: "requests_total", Type: CounterType}), IsNil)
+	c.Assert(registry.Register(Desc{Name: "cached", Type: GaugeType}), IsNil)
+
+	_, err := registry.Counter("requests_total")
+	c.Assert(err, IsNil)
+
+	_, err = registry.Gauge("cached")
+	c.Assert(err, IsNil)
+
+	_, err = registry.Histogram("requests_total")
+	c.Assert(err, ErrorMatches, `metric "requests_total" is counter, not histogram`)
+
+	_, err = registry.Counter("unknown_total")
+	c.Assert(err, ErrorMatches, `metric "unknown_total" is not registered`)
+}
+
+func (s RegistrySuite) TestSubscribe(c *C) {
+	registry := NewRegistry()
+	c.Assert(registry.Register(Desc{Name: "requests_total", Type: CounterType, Labels: []string{"host"}}), IsNil)
+
+	first := &recordingSink{}
+	c.Assert(registry.Subscribe(first), IsNil)
+
+	c.Assert(registry.Register(Desc{Name: "response_time_seconds", Type: HistogramType}), IsNil)
+
+	second := &recordingSink{}
+	c.Assert(registry.Subscribe(second), IsNil)
+
+	// both sinks know all metrics regardless of subscription moment
+	c.Assert(first.registered, DeepEquals, []string{"requests_total", "response_time_seconds"})
+	c.Assert(second.registered, DeepEquals, []string{"requests_total", "response_time_seconds"})
+
+	counter, err := registry.Counter("requests_total")
+	c.Assert(err, IsNil)
+	histogram, err := registry.Histogram("response_time_seconds")
+	c.Assert(err, IsNil)
+
+	counter.Inc("localhost")
+	counter.Add(2, "localhost")
+	histogram.Observe(0.5)
+
+	// observation with wrong number of label values is dropped
+	counter.Inc()
+	counter.Inc("localhost", "extra")
+
+	expected := []observation{
+		{name: "requests_total", labels: []string{"localhost"}, value: 1},
+		{name: "requests_total", labels: []string{"localhost"}, value: 2},
+		{name: "response_time_seconds", value: 0.5},
+	}
+	for _, sink := range []*recordingSink{first, second} {
+		c.Assert(sink.observations, HasLen, len(expected))
+		for i, o := range sink.observations {
+			c.Assert(o.name, Equals, expected[i].name)
+			c.Assert(o.value, Equals, expected[i].value)
+			c.Assert(len(o.labels), Equals, len(expected[i].labels))
+		}
+	}
+}
+
+func (s RegistrySuite) TestDropAndConstLabels(c *C) {
+	registry := NewRegistry()
+	sink := &recordingSink{}
+	c.Assert(registry.Subscribe(sink), IsNil)
+
+	c.Assert(registry.Register(Desc{
+		Name:        "requests_total",
+		Type:        CounterType,
+		Labels:      []string{"host", "code", "user_agent"},
+		DropLabels:  []string{"code"},
+		ConstLabels: map[string]string{"dc": "eu", "cluster": "main"},
+	}), IsNil)
+
+	// sinks receive exposed labels, const labels are sorted by name
+	c.Assert(registry.Descs()[0].Labels, DeepEquals, []string{"host", "user_agent", "cluster", "dc"})
+
+	counter, err := registry.Counter("requests_total")
+	c.Assert(err, IsNil)
+	c.Assert(counter.Labels(), DeepEquals, []string{"host", "code", "user_agent"})
+
+	counter.Inc("localhost", "200", "Chrome")
+	c.Assert(sink.observations, HasLen, 1)
+	c.Assert(sink.observations[0].labels, DeepEquals, []string{"localhost", "Chrome", "main", "eu"})
+
+	testCases := []struct {
+		desc Desc
+		err  string
+	}{
+		{
+			desc: Desc{Name: "cached", Type: GaugeType, Labels: []string{"host"}, DropLabels: []string{"code"}},
+			err:  `label "code" of metric "cached" could not be dropped, because metric doesn't have it`,
+		},
+		{
+			desc: Desc{Name: "cached", Type: GaugeType, Labels: []string{"host"}, ConstLabels: map[string]string{"host": "a"}},
+			err:  `const label "host" of metric "cached" is duplicated`,
+		},
+	}
+	for _, tc := range testCases {
+		c.Assert(registry.Register(tc.desc), ErrorMatches, tc.err)
+	}
+}
+
+func (s RegistrySuite) TestRegisterMetrics_Labels(c *C) {
+	promRegistry := prometheus.NewRegistry()
+
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(NewPromSink(promRegistry, "nginx")), IsNil)
+	c.Assert(RegisterMetrics(registry, MetricsOptions{
+		SourceLabels: []string{"team"},
+		ConstLabels:  map[string]string{"dc": "eu"},
+		DropLabels:   map[string][]string{UserAgentResponseTimeSecondsMetricName: {"code"}},
+	}), IsNil)
+
+	histogram, err := registry.Histogram(UserAgentResponseTimeSecondsMetricName)
+	c.Assert(err, IsNil)
+	c.Assert(histogram.Labels(), DeepEquals, []string{"host", "user_agent", "code", "team"})
+	histogram.Observe(0.2, "localhost", "Chrome", "200", "search")
+
+	// labels of sources are not appended to build info
+	gauge, err := registry.Gauge(BuildInfoName)
+	c.Assert(err, IsNil)
+	c.Assert(gauge.Labels(), DeepEquals, []string{"version", "revision", "branch"})
+	gauge.Set(1, "1.0", "abc", "master")
+
+	families, err := promRegistry.Gather()
+	c.Assert(err, IsNil)
+
+	labels := make(map[string][]string)
+	for _, family := range families {
+		for _, pair := range family.GetMetric()[0].GetLabel() {
+			labels[family.GetName()] = append(labels[family.GetName()], pair.GetName()+"="+pair.GetValue())
+		}
+	}
+	c.Assert(labels, DeepEquals, map[string][]string{
+		"nginx_" + UserAgentResponseTimeSecondsMetricName: {"dc=eu", "host=localhost", "team=search", "user_agent=Chrome"},
+		"nginx_" + BuildInfoName:                          {"branch=master", "dc=eu", "revision=abc", "version=1.0"},
+	})
+
+	err = RegisterMetrics(NewRegistry(), MetricsOptions{DropLabels: map[string][]string{"unknown_total": {"host"}}})
+	c.Assert(err, ErrorMatches, `labels could not be dropped from unknown metric "unknown_total"`)
+}
+
+func (s RegistrySuite) TestRegisterMetrics_CustomMetrics(c *C) {
+	registry := NewRegistry()
+	c.Assert(RegisterMetrics(registry, MetricsOptions{
+		SourceLabels: []string{"team"},
+		DropLabels:   map[string][]string{"upstream_time_seconds": {"team"}},
+		CustomMetrics: []Desc{
+			{Name: "upstream_time_seconds", Help: "Upstream time", Type: HistogramType, Labels: []string{"upstream"}},
+			{Name: "api_requests_total", Help: "API requests", Type: CounterType, Labels: []string{"version"}},
+		},
+	}), IsNil)
+
+	// histograms without buckets have default ones, labels of sources are appended to custom metrics
+	histogram, err := registry.Histogram("upstream_time_seconds")
+	c.Assert(err, IsNil)
+	c.Assert(histogram.Labels(), DeepEquals, []string{"upstream", "team"})
+	descs := registry.Descs()
+	c.Assert(descs[len(descs)-2].Buckets, DeepEquals, defaultBuckets)
+	c.Assert(descs[len(descs)-2].Labels, DeepEquals, []string{"upstream"})
+
+	counter, err := registry.Counter("api_requests_total")
+	c.Assert(err, IsNil)
+	c.Assert(counter.Labels(), DeepEquals, []string{"version", "team"})
+
+	// custom metric could not replace metric of exporter
+	err = RegisterMetrics(NewRegistry(), MetricsOptions{CustomMetrics: []Desc{{Name: LogsTotal, Type: CounterType}}})
+	c.Assert(err, ErrorMatches, `metric "logs_total" is already registered`)
+}
+
+func (s RegistrySuite) TestGaugeReset(c *C) {
+	promRegistry := prometheus.NewRegistry()
+	influxSink, err := NewInfluxSink("http://127.0.0.1:8086/write", "", 1432, time.Second)
+	c.Assert(err, IsNil)
+
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(NewPromSink(promRegistry, "")), IsNil)
+	c.Assert(registry.Subscribe(influxSink), IsNil)
+	c.Assert(registry.Register(Desc{Name: "top", Help: "Top", Type: GaugeType, Labels: []string{"value"}}), IsNil)
+	c.Assert(registry.Register(Desc{Name: "other", Help: "Other", Type: GaugeType, Labels: []string{"value"}}), IsNil)
+
+	gauge, err := registry.Gauge("top")
+	c.Assert(err, IsNil)
+	other, err := registry.Gauge("other")
+	c.Assert(err, IsNil)
+
+	gauge.Set(1, "a")
+	gauge.Set(2, "b")
+	other.Set(3, "c")
+
+	// only series of reset metric are removed
+	gauge.Reset()
+	gauge.Set(4, "d")
+
+	families, err := promRegistry.Gather()
+	c.Assert(err, IsNil)
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			series[family.GetName()+"{"+metric.GetLabel()[0].GetValue()+"}"] = metric.GetGauge().GetValue()
+		}
+	}
+	c.Assert(series, DeepEquals, map[string]float64{"accesslog_top{d}": 4, "accesslog_other{c}": 3})
+
+	aggregated := make(map[string]float64)
+	for _, agg := range influxSink.snapshot() {
+		aggregated[agg.desc.Name+"{"+agg.labels[0]+"}"] = agg.value
+	}
+	c.Assert(aggregated, DeepEquals, map[string]float64{"top{d}": 4, "other{c}": 3})
+}
+
+func (s RegistrySuite) TestPromSink(c *C) {
+	promRegistry := prometheus.NewRegistry()
+
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(NewPromSink(promRegistry, "")), IsNil)
+	c.Assert(RegisterMetrics(registry, MetricsOptions{ExtraLabels: map[string][]string{
+		HostResponseTimeSecondsMetricName: {"client_class"},
+	}}), IsNil)
+
+	// metric with the same name can't be registered in Prometheus twice
+	c.Assert(NewPromSink(promRegistry, "").Register(registry.Descs()[0]), NotNil)
+
+	histogram, err := registry.Histogram(HostResponseTimeSecondsMetricName)
+	c.Assert(err, IsNil)
+	c.Assert(histogram.Labels(), DeepEquals, []string{"host", "code", "client_class"})
+	histogram.Observe(0.2, "localhost", "200", "human")
+
+	counter, err := registry.Counter(LogsTotal)
+	c.Assert(err, IsNil)
+	counter.Add(3, "localhost")
+
+	families, err := promRegistry.Gather()
+	c.Assert(err, IsNil)
+
+	found := make(map[string]bool)
+	for _, family := range families {
+		switch family.GetName() {
+		case "accesslog_" + HostResponseTimeSecondsMetricName:
+			c.Assert(family.GetMetric(), HasLen, 1)
+			c.Assert(family.GetMetric()[0].GetHistogram().GetSampleCount(), Equals, uint64(1))
+			c.Assert(family.GetMetric()[0].GetLabel(), HasLen, 3)
+			found[family.GetName()] = true
+		case "accesslog_" + LogsTotal:
+			c.Assert(family.GetMetric(), HasLen, 1)
+			c.Assert(family.GetMetric()[0].GetCounter().GetValue(), Equals, float64(3))
+			found[family.GetName()] = true
+		}
+	}
+	c.Assert(found, HasLen, 2)
+}
+
+func (s RegistrySuite) TestRegisterMetrics_Histograms(c *C) {
+	promRegistry := prometheus.NewRegistry()
+
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(NewPromSink(promRegistry, "")), IsNil)
+	c.Assert(RegisterMetrics(registry, MetricsOptions{Histograms: map[string]HistogramOpts{
+		HostResponseTimeSecondsMetricName: {
+			NativeHistogram: &NativeHistogramOpts{BucketFactor: 1.1, MaxBuckets: 160, MinResetDuration: time.Hour},
+		},
+		UserAgentResponseTimeSecondsMetricName: {
+			Summary: &SummaryOpts{Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001}, MaxAge: time.Minute, AgeBuckets: 5},
+		},
+		URIResponseTimeSecondsMetricName: {
+			Buckets: []float64{0.1, 1},
+		},
+	}}), IsNil)
+
+	for _, name := range []string{
+		HostResponseTimeSecondsMetricName, UserAgentResponseTimeSecondsMetricName, URIResponseTimeSecondsMetricName,
+	} {
+		histogram, err := registry.Histogram(name)
+		c.Assert(err, IsNil)
+		histogram.Observe(0.2, make([]string, len(histogram.Labels()))...)
+	}
+
+	families, err := promRegistry.Gather()
+	c.Assert(err, IsNil)
+
+	found := make(map[string]bool)
+	for _, family := range families {
+		switch family.GetName() {
+		case "accesslog_" + HostResponseTimeSecondsMetricName:
+			// native histogram has exponential buckets only
+			histogram := family.GetMetric()[0].GetHistogram()
+			c.Assert(family.GetType(), Equals, dto.MetricType_HISTOGRAM)
+			c.Assert(histogram.GetBucket(), HasLen, 0)
+			c.Assert(histogram.GetSchema(), Equals, int32(3))
+			c.Assert(histogram.GetPositiveSpan(), HasLen, 1)
+			found[family.GetName()] = true
+		case "accesslog_" + UserAgentResponseTimeSecondsMetricName:
+			c.Assert(family.GetType(), Equals, dto.MetricType_SUMMARY)
+			c.Assert(family.GetMetric()[0].GetSummary().GetQuantile(), HasLen, 2)
+			found[family.GetName()] = true
+		case "accesslog_" + URIResponseTimeSecondsMetricName:
+			c.Assert(family.GetMetric()[0].GetHistogram().GetBucket(), HasLen, 2)
+			found[family.GetName()] = true
+		}
+	}
+	c.Assert(found, HasLen, 3)
+
+	// native histograms are exposed only with protobuf format
+	handler := promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	c.Assert(resp.Header().Get("Content-Type"), Matches, "application/vnd.google.protobuf.*")
+}
+
+func (s RegistrySuite) TestRegisterMetrics_HistogramsErrors(c *C) {
+	testCases := []struct {
+		histograms map[string]HistogramOpts
+		err        string
+	}{
+		{
+			histograms: map[string]HistogramOpts{UserAgentRequestsTotalMetricName: {Buckets: []float64{1}}},
+			err:        `metric "user_agent_requests_total" is not a response time histogram`,
+		},
+		{
+			histograms: map[string]HistogramOpts{LogsTotal: {Buckets: []float64{1}}},
+			err:        `metric "logs_total" is not a response time histogram`,
+		},
+		{
+			histograms: map[string]HistogramOpts{HostResponseTimeSecondsMetricName: {
+				NativeHistogram: &NativeHistogramOpts{BucketFactor: 1.1},
+				Summary:         &SummaryOpts{},
+			}},
+			err: `metric "host_response_time_seconds" could not be both native histogram and summary`,
+		},
+	}
+
+	for _, tc := range testCases {
+		err := RegisterMetrics(NewRegistry(), MetricsOptions{Histograms: tc.histograms})
+		c.Assert(err, ErrorMatches, tc.err)
+	}
+}
+
+func (s RegistrySuite) TestObserveWithExemplar(c *C) {
+	promRegistry := prometheus.NewRegistry()
+
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(NewPromSink(promRegistry, "")), IsNil)
+
+	// sink without exemplars support receives plain observations
+	recording := &recordingSink{}
+	c.Assert(registry.Subscribe(recording), IsNil)
+
+	c.Assert(registry.Register(Desc{
+		Name: "response_time_seconds", Type: HistogramType, Labels: []string{"host"}, Buckets: []float64{0.1, 1},
+	}), IsNil)
+
+	histogram, err := registry.Histogram("response_time_seconds")
+	c.Assert(err, IsNil)
+
+	histogram.ObserveWithExemplar(0.05, map[string]string{"trace_id": "abc"}, "localhost")
+	histogram.ObserveWithExemplar(0.5, nil, "localhost")
+	// too long exemplar is dropped, but the value is observed
+	histogram.ObserveWithExemplar(0.7, map[string]string{"trace_id": strings.Repeat("a", 200)}, "localhost")
+
+	c.Assert(recording.observations, HasLen, 3)
+
+	families, err := promRegistry.Gather()
+	c.Assert(err, IsNil)
+	c.Assert(families, HasLen, 1)
+
+	buckets := families[0].GetMetric()[0].GetHistogram().GetBucket()
+	c.Assert(buckets, HasLen, 2)
+	c.Assert(buckets[0].GetExemplar(), NotNil)
+	c.Assert(buckets[0].GetExemplar().GetValue(), Equals, 0.05)
+	c.Assert(buckets[0].GetExemplar().GetLabel()[0].GetValue(), Equals, "abc")
+	c.Assert(buckets[1].GetExemplar(), IsNil)
+	c.Assert(buckets[1].GetCumulativeCount(), Equals, uint64(3))
+
+	// exemplars are exposed with OpenMetrics format
+	handler := promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	c.Assert(resp.Body.String(), Matches, `(?s).*accesslog_response_time_seconds_bucket\{host="localhost",le="0.1"\} 1 # \{trace_id="abc"\} 0.05.*`)
+}
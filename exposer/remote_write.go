@@ -0,0 +1,371 @@
+package exposer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const remoteWriteUserAgent = "accesslog-exporter"
+
+// RemoteWriteOptions contains settings of remote write client
+type RemoteWriteOptions struct {
+	URL            string
+	ExternalLabels map[string]string
+	Username       string
+	Password       string
+	BearerToken    string
+	Timeout        time.Duration
+	MaxRetries     int
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	// BufferSize is a max number of requests waiting to be sent, the oldest request is dropped on overflow
+	BufferSize int
+}
+
+// RemoteWriter periodically gathers metrics and pushes them using Prometheus remote write protocol
+type RemoteWriter struct {
+	opts     RemoteWriteOptions
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	// sendMu serializes sending of buffered requests, mu guards buffer only, so it is not held while sending
+	sendMu  sync.Mutex
+	mu      sync.Mutex
+	pending [][]byte
+}
+
+// remoteWriteError is an error of sending request, recoverable errors are retried
+type remoteWriteError struct {
+	err         error
+	recoverable bool
+}
+
+// Error returns error message
+func (e *remoteWriteError) Error() string {
+	return e.err.Error()
+}
+
+// NewRemoteWriter creates remote writer that pushes metrics of gatherer
+func NewRemoteWriter(gatherer prometheus.Gatherer, opts RemoteWriteOptions) *RemoteWriter {
+	return &RemoteWriter{
+		opts:     opts,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+// Run pushes metrics every interval until context is done
+func (w *RemoteWriter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Push(ctx); err != nil {
+				logging.WithContext(ctx).Sugar().Warnf("could not push metrics: %s", err)
+			}
+		}
+	}
+}
+
+// Push gathers metrics, adds them to buffer and sends all buffered requests. Requests that could not be sent
+// because of recoverable error are kept in buffer until the next push.
+func (w *RemoteWriter) Push(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	req := &prompb.WriteRequest{Timeseries: w.makeTimeSeries(families, time.Now())}
+	raw, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+
+	w.enqueue(snappy.Encode(nil, raw))
+
+	return w.flush(ctx)
+}
+
+// Pending returns number of requests waiting to be sent
+func (w *RemoteWriter) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.pending)
+}
+
+// enqueue adds request to buffer dropping the oldest one on overflow
+func (w *RemoteWriter) enqueue(req []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) >= w.opts.BufferSize {
+		logging.WithContext(context.Background()).Sugar().Warnf("remote write buffer is full, the oldest request is dropped")
+		w.pending = w.pending[1:]
+	}
+
+	w.pending = append(w.pending, req)
+}
+
+// flush sends buffered requests in order. The request is removed from buffer after sending, if it was not dropped
+// on overflow meanwhile.
+func (w *RemoteWriter) flush(ctx context.Context) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	for {
+		req := w.head()
+		if req == nil {
+			return nil
+		}
+
+		err := w.sendWithRetries(ctx, req)
+		if err, ok := err.(*remoteWriteError); ok && err.recoverable {
+			return err
+		}
+
+		w.remove(req)
+
+		if err != nil {
+			logging.WithContext(ctx).Sugar().Warnf("remote write request is dropped: %s", err)
+		}
+	}
+}
+
+// head returns the oldest buffered request, nil is returned if buffer is empty
+func (w *RemoteWriter) head() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	return w.pending[0]
+}
+
+// remove removes request from the head of buffer, if it is still there
+func (w *RemoteWriter) remove(req []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) > 0 && &w.pending[0][0] == &req[0] {
+		w.pending = w.pending[1:]
+	}
+}
+
+// sendWithRetries sends request retrying recoverable errors with exponential backoff
+func (w *RemoteWriter) sendWithRetries(ctx context.Context, req []byte) error {
+	backoff := w.opts.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := w.send(ctx, req)
+		if err == nil {
+			return nil
+		}
+		if !err.recoverable || attempt >= w.opts.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &remoteWriteError{err: ctx.Err(), recoverable: true}
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > w.opts.MaxBackoff {
+			backoff = w.opts.MaxBackoff
+		}
+	}
+}
+
+// send sends request once
+func (w *RemoteWriter) send(ctx context.Context, req []byte) *remoteWriteError {
+	httpReq, err := http.NewRequest(http.MethodPost, w.opts.URL, bytes.NewReader(req))
+	if err != nil {
+		return &remoteWriteError{err: err}
+	}
+	httpReq = httpReq.WithContext(ctx)
+
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", remoteWriteUserAgent)
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if w.opts.Username != "" {
+		httpReq.SetBasicAuth(w.opts.Username, w.opts.Password)
+	} else if w.opts.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+w.opts.BearerToken)
+	}
+
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return &remoteWriteError{err: err, recoverable: true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+
+	// server errors and rate limiting are retried, other client errors are not
+	return &remoteWriteError{
+		err:         err,
+		recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+// makeTimeSeries converts gathered metric families into time series with external labels
+func (w *RemoteWriter) makeTimeSeries(families []*dto.MetricFamily, now time.Time) []prompb.TimeSeries {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	var series []prompb.TimeSeries
+	makeLabels := func(name string, metric *dto.Metric, extra ...prompb.Label) []prompb.Label {
+		labels := make([]prompb.Label, 0, len(metric.GetLabel())+len(extra)+len(w.opts.ExternalLabels)+1)
+		labels = append(labels, prompb.Label{Name: "__name__", Value: name})
+
+		seen := make(map[string]bool)
+		for _, l := range metric.GetLabel() {
+			labels = append(labels, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+			seen[l.GetName()] = true
+		}
+		for _, l := range extra {
+			labels = append(labels, l)
+			seen[l.Name] = true
+		}
+
+		// external labels don't override labels of series
+		for name, value := range w.opts.ExternalLabels {
+			if !seen[name] {
+				labels = append(labels, prompb.Label{Name: name, Value: value})
+			}
+		}
+
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		return labels
+	}
+	add := func(name string, metric *dto.Metric, value float64, extra ...prompb.Label) {
+		series = append(series, prompb.TimeSeries{
+			Labels:  makeLabels(name, metric, extra...),
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		})
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				if histogram.Schema != nil {
+					series = append(series, prompb.TimeSeries{
+						Labels:     makeLabels(name, metric),
+						Histograms: []prompb.Histogram{nativeHistogram(histogram, timestamp)},
+					})
+				}
+
+				// classic buckets are sent only if they are kept with native histogram
+				if isNativeHistogram(histogram) {
+					break
+				}
+
+				hasInf := false
+				for _, bucket := range histogram.GetBucket() {
+					if math.IsInf(bucket.GetUpperBound(), +1) {
+						hasInf = true
+					}
+					add(name+"_bucket", metric, float64(bucket.GetCumulativeCount()),
+						prompb.Label{Name: "le", Value: formatFloat(bucket.GetUpperBound())})
+				}
+				if !hasInf {
+					add(name+"_bucket", metric, float64(histogram.GetSampleCount()), prompb.Label{Name: "le", Value: "+Inf"})
+				}
+				add(name+"_sum", metric, histogram.GetSampleSum())
+				add(name+"_count", metric, float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add(name, metric, quantile.GetValue(), prompb.Label{Name: "quantile", Value: formatFloat(quantile.GetQuantile())})
+				}
+				add(name+"_sum", metric, summary.GetSampleSum())
+				add(name+"_count", metric, float64(summary.GetSampleCount()))
+			}
+		}
+	}
+
+	return series
+}
+
+// nativeHistogram converts native histogram into remote write histogram, spans and delta encoded counts
+// are the same in both formats
+func nativeHistogram(histogram *dto.Histogram, timestamp int64) prompb.Histogram {
+	return prompb.Histogram{
+		Count:          &prompb.Histogram_CountInt{CountInt: histogram.GetSampleCount()},
+		Sum:            histogram.GetSampleSum(),
+		Schema:         histogram.GetSchema(),
+		ZeroThreshold:  histogram.GetZeroThreshold(),
+		ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: histogram.GetZeroCount()},
+		NegativeSpans:  bucketSpans(histogram.GetNegativeSpan()),
+		NegativeDeltas: histogram.GetNegativeDelta(),
+		PositiveSpans:  bucketSpans(histogram.GetPositiveSpan()),
+		PositiveDeltas: histogram.GetPositiveDelta(),
+		Timestamp:      timestamp,
+	}
+}
+
+// bucketSpans converts spans of native histogram buckets
+func bucketSpans(spans []*dto.BucketSpan) []prompb.BucketSpan {
+	res := make([]prompb.BucketSpan, 0, len(spans))
+	for _, span := range spans {
+		res = append(res, prompb.BucketSpan{Offset: span.GetOffset(), Length: span.GetLength()})
+	}
+
+	return res
+}
+
+// formatFloat formats float the same way as Prometheus does for le and quantile labels
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,294 @@
+package exposer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+
+	. "gopkg.in/check.v1"
+)
+
+type RemoteWriteSuite struct{}
+
+var _ = Suite(&RemoteWriteSuite{})
+
+// remoteWriteReceiver is a test server that receives remote write requests
+type remoteWriteReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	series   [][]prompb.TimeSeries
+}
+
+// ServeHTTP decodes request and responds with the next status, 204 is used when statuses are over
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+
+	if status == http.StatusNoContent {
+		body, _ := ioutil.ReadAll(req.Body)
+		raw, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		var writeReq prompb.WriteRequest
+		if err := writeReq.Unmarshal(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		r.requests = append(r.requests, req)
+		r.series = append(r.series, writeReq.Timeseries)
+	}
+
+	w.WriteHeader(status)
+}
+
+// received returns decoded series of received requests
+func (r *remoteWriteReceiver) received() [][]prompb.TimeSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.series
+}
+
+// newRemoteWriteRegistry creates Prometheus registry with a counter and a histogram
+func newRemoteWriteRegistry(c *C) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"host"})
+	c.Assert(registry.Register(counter), IsNil)
+	counter.WithLabelValues("localhost").Add(3)
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "response_time_seconds", Buckets: []float64{0.1, 1}})
+	c.Assert(registry.Register(histogram), IsNil)
+	histogram.Observe(0.5)
+
+	return registry
+}
+
+// newRemoteWriteOptions creates options with fast retries
+func newRemoteWriteOptions(url string) RemoteWriteOptions {
+	return RemoteWriteOptions{
+		URL:        url,
+		Timeout:    time.Second,
+		MaxRetries: 2,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+		BufferSize: 2,
+	}
+}
+
+func (s RemoteWriteSuite) TestPush(c *C) {
+	receiver := &remoteWriteReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	opts := newRemoteWriteOptions(server.URL)
+	opts.ExternalLabels = map[string]string{"dc": "dc1", "host": "external"}
+	opts.Username = "user"
+	opts.Password = "secret"
+
+	writer := NewRemoteWriter(newRemoteWriteRegistry(c), opts)
+	c.Assert(writer.Push(context.Background()), IsNil)
+	c.Assert(writer.Pending(), Equals, 0)
+
+	received := receiver.received()
+	c.Assert(received, HasLen, 1)
+
+	req := receiver.requests[0]
+	c.Assert(req.Header.Get("Content-Encoding"), Equals, "snappy")
+	c.Assert(req.Header.Get("Content-Type"), Equals, "application/x-protobuf")
+	c.Assert(req.Header.Get("X-Prometheus-Remote-Write-Version"), Equals, "0.1.0")
+	username, password, ok := req.BasicAuth()
+	c.Assert(ok, Equals, true)
+	c.Assert(username, Equals, "user")
+	c.Assert(password, Equals, "secret")
+
+	expected := []struct {
+		labels []prompb.Label
+		value  float64
+	}{
+		{
+			// external label doesn't override label of series
+			labels: []prompb.Label{{Name: "__name__", Value: "requests_total"}, {Name: "dc", Value: "dc1"}, {Name: "host", Value: "localhost"}},
+			value:  3,
+		},
+		{
+			labels: []prompb.Label{{Name: "__name__", Value: "response_time_seconds_bucket"}, {Name: "dc", Value: "dc1"}, {Name: "host", Value: "external"}, {Name: "le", Value: "0.1"}},
+			value:  0,
+		},
+		{
+			labels: []prompb.Label{{Name: "__name__", Value: "response_time_seconds_bucket"}, {Name: "dc", Value: "dc1"}, {Name: "host", Value: "external"}, {Name: "le", Value: "1"}},
+			value:  1,
+		},
+		{
+			labels: []prompb.Label{{Name: "__name__", Value: "response_time_seconds_bucket"}, {Name: "dc", Value: "dc1"}, {Name: "host", Value: "external"}, {Name: "le", Value: "+Inf"}},
+			value:  1,
+		},
+		{
+			labels: []prompb.Label{{Name: "__name__", Value: "response_time_seconds_sum"}, {Name: "dc", Value: "dc1"}, {Name: "host", Value: "external"}},
+			value:  0.5,
+		},
+		{
+			labels: []prompb.Label{{Name: "__name__", Value: "response_time_seconds_count"}, {Name: "dc", Value: "dc1"}, {Name: "host", Value: "external"}},
+			value:  1,
+		},
+	}
+
+	c.Assert(received[0], HasLen, len(expected))
+	for i, ts := range received[0] {
+		c.Assert(ts.Labels, DeepEquals, expected[i].labels)
+		c.Assert(ts.Samples, HasLen, 1)
+		c.Assert(ts.Samples[0].Value, Equals, expected[i].value)
+		c.Assert(ts.Samples[0].Timestamp > 0, Equals, true)
+	}
+}
+
+func (s RemoteWriteSuite) TestPush_BearerToken(c *C) {
+	receiver := &remoteWriteReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	opts := newRemoteWriteOptions(server.URL)
+	opts.BearerToken = "token"
+
+	c.Assert(NewRemoteWriter(newRemoteWriteRegistry(c), opts).Push(context.Background()), IsNil)
+	c.Assert(receiver.requests, HasLen, 1)
+	c.Assert(receiver.requests[0].Header.Get("Authorization"), Equals, "Bearer token")
+}
+
+func (s RemoteWriteSuite) TestPush_Retries(c *C) {
+	// two failures are retried, the request is sent with the third attempt
+	receiver := &remoteWriteReceiver{statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	writer := NewRemoteWriter(newRemoteWriteRegistry(c), newRemoteWriteOptions(server.URL))
+	c.Assert(writer.Push(context.Background()), IsNil)
+	c.Assert(receiver.received(), HasLen, 1)
+	c.Assert(writer.Pending(), Equals, 0)
+}
+
+func (s RemoteWriteSuite) TestPush_Buffer(c *C) {
+	// all retries of three pushes fail
+	statuses := make([]int, 9)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+
+	receiver := &remoteWriteReceiver{statuses: statuses}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	writer := NewRemoteWriter(newRemoteWriteRegistry(c), newRemoteWriteOptions(server.URL))
+	for i := 0; i < 3; i++ {
+		c.Assert(writer.Push(context.Background()), ErrorMatches, "server returned HTTP status 503.*")
+	}
+
+	// the oldest request is dropped on overflow
+	c.Assert(writer.Pending(), Equals, 2)
+	c.Assert(receiver.received(), HasLen, 0)
+
+	// buffered requests are sent with the next push
+	c.Assert(writer.Push(context.Background()), IsNil)
+	c.Assert(writer.Pending(), Equals, 0)
+	c.Assert(receiver.received(), HasLen, 2)
+}
+
+func (s RemoteWriteSuite) TestPush_NotRecoverable(c *C) {
+	receiver := &remoteWriteReceiver{statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	writer := NewRemoteWriter(newRemoteWriteRegistry(c), newRemoteWriteOptions(server.URL))
+
+	// the request rejected by server is dropped without retries
+	c.Assert(writer.Push(context.Background()), IsNil)
+	c.Assert(writer.Pending(), Equals, 0)
+	c.Assert(receiver.received(), HasLen, 0)
+
+	c.Assert(writer.Push(context.Background()), IsNil)
+	c.Assert(receiver.received(), HasLen, 1)
+}
+
+func (s RemoteWriteSuite) TestPush_NotBlocking(c *C) {
+	received, release := make(chan struct{}, 2), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer := NewRemoteWriter(newRemoteWriteRegistry(c), newRemoteWriteOptions(server.URL))
+
+	done := make(chan error)
+	go func() { done <- writer.Push(context.Background()) }()
+
+	// buffer is available while request is being sent
+	<-received
+	c.Assert(writer.Pending(), Equals, 1)
+	writer.enqueue([]byte("request"))
+	c.Assert(writer.Pending(), Equals, 2)
+
+	close(release)
+	c.Assert(<-done, IsNil)
+	c.Assert(writer.Pending(), Equals, 0)
+}
+
+func (s RemoteWriteSuite) TestPush_NativeHistogram(c *C) {
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        "response_time_seconds",
+		NativeHistogramBucketFactor: 2,
+	})
+	c.Assert(registry.Register(histogram), IsNil)
+	histogram.Observe(1)
+	histogram.Observe(3)
+	histogram.Observe(3)
+	histogram.Observe(0)
+
+	receiver := &remoteWriteReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	c.Assert(NewRemoteWriter(registry, newRemoteWriteOptions(server.URL)).Push(context.Background()), IsNil)
+
+	// native histogram is sent without classic buckets, sum and count
+	received := receiver.received()
+	c.Assert(received, HasLen, 1)
+	c.Assert(received[0], HasLen, 1)
+
+	ts := received[0][0]
+	c.Assert(ts.Labels, DeepEquals, []prompb.Label{{Name: "__name__", Value: "response_time_seconds"}})
+	c.Assert(ts.Samples, HasLen, 0)
+	c.Assert(ts.Histograms, HasLen, 1)
+
+	// buckets (0.5, 1] and (2, 4] with schema 0
+	h := ts.Histograms[0]
+	c.Assert(h.GetCountInt(), Equals, uint64(4))
+	c.Assert(h.Sum, Equals, float64(7))
+	c.Assert(h.Schema, Equals, int32(0))
+	c.Assert(h.GetZeroCountInt(), Equals, uint64(1))
+	c.Assert(h.PositiveSpans, DeepEquals, []prompb.BucketSpan{{Offset: 0, Length: 3}})
+	c.Assert(h.PositiveDeltas, DeepEquals, []int64{1, -1, 2})
+	c.Assert(h.NegativeSpans, HasLen, 0)
+	c.Assert(h.Timestamp > 0, Equals, true)
+}
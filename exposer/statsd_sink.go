@@ -0,0 +1,220 @@
+package exposer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+)
+
+var (
+	// statsDTagReplacer replaces characters that break StatsD line protocol in tag values
+	statsDTagReplacer = strings.NewReplacer("|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+	// statsDNameReplacer replaces characters that break StatsD line protocol or split metric name
+	statsDNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", " ", "_", ".", "_")
+)
+
+// StatsDSink is a sink that sends metrics to StatsD or DogStatsD. Counters are sent as counters, histograms are
+// sent as timers in milliseconds and gauges as gauges. Lines are batched into packets not larger than packet size.
+type StatsDSink struct {
+	conn        net.Conn
+	prefix      string
+	tags        bool
+	sampleRates map[string]float64
+	packetSize  int
+
+	// random returns value in [0, 1) to sample observations
+	random func() float64
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewStatsDSink creates sink that sends metrics to address udp://host:port or unix:///path/to/socket. When tags are
+// enabled, labels are sent as DogStatsD tags, otherwise label values are appended to metric name.
+func NewStatsDSink(address, prefix string, tags bool, sampleRates map[string]float64, packetSize int) (*StatsDSink, error) {
+	conn, err := dialStatsD(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" {
+		prefix = defaultNamespace
+	}
+
+	return &StatsDSink{
+		conn:        conn,
+		prefix:      prefix,
+		tags:        tags,
+		sampleRates: sampleRates,
+		packetSize:  packetSize,
+		random:      rand.Float64,
+		buf:         make([]byte, 0, packetSize),
+	}, nil
+}
+
+// Register checks that metric could be sent to StatsD
+func (s *StatsDSink) Register(desc *Desc) error {
+	switch desc.Type {
+	case CounterType, GaugeType, HistogramType:
+	default:
+		return fmt.Errorf("unsupported type of metric %q", desc.Name)
+	}
+
+	if rate, ok := s.sampleRates[desc.Name]; ok && desc.Type == GaugeType && rate < 1 {
+		return fmt.Errorf("gauge %q could not be sampled", desc.Name)
+	}
+
+	return nil
+}
+
+// Observe formats observation as StatsD line and adds it to the current packet
+func (s *StatsDSink) Observe(desc *Desc, labels []string, value float64) {
+	rate, sampled := s.sampleRates[desc.Name]
+	sampled = sampled && rate < 1
+	if sampled && s.random() >= rate {
+		return
+	}
+
+	line := make([]byte, 0, 128)
+	line = append(line, s.prefix...)
+	line = append(line, '.')
+	line = append(line, desc.Name...)
+	if !s.tags {
+		for _, label := range labels {
+			line = append(line, '.')
+			line = append(line, statsDSegment(label)...)
+		}
+	}
+	line = append(line, ':')
+
+	switch desc.Type {
+	case CounterType:
+		line = strconv.AppendFloat(line, value, 'f', -1, 64)
+		line = append(line, "|c"...)
+	case GaugeType:
+		line = strconv.AppendFloat(line, value, 'f', -1, 64)
+		line = append(line, "|g"...)
+	case HistogramType:
+		line = strconv.AppendFloat(line, value*1000, 'f', -1, 64)
+		line = append(line, "|ms"...)
+	default:
+		return
+	}
+
+	if sampled {
+		line = append(line, "|@"...)
+		line = strconv.AppendFloat(line, rate, 'f', -1, 64)
+	}
+
+	if s.tags && len(labels) > 0 {
+		line = append(line, "|#"...)
+		for i, label := range labels {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = append(line, desc.Labels[i]...)
+			line = append(line, ':')
+			line = append(line, statsDTagReplacer.Replace(label)...)
+		}
+	}
+
+	// full packet is sent without lock, so workers are not blocked by each other
+	var packet []byte
+
+	s.mu.Lock()
+	if len(s.buf) > 0 && len(s.buf)+1+len(line) > s.packetSize {
+		packet = s.swap()
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line...)
+	s.mu.Unlock()
+
+	s.send(packet)
+}
+
+// statsDSegment escapes label value to be used as metric name segment, empty value would produce empty segment
+func statsDSegment(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+
+	return statsDNameReplacer.Replace(value)
+}
+
+// Run sends collected lines every interval until context is done
+func (s *StatsDSink) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.Flush()
+
+			return
+		case <-ticker.C:
+			s.Flush()
+		}
+	}
+}
+
+// Flush sends collected lines
+func (s *StatsDSink) Flush() {
+	s.mu.Lock()
+	packet := s.swap()
+	s.mu.Unlock()
+
+	s.send(packet)
+}
+
+// Close sends collected lines and closes connection
+func (s *StatsDSink) Close() error {
+	s.Flush()
+
+	return s.conn.Close()
+}
+
+// swap replaces packet being collected with the new one and returns collected packet, it should be called under lock
+func (s *StatsDSink) swap() []byte {
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	packet := s.buf
+	s.buf = make([]byte, 0, s.packetSize)
+
+	return packet
+}
+
+// send sends packet, empty packet is skipped
+func (s *StatsDSink) send(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+
+	// StatsD is a fire-and-forget protocol, so the packet is lost on error
+	if _, err := s.conn.Write(packet); err != nil {
+		logging.WithContext(context.Background()).Sugar().Warnf("could not send metrics to statsd: %s", err)
+	}
+}
+
+// dialStatsD connects to address udp://host:port or unix:///path/to/socket
+func dialStatsD(address string) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(address, "udp://"):
+		return net.Dial("udp", strings.TrimPrefix(address, "udp://"))
+	case strings.HasPrefix(address, "unix://"):
+		return net.Dial("unixgram", strings.TrimPrefix(address, "unix://"))
+	}
+
+	return nil, fmt.Errorf("unsupported statsd address %q, udp://host:port or unix:///path is expected", address)
+}
@@ -0,0 +1,191 @@
+package exposer
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type StatsDSinkSuite struct{}
+
+var _ = Suite(&StatsDSinkSuite{})
+
+// listenStatsD starts local UDP listener
+func listenStatsD(c *C) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	return conn
+}
+
+// readPackets reads all packets received by listener until timeout
+func readPackets(c *C, conn net.PacketConn) []string {
+	var packets []string
+
+	buf := make([]byte, 65536)
+	for {
+		c.Assert(conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)), IsNil)
+
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+// newStatsDRegistry creates registry with sink subscribed and metrics of all types registered
+func newStatsDRegistry(c *C, sink Sink) *Registry {
+	registry := NewRegistry()
+	c.Assert(registry.Subscribe(sink), IsNil)
+	c.Assert(registry.Register(Desc{Name: "requests_total", Type: CounterType, Labels: []string{"host", "code"}}), IsNil)
+	c.Assert(registry.Register(Desc{Name: "cached", Type: GaugeType}), IsNil)
+	c.Assert(registry.Register(Desc{Name: "response_time_seconds", Type: HistogramType, Labels: []string{"host"}}), IsNil)
+
+	return registry
+}
+
+func (s StatsDSinkSuite) TestObserve(c *C) {
+	testCases := []struct {
+		tags     bool
+		expected []string
+	}{
+		{
+			tags: true,
+			expected: []string{
+				"accesslog.requests_total:1|c|#host:www.site.com,code:200",
+				"accesslog.requests_total:1|c|#host:,code:499",
+				"accesslog.cached:10|g",
+				"accesslog.response_time_seconds:250|ms|#host:www.site.com",
+			},
+		},
+		{
+			tags: false,
+			expected: []string{
+				"accesslog.requests_total.www_site_com.200:1|c",
+				"accesslog.requests_total.unknown.499:1|c",
+				"accesslog.cached:10|g",
+				"accesslog.response_time_seconds.www_site_com:250|ms",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		listener := listenStatsD(c)
+
+		sink, err := NewStatsDSink("udp://"+listener.LocalAddr().String(), "", tc.tags, nil, 1432)
+		c.Assert(err, IsNil)
+
+		registry := newStatsDRegistry(c, sink)
+
+		counter, err := registry.Counter("requests_total")
+		c.Assert(err, IsNil)
+		gauge, err := registry.Gauge("cached")
+		c.Assert(err, IsNil)
+		histogram, err := registry.Histogram("response_time_seconds")
+		c.Assert(err, IsNil)
+
+		counter.Inc("www.site.com", "200")
+		counter.Inc("", "499")
+		gauge.Set(10)
+		histogram.Observe(0.25, "www.site.com")
+
+		c.Assert(sink.Close(), IsNil)
+		c.Assert(readPackets(c, listener), DeepEquals, []string{strings.Join(tc.expected, "\n")})
+		c.Assert(listener.Close(), IsNil)
+	}
+}
+
+func (s StatsDSinkSuite) TestObserve_Batching(c *C) {
+	listener := listenStatsD(c)
+	defer listener.Close()
+
+	line := "app.requests_total:1|c|#host:localhost,code:200"
+
+	// two lines fit into packet, but three don't
+	sink, err := NewStatsDSink("udp://"+listener.LocalAddr().String(), "app", true, nil, 2*len(line)+2)
+	c.Assert(err, IsNil)
+
+	counter, err := newStatsDRegistry(c, sink).Counter("requests_total")
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 5; i++ {
+		counter.Inc("localhost", "200")
+	}
+	c.Assert(sink.Close(), IsNil)
+
+	c.Assert(readPackets(c, listener), DeepEquals, []string{
+		line + "\n" + line,
+		line + "\n" + line,
+		line,
+	})
+}
+
+func (s StatsDSinkSuite) TestObserve_SampleRates(c *C) {
+	listener := listenStatsD(c)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink("udp://"+listener.LocalAddr().String(), "", true, map[string]float64{
+		"requests_total": 0.5,
+	}, 1432)
+	c.Assert(err, IsNil)
+
+	randoms := []float64{0.1, 0.7, 0.4}
+	sink.random = func() float64 {
+		r := randoms[0]
+		randoms = randoms[1:]
+
+		return r
+	}
+
+	counter, err := newStatsDRegistry(c, sink).Counter("requests_total")
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		counter.Inc("localhost", "200")
+	}
+	c.Assert(sink.Close(), IsNil)
+
+	line := "accesslog.requests_total:1|c|@0.5|#host:localhost,code:200"
+	c.Assert(readPackets(c, listener), DeepEquals, []string{line + "\n" + line})
+}
+
+func (s StatsDSinkSuite) TestRegister_SampledGauge(c *C) {
+	listener := listenStatsD(c)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink("udp://"+listener.LocalAddr().String(), "", true, map[string]float64{
+		"cached": 0.1,
+	}, 1432)
+	c.Assert(err, IsNil)
+	defer sink.Close()
+
+	c.Assert(sink.Register(&Desc{Name: "cached", Type: GaugeType}), ErrorMatches, `gauge "cached" could not be sampled`)
+}
+
+func (s StatsDSinkSuite) TestUnixSocket(c *C) {
+	path := filepath.Join(c.MkDir(), "statsd.sock")
+
+	listener, err := net.ListenPacket("unixgram", path)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink("unix://"+path, "", true, nil, 1432)
+	c.Assert(err, IsNil)
+
+	gauge, err := newStatsDRegistry(c, sink).Gauge("cached")
+	c.Assert(err, IsNil)
+	gauge.Set(1)
+	c.Assert(sink.Close(), IsNil)
+
+	c.Assert(readPackets(c, listener), DeepEquals, []string{"accesslog.cached:1|g"})
+}
+
+func (s StatsDSinkSuite) TestNewStatsDSink_UnsupportedAddress(c *C) {
+	_, err := NewStatsDSink("tcp://127.0.0.1:8125", "", true, nil, 1432)
+	c.Assert(err, ErrorMatches, `unsupported statsd address "tcp://127.0.0.1:8125".*`)
+}
@@ -0,0 +1,297 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// node is a node of expression tree
+type node interface {
+	eval(vars map[string]string) (Value, error)
+}
+
+// literalNode is a number, string or bool literal
+type literalNode struct {
+	value Value
+}
+
+func (n *literalNode) eval(map[string]string) (Value, error) {
+	return n.value, nil
+}
+
+// variableNode is a variable of log line, missing variable is empty
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(vars map[string]string) (Value, error) {
+	return stringValue(vars[n.name]), nil
+}
+
+// unaryNode is a logical negation or numeric negation
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(vars map[string]string) (Value, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if n.op == "!" {
+		b, err := v.Bool()
+		if err != nil {
+			return Value{}, fmt.Errorf("operand of !: %s", err)
+		}
+
+		return boolValue(!b), nil
+	}
+
+	f, err := v.Float()
+	if err != nil {
+		return Value{}, fmt.Errorf("operand of -: %s", err)
+	}
+
+	return numberValue(-f), nil
+}
+
+// binaryNode is a logical, comparison or arithmetic operation
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(vars map[string]string) (Value, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+
+	// logical operations are short-circuit
+	if n.op == "&&" || n.op == "||" {
+		l, err := left.Bool()
+		if err != nil {
+			return Value{}, fmt.Errorf("left operand of %s: %s", n.op, err)
+		}
+		if l == (n.op == "||") {
+			return boolValue(l), nil
+		}
+
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return Value{}, err
+		}
+
+		r, err := right.Bool()
+		if err != nil {
+			return Value{}, fmt.Errorf("right operand of %s: %s", n.op, err)
+		}
+
+		return boolValue(r), nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch n.op {
+	case "==":
+		return boolValue(equal(left, right)), nil
+	case "!=":
+		return boolValue(!equal(left, right)), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return Value{}, fmt.Errorf("operands of %s: %s", n.op, err)
+		}
+
+		switch n.op {
+		case "<":
+			return boolValue(c < 0), nil
+		case "<=":
+			return boolValue(c <= 0), nil
+		case ">":
+			return boolValue(c > 0), nil
+		}
+
+		return boolValue(c >= 0), nil
+	}
+
+	l, err := left.Float()
+	if err != nil {
+		return Value{}, fmt.Errorf("left operand of %s: %s", n.op, err)
+	}
+	r, err := right.Float()
+	if err != nil {
+		return Value{}, fmt.Errorf("right operand of %s: %s", n.op, err)
+	}
+
+	switch n.op {
+	case "+":
+		return numberValue(l + r), nil
+	case "-":
+		return numberValue(l - r), nil
+	case "*":
+		return numberValue(l * r), nil
+	case "/":
+		if r == 0 {
+			return Value{}, fmt.Errorf("division by zero")
+		}
+
+		return numberValue(l / r), nil
+	}
+
+	if r == 0 {
+		return Value{}, fmt.Errorf("division by zero")
+	}
+
+	return numberValue(math.Mod(l, r)), nil
+}
+
+// equal compares values, numbers are compared with strings numerically and values of other kinds
+// are compared as strings
+func equal(left, right Value) bool {
+	if left.kind == NumberKind || right.kind == NumberKind {
+		l, lErr := left.Float()
+		r, rErr := right.Float()
+
+		return lErr == nil && rErr == nil && l == r
+	}
+
+	if left.kind == BoolKind && right.kind == BoolKind {
+		return left.b == right.b
+	}
+
+	return left.String() == right.String()
+}
+
+// compare returns sign of difference between values. Numbers and numeric strings are compared numerically,
+// other strings are compared lexicographically.
+func compare(left, right Value) (int, error) {
+	if left.kind == StringKind && right.kind == StringKind {
+		l, lErr := left.Float()
+		r, rErr := right.Float()
+		if lErr != nil || rErr != nil {
+			switch {
+			case left.str < right.str:
+				return -1, nil
+			case left.str > right.str:
+				return 1, nil
+			}
+
+			return 0, nil
+		}
+
+		return compareFloats(l, r), nil
+	}
+
+	l, err := left.Float()
+	if err != nil {
+		return 0, err
+	}
+	r, err := right.Float()
+	if err != nil {
+		return 0, err
+	}
+
+	return compareFloats(l, r), nil
+}
+
+// compareFloats returns sign of difference between numbers
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+
+	return 0
+}
+
+// ternaryNode is a conditional expression
+type ternaryNode struct {
+	cond, then, otherwise node
+}
+
+func (n *ternaryNode) eval(vars map[string]string) (Value, error) {
+	v, err := n.cond.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+
+	cond, err := v.Bool()
+	if err != nil {
+		return Value{}, fmt.Errorf("condition of ?: %s", err)
+	}
+
+	if cond {
+		return n.then.eval(vars)
+	}
+
+	return n.otherwise.eval(vars)
+}
+
+// indexNode is an indexing of list, negative index counts from the end, item out of range is empty
+type indexNode struct {
+	list, index node
+}
+
+func (n *indexNode) eval(vars map[string]string) (Value, error) {
+	list, err := n.list.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+	if list.kind != ListKind {
+		return Value{}, fmt.Errorf("%s could not be indexed", list.kind)
+	}
+
+	v, err := n.index.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+
+	f, err := v.Float()
+	if err != nil || f != math.Trunc(f) {
+		return Value{}, fmt.Errorf("index %s is not an integer", strconv.Quote(v.String()))
+	}
+
+	i := int(f)
+	if i < 0 {
+		i += len(list.list)
+	}
+	if i < 0 || i >= len(list.list) {
+		return stringValue(""), nil
+	}
+
+	return stringValue(list.list[i]), nil
+}
+
+// callNode is a call of function
+type callNode struct {
+	name string
+	call func(args []Value) (Value, error)
+	args []node
+}
+
+func (n *callNode) eval(vars map[string]string) (Value, error) {
+	args := make([]Value, 0, len(n.args))
+	for _, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return Value{}, err
+		}
+		args = append(args, v)
+	}
+
+	v, err := n.call(args)
+	if err != nil {
+		return Value{}, fmt.Errorf("%s: %s", n.name, err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,180 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind is a type of value
+type Kind int
+
+const (
+	// StringKind is a kind of variables and string literals
+	StringKind Kind = iota
+	// NumberKind is a kind of numbers, all numbers are float64
+	NumberKind
+	// BoolKind is a kind of comparisons and logical operations
+	BoolKind
+	// ListKind is a kind of list of strings returned by split
+	ListKind
+)
+
+// String returns name of kind
+func (k Kind) String() string {
+	switch k {
+	case StringKind:
+		return "string"
+	case NumberKind:
+		return "number"
+	case BoolKind:
+		return "bool"
+	case ListKind:
+		return "list"
+	}
+
+	return "unknown"
+}
+
+// Value is a result of evaluation
+type Value struct {
+	kind Kind
+	str  string
+	num  float64
+	b    bool
+	list []string
+}
+
+// stringValue creates string value
+func stringValue(s string) Value {
+	return Value{kind: StringKind, str: s}
+}
+
+// numberValue creates number value
+func numberValue(n float64) Value {
+	return Value{kind: NumberKind, num: n}
+}
+
+// boolValue creates bool value
+func boolValue(b bool) Value {
+	return Value{kind: BoolKind, b: b}
+}
+
+// listValue creates list value
+func listValue(list []string) Value {
+	return Value{kind: ListKind, list: list}
+}
+
+// Kind returns kind of value
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// String formats value as label value, list items are joined with comma
+func (v Value) String() string {
+	switch v.kind {
+	case NumberKind:
+		return strconv.FormatFloat(v.num, 'f', -1, 64)
+	case BoolKind:
+		return strconv.FormatBool(v.b)
+	case ListKind:
+		return strings.Join(v.list, ",")
+	}
+
+	return v.str
+}
+
+// Float converts value to number, strings are parsed
+func (v Value) Float() (float64, error) {
+	switch v.kind {
+	case NumberKind:
+		return v.num, nil
+	case StringKind:
+		// NaN and infinities are not numbers of log lines
+		n, err := strconv.ParseFloat(strings.TrimSpace(v.str), 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("%q is not a number", v.str)
+		}
+
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("%s could not be converted to number", v.kind)
+}
+
+// Bool returns value of bool
+func (v Value) Bool() (bool, error) {
+	if v.kind != BoolKind {
+		return false, fmt.Errorf("%s is used as bool", v.kind)
+	}
+
+	return v.b, nil
+}
+
+// Expression is a compiled expression over variables of log line. It has no access to anything except
+// variables, so its evaluation has no side effects and always terminates.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile parses expression, checks names and arguments of functions and compiles literal regexes and subnets
+func Compile(source string) (*Expression, error) {
+	root, err := parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile expression %q: %s", source, err)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// MustCompile compiles expression and panics on error
+func MustCompile(source string) *Expression {
+	e, err := Compile(source)
+	if err != nil {
+		panic(err)
+	}
+
+	return e
+}
+
+// String returns source of expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates expression, missing variables are empty strings
+func (e *Expression) Eval(vars map[string]string) (Value, error) {
+	return e.root.eval(vars)
+}
+
+// EvalString evaluates expression and formats result as string
+func (e *Expression) EvalString(vars map[string]string) (string, error) {
+	v, err := e.Eval(vars)
+	if err != nil {
+		return "", err
+	}
+
+	return v.String(), nil
+}
+
+// EvalBool evaluates expression, that should return bool
+func (e *Expression) EvalBool(vars map[string]string) (bool, error) {
+	v, err := e.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+
+	return v.Bool()
+}
+
+// EvalFloat evaluates expression and converts result to number
+func (e *Expression) EvalFloat(vars map[string]string) (float64, error) {
+	v, err := e.Eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	return v.Float()
+}
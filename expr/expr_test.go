@@ -0,0 +1,168 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestExpr(t *testing.T) { TestingT(t) }
+
+type ExprSuite struct{}
+
+var _ = Suite(&ExprSuite{})
+
+// vars are variables of log line used in tests
+var vars = map[string]string{
+	"$status":          "503",
+	"$request_time":    "1.250",
+	"$request_uri":     "/api/v2/users/42?debug=1",
+	"$remote_addr":     "10.1.2.3:5678",
+	"$http_user_agent": "Mozilla/5.0",
+	"$upstream_addr":   "-",
+	"$request_method":  "GET",
+}
+
+func (s ExprSuite) TestEval(c *C) {
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		// literals and arithmetic
+		{source: `1 + 2 * 3`, expected: "7"},
+		{source: `(1 + 2) * 3`, expected: "9"},
+		{source: `-2 - -3`, expected: "1"},
+		{source: `7 % 4`, expected: "3"},
+		{source: `1.5e3 / 3`, expected: "500"},
+		{source: `"1" + '2'`, expected: "3"},
+		{source: `'say \'hi\''`, expected: "say 'hi'"},
+		// variables are strings converted to numbers by arithmetic and comparisons
+		{source: `$request_time * 1000`, expected: "1250"},
+		{source: `$status >= 500`, expected: "true"},
+		{source: `$status == 503`, expected: "true"},
+		{source: `$status == "503"`, expected: "true"},
+		{source: `$request_time > 1`, expected: "true"},
+		{source: `$missing`, expected: ""},
+		// strings are compared numerically if both are numbers, otherwise lexicographically
+		{source: `$status < "1000"`, expected: "true"},
+		{source: `$request_method < "POST"`, expected: "true"},
+		// logical operations are short-circuit, so invalid right operand is not evaluated
+		{source: `$status >= 500 && $request_method == "GET"`, expected: "true"},
+		{source: `$status < 500 && int($upstream_addr) > 0`, expected: "false"},
+		{source: `$status >= 500 || int($upstream_addr) > 0`, expected: "true"},
+		{source: `!($status >= 500)`, expected: "false"},
+		// ternary
+		{source: `$status >= 500 ? "5xx" : $status >= 400 ? "4xx" : "other"`, expected: "5xx"},
+		{source: `str(int($status / 100)) + 0`, expected: "5"},
+		{source: `$request_time > 1 ? "slow" : "fast"`, expected: "slow"},
+		// functions
+		{source: `int($request_time)`, expected: "1"},
+		{source: `float("2.5") + 1`, expected: "3.5"},
+		{source: `lower("GeT") == "get"`, expected: "true"},
+		{source: `upper($request_method)`, expected: "GET"},
+		{source: `trim("  a ")`, expected: "a"},
+		{source: `split($request_uri, "/")[2]`, expected: "v2"},
+		{source: `split(split($request_uri, "?")[0], "/")[-1]`, expected: "42"},
+		{source: `split($request_uri, "/")[10]`, expected: ""},
+		{source: `len(split($request_uri, "/"))`, expected: "5"},
+		{source: `len($request_method)`, expected: "3"},
+		{source: `contains($http_user_agent, "Mozilla")`, expected: "true"},
+		{source: `starts_with($request_uri, "/api/")`, expected: "true"},
+		{source: `ends_with($request_uri, "debug=1")`, expected: "true"},
+		{source: `replace($request_uri, "/", ".")`, expected: ".api.v2.users.42?debug=1"},
+		{source: `coalesce($upstream_addr, $missing, "none")`, expected: "none"},
+		{source: `matches($request_uri, "^/api/v[0-9]+/")`, expected: "true"},
+		{source: `cidr_match($remote_addr, "192.168.0.0/16", "10.0.0.0/8")`, expected: "true"},
+		{source: `cidr_match($upstream_addr, "0.0.0.0/0")`, expected: "false"},
+	}
+
+	for _, tc := range testCases {
+		e, err := Compile(tc.source)
+		c.Assert(err, IsNil, Commentf("%s", tc.source))
+
+		v, err := e.EvalString(vars)
+		c.Assert(err, IsNil, Commentf("%s", tc.source))
+		c.Assert(v, Equals, tc.expected, Commentf("%s", tc.source))
+	}
+}
+
+func (s ExprSuite) TestEval_Errors(c *C) {
+	testCases := []struct {
+		source string
+		err    string
+	}{
+		{source: `$request_method * 2`, err: `left operand of \*: "GET" is not a number`},
+		{source: `"a" + "b"`, err: `left operand of \+: "a" is not a number`},
+		{source: `$status > $request_method || true`, err: ``},
+		{source: `$status > "abc"`, err: ``},
+		{source: `1 > "abc"`, err: `operands of >: "abc" is not a number`},
+		{source: `1 / 0`, err: `division by zero`},
+		{source: `1 % 0`, err: `division by zero`},
+		{source: `$status && true`, err: `left operand of &&: string is used as bool`},
+		{source: `!$status`, err: `operand of !: string is used as bool`},
+		{source: `$status ? 1 : 2`, err: `condition of \?: string is used as bool`},
+		{source: `$status[0]`, err: `string could not be indexed`},
+		{source: `split($status, "")[1.5]`, err: `index "1.5" is not an integer`},
+		{source: `int($upstream_addr)`, err: `int: "-" is not a number`},
+		{source: `float(true)`, err: `float: bool could not be converted to number`},
+		{source: `float("NaN")`, err: `float: "NaN" is not a number`},
+	}
+
+	for _, tc := range testCases {
+		e, err := Compile(tc.source)
+		c.Assert(err, IsNil, Commentf("%s", tc.source))
+
+		_, err = e.Eval(vars)
+		if tc.err == "" {
+			c.Assert(err, IsNil, Commentf("%s", tc.source))
+		} else {
+			c.Assert(err, ErrorMatches, tc.err, Commentf("%s", tc.source))
+		}
+	}
+}
+
+func (s ExprSuite) TestCompile_Errors(c *C) {
+	testCases := []struct {
+		source string
+		err    string
+	}{
+		{source: ``, err: `unexpected end of expression`},
+		{source: `1 +`, err: `unexpected end of expression`},
+		{source: `(1 + 2`, err: `"\)" is expected at the end`},
+		{source: `1 2`, err: `unexpected "2" at 2`},
+		{source: `$`, err: `variable name is expected at 0`},
+		{source: `"abc`, err: `string at 0 is not terminated`},
+		{source: `1 # 2`, err: `unexpected character '#' at 2`},
+		{source: `open("/etc/passwd")`, err: `unknown function "open" at 0`},
+		{source: `lower`, err: `"\(" is expected at the end`},
+		{source: `lower(1, 2)`, err: `wrong number of arguments of function "lower": 2`},
+		{source: `matches($host, $pattern)`, err: `function "matches": string literal is expected`},
+		{source: `matches($host, "(")`, err: `function "matches": error parsing regexp.*`},
+		{source: `cidr_match($remote_addr, "10.0.0.0/33")`, err: `function "cidr_match": invalid CIDR address.*`},
+		{source: `true ? 1`, err: `":" is expected at the end`},
+		{source: strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100), err: `expression is nested too deeply`},
+		{source: strings.Repeat("-", 100) + "1", err: `expression is nested too deeply`},
+	}
+
+	for _, tc := range testCases {
+		_, err := Compile(tc.source)
+		c.Assert(err, ErrorMatches, `could not compile expression .*: `+tc.err, Commentf("%s", tc.source))
+	}
+}
+
+func (s ExprSuite) TestEvalTyped(c *C) {
+	b, err := MustCompile(`$request_time > 1`).EvalBool(vars)
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, true)
+
+	_, err = MustCompile(`$request_time`).EvalBool(vars)
+	c.Assert(err, ErrorMatches, `string is used as bool`)
+
+	f, err := MustCompile(`$request_time`).EvalFloat(vars)
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, 1.25)
+
+	_, err = MustCompile(`$request_time > 1`).EvalFloat(vars)
+	c.Assert(err, ErrorMatches, `bool could not be converted to number`)
+}
@@ -0,0 +1,136 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ozonru/accesslog-exporter/pkg/net"
+)
+
+// function is a builtin function. Functions with compile have literal arguments, that are compiled once
+// with expression, for example regexes and subnets.
+type function struct {
+	minArgs int
+	// maxArgs is -1 for variadic functions
+	maxArgs int
+	call    func(args []Value) (Value, error)
+	compile func(args []node) (func(args []Value) (Value, error), error)
+}
+
+// functions contains builtin functions by name
+var functions = map[string]function{
+	"int": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		f, err := args[0].Float()
+		if err != nil {
+			return Value{}, err
+		}
+
+		return numberValue(math.Trunc(f)), nil
+	}},
+	"float": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		f, err := args[0].Float()
+		if err != nil {
+			return Value{}, err
+		}
+
+		return numberValue(f), nil
+	}},
+	"str": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		return stringValue(args[0].String()), nil
+	}},
+	"lower": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		return stringValue(strings.ToLower(args[0].String())), nil
+	}},
+	"upper": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		return stringValue(strings.ToUpper(args[0].String())), nil
+	}},
+	"trim": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		return stringValue(strings.TrimSpace(args[0].String())), nil
+	}},
+	"split": {minArgs: 2, maxArgs: 2, call: func(args []Value) (Value, error) {
+		return listValue(strings.Split(args[0].String(), args[1].String())), nil
+	}},
+	"len": {minArgs: 1, maxArgs: 1, call: func(args []Value) (Value, error) {
+		if args[0].kind == ListKind {
+			return numberValue(float64(len(args[0].list))), nil
+		}
+
+		return numberValue(float64(utf8.RuneCountInString(args[0].String()))), nil
+	}},
+	"contains": {minArgs: 2, maxArgs: 2, call: func(args []Value) (Value, error) {
+		return boolValue(strings.Contains(args[0].String(), args[1].String())), nil
+	}},
+	"starts_with": {minArgs: 2, maxArgs: 2, call: func(args []Value) (Value, error) {
+		return boolValue(strings.HasPrefix(args[0].String(), args[1].String())), nil
+	}},
+	"ends_with": {minArgs: 2, maxArgs: 2, call: func(args []Value) (Value, error) {
+		return boolValue(strings.HasSuffix(args[0].String(), args[1].String())), nil
+	}},
+	"replace": {minArgs: 3, maxArgs: 3, call: func(args []Value) (Value, error) {
+		return stringValue(strings.ReplaceAll(args[0].String(), args[1].String(), args[2].String())), nil
+	}},
+	// coalesce returns the first argument, that is neither empty nor "-", which nginx logs for missing values
+	"coalesce": {minArgs: 1, maxArgs: -1, call: func(args []Value) (Value, error) {
+		for _, arg := range args {
+			if s := arg.String(); s != "" && s != "-" {
+				return arg, nil
+			}
+		}
+
+		return stringValue(""), nil
+	}},
+	"matches": {minArgs: 2, maxArgs: 2, compile: compileMatches},
+	// cidr_match checks if address belongs to any of subnets, invalid address doesn't belong to them
+	"cidr_match": {minArgs: 2, maxArgs: -1, compile: compileCIDRMatch},
+}
+
+// compileMatches compiles literal regex of matches(value, regex)
+func compileMatches(args []node) (func(args []Value) (Value, error), error) {
+	literals, err := stringLiterals(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(literals[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return func(args []Value) (Value, error) {
+		return boolValue(re.MatchString(args[0].String())), nil
+	}, nil
+}
+
+// compileCIDRMatch compiles literal subnets of cidr_match(address, subnet...)
+func compileCIDRMatch(args []node) (func(args []Value) (Value, error), error) {
+	literals, err := stringLiterals(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	nets, err := net.ParseCIDRs(literals)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(args []Value) (Value, error) {
+		return boolValue(net.ContainsIP(nets, args[0].String())), nil
+	}, nil
+}
+
+// stringLiterals returns values of arguments, that should be string literals
+func stringLiterals(args []node) ([]string, error) {
+	literals := make([]string, 0, len(args))
+	for _, arg := range args {
+		literal, ok := arg.(*literalNode)
+		if !ok || literal.value.kind != StringKind {
+			return nil, fmt.Errorf("string literal is expected")
+		}
+		literals = append(literals, literal.value.str)
+	}
+
+	return literals, nil
+}
@@ -0,0 +1,406 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxDepth limits nesting of expressions
+const maxDepth = 64
+
+// tokenKind is a kind of lexical token
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	numberToken
+	stringToken
+	variableToken
+	identToken
+	operatorToken
+)
+
+// token is a lexical token of expression
+type token struct {
+	kind  tokenKind
+	text  string
+	value string
+	pos   int
+}
+
+// operators are operators and punctuation, two-character operators go first
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", "(", ")", "[", "]", ","}
+
+// tokenize splits source into tokens
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(source); {
+		c := source[pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '$':
+			end := pos + 1
+			for end < len(source) && isIdentChar(source[end]) {
+				end++
+			}
+			if end == pos+1 {
+				return nil, fmt.Errorf("variable name is expected at %d", pos)
+			}
+			tokens = append(tokens, token{kind: variableToken, text: source[pos:end], pos: pos})
+			pos = end
+		case isDigit(c) || (c == '.' && pos+1 < len(source) && isDigit(source[pos+1])):
+			end := pos
+			for end < len(source) && (isDigit(source[end]) || source[end] == '.' || source[end] == 'e' || source[end] == 'E' ||
+				((source[end] == '+' || source[end] == '-') && (source[end-1] == 'e' || source[end-1] == 'E'))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: numberToken, text: source[pos:end], pos: pos})
+			pos = end
+		case c == '"' || c == '\'':
+			value, end, err := readString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: stringToken, text: source[pos:end], value: value, pos: pos})
+			pos = end
+		case isIdentChar(c):
+			end := pos
+			for end < len(source) && isIdentChar(source[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: identToken, text: source[pos:end], pos: pos})
+			pos = end
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[pos:], op) {
+					tokens = append(tokens, token{kind: operatorToken, text: op, pos: pos})
+					pos += len(op)
+					found = true
+
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, pos)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: eofToken, pos: len(source)}), nil
+}
+
+// readString reads quoted string starting at pos, backslash escapes quote and backslash itself
+func readString(source string, pos int) (string, int, error) {
+	quote := source[pos]
+
+	var value strings.Builder
+	for i := pos + 1; i < len(source); i++ {
+		switch source[i] {
+		case quote:
+			return value.String(), i + 1, nil
+		case '\\':
+			if i+1 < len(source) && (source[i+1] == quote || source[i+1] == '\\') {
+				i++
+			}
+		}
+		value.WriteByte(source[i])
+	}
+
+	return "", 0, fmt.Errorf("string at %d is not terminated", pos)
+}
+
+// isDigit checks if character is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdentChar checks if character could be used in names of variables and functions
+func isIdentChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// parser is a recursive descent parser of expression. Precedence from lowest: ternary ?:, ||, &&,
+// == !=, < <= > >=, + -, * / %, unary ! -, indexing.
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// parse parses source into tree of nodes
+func parse(source string) (node, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	n, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != eofToken {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+
+	return n, nil
+}
+
+// peek returns current token
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next returns current token and moves to the next one
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != eofToken {
+		p.pos++
+	}
+
+	return t
+}
+
+// accept moves to the next token, if current one is the operator
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == operatorToken && t.text == op {
+		p.pos++
+
+		return true
+	}
+
+	return false
+}
+
+// expect moves to the next token, if current one is the operator, otherwise it fails
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		if t.kind == eofToken {
+			return fmt.Errorf("%q is expected at the end", op)
+		}
+
+		return fmt.Errorf("%q is expected at %d, got %q", op, t.pos, t.text)
+	}
+
+	return nil
+}
+
+// parseTernary parses condition ? then : else
+func (p *parser) parseTernary() (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, fmt.Errorf("expression is nested too deeply")
+	}
+
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.accept("?") {
+		return cond, nil
+	}
+
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ternaryNode{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+// binaryPrecedence contains binary operators by precedence level from lowest
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// parseBinary parses left-associative binary operators of precedence level and higher
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != operatorToken || !contains(binaryPrecedence[level], t.text) {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op: t.text, left: left, right: right}
+	}
+}
+
+// parseUnary parses ! and unary -
+func (p *parser) parseUnary() (node, error) {
+	t := p.peek()
+	if t.kind == operatorToken && (t.text == "!" || t.text == "-") {
+		p.next()
+
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxDepth {
+			return nil, fmt.Errorf("expression is nested too deeply")
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &unaryNode{op: t.text, operand: operand}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+// parsePostfix parses indexing of list
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("[") {
+		index, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+
+		n = &indexNode{list: n, index: index}
+	}
+
+	return n, nil
+}
+
+// parsePrimary parses literals, variables, calls of functions and parenthesized expressions
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case numberToken:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+
+		return &literalNode{value: numberValue(n)}, nil
+	case stringToken:
+		return &literalNode{value: stringValue(t.value)}, nil
+	case variableToken:
+		return &variableNode{name: t.text}, nil
+	case identToken:
+		switch t.text {
+		case "true":
+			return &literalNode{value: boolValue(true)}, nil
+		case "false":
+			return &literalNode{value: boolValue(false)}, nil
+		}
+
+		return p.parseCall(t)
+	case operatorToken:
+		if t.text == "(" {
+			n, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+
+			return n, p.expect(")")
+		}
+	case eofToken:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// parseCall parses call of function with name token
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.text, name.pos)
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []node
+	if !p.accept(")") {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if p.accept(")") {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments of function %q: %d", name.text, len(args))
+	}
+
+	call := fn.call
+	if fn.compile != nil {
+		var err error
+		if call, err = fn.compile(args); err != nil {
+			return nil, fmt.Errorf("function %q: %s", name.text, err)
+		}
+	}
+
+	return &callNode{name: name.text, call: call, args: args}, nil
+}
+
+// contains checks if list contains string
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
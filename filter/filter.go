@@ -0,0 +1,202 @@
+package filter
+
+import (
+	"fmt"
+	stdnet "net"
+	"regexp"
+	"strconv"
+
+	"github.com/ozonru/accesslog-exporter/expr"
+	"github.com/ozonru/accesslog-exporter/pkg/net"
+)
+
+// Action is an action of filter, when its condition matches log line
+type Action string
+
+const (
+	// Drop drops log lines matching condition
+	Drop Action = "drop"
+	// Keep drops log lines not matching condition
+	Keep Action = "keep"
+
+	// RelabelName is a name of filter reserved for log lines dropped by relabel configs
+	RelabelName = "relabel"
+)
+
+// Filter drops or keeps log lines by condition on nginx variables
+type Filter struct {
+	Name      string `yaml:"name"`
+	Action    Action `yaml:"action"`
+	Condition `yaml:",inline"`
+}
+
+// Condition is a condition on variable of log line, an expression or a combination of conditions. Condition
+// on variable matches, if all its comparisons are true, numeric comparisons are false for non-numeric values.
+// Regex is not anchored unlike regex of relabel configs, it matches any part of value.
+// Expression matches, if it returns true, expression that fails doesn't match.
+type Condition struct {
+	Variable string   `yaml:"variable"`
+	Equals   *string  `yaml:"equals"`
+	Regex    string   `yaml:"regex"`
+	CIDR     []string `yaml:"cidr"`
+	GT       *float64 `yaml:"gt"`
+	GTE      *float64 `yaml:"gte"`
+	LT       *float64 `yaml:"lt"`
+	LTE      *float64 `yaml:"lte"`
+
+	Expr string `yaml:"expr"`
+
+	And []*Condition `yaml:"and"`
+	Or  []*Condition `yaml:"or"`
+	Not *Condition   `yaml:"not"`
+
+	// compiled settings
+	regex      *regexp.Regexp
+	nets       []*stdnet.IPNet
+	expression *expr.Expression
+}
+
+// Compile checks settings of filter and compiles its condition
+func (f *Filter) Compile() error {
+	if f.Name == "" {
+		return fmt.Errorf("filter name is not specified")
+	}
+	if f.Name == RelabelName {
+		return fmt.Errorf("filter name %q is reserved", f.Name)
+	}
+
+	switch f.Action {
+	case "":
+		f.Action = Drop
+	case Drop, Keep:
+	default:
+		return fmt.Errorf("unknown action %q of filter %q", f.Action, f.Name)
+	}
+
+	if err := f.Condition.compile(); err != nil {
+		return fmt.Errorf("invalid condition of filter %q: %s", f.Name, err)
+	}
+
+	return nil
+}
+
+// Drops checks if log line with variables should be dropped
+func (f *Filter) Drops(data map[string]string) bool {
+	return f.Condition.Match(data) == (f.Action == Drop)
+}
+
+// compile checks that condition is either a condition on variable, an expression or a combination and compiles it
+func (c *Condition) compile() error {
+	kinds := 0
+	for _, set := range []bool{c.Variable != "", c.Expr != "", len(c.And) > 0, len(c.Or) > 0, c.Not != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("exactly one of variable, expr, and, or, not should be specified")
+	}
+
+	if c.Expr != "" {
+		expression, err := expr.Compile(c.Expr)
+		if err != nil {
+			return err
+		}
+		c.expression = expression
+	}
+
+	children := append(append([]*Condition{}, c.And...), c.Or...)
+	if c.Not != nil {
+		children = append(children, c.Not)
+	}
+	for _, child := range children {
+		if child == nil {
+			return fmt.Errorf("condition is empty")
+		}
+		if err := child.compile(); err != nil {
+			return err
+		}
+	}
+
+	if c.Variable == "" {
+		return nil
+	}
+
+	if c.Equals == nil && c.Regex == "" && len(c.CIDR) == 0 && c.GT == nil && c.GTE == nil && c.LT == nil && c.LTE == nil {
+		return fmt.Errorf("comparison of variable %q is not specified", c.Variable)
+	}
+
+	if c.Regex != "" {
+		regex, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return err
+		}
+		c.regex = regex
+	}
+
+	if len(c.CIDR) > 0 {
+		nets, err := net.ParseCIDRs(c.CIDR)
+		if err != nil {
+			return err
+		}
+		c.nets = nets
+	}
+
+	return nil
+}
+
+// Match checks if variables of log line match condition
+func (c *Condition) Match(data map[string]string) bool {
+	switch {
+	case len(c.And) > 0:
+		for _, condition := range c.And {
+			if !condition.Match(data) {
+				return false
+			}
+		}
+
+		return true
+	case len(c.Or) > 0:
+		for _, condition := range c.Or {
+			if condition.Match(data) {
+				return true
+			}
+		}
+
+		return false
+	case c.Not != nil:
+		return !c.Not.Match(data)
+	case c.expression != nil:
+		match, err := c.expression.EvalBool(data)
+
+		return err == nil && match
+	}
+
+	value := data[c.Variable]
+
+	if c.Equals != nil && value != *c.Equals {
+		return false
+	}
+
+	if c.regex != nil && !c.regex.MatchString(value) {
+		return false
+	}
+
+	if c.nets != nil && !net.ContainsIP(c.nets, value) {
+		return false
+	}
+
+	if c.GT != nil || c.GTE != nil || c.LT != nil || c.LTE != nil {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+
+		if (c.GT != nil && number <= *c.GT) || (c.GTE != nil && number < *c.GTE) ||
+			(c.LT != nil && number >= *c.LT) || (c.LTE != nil && number > *c.LTE) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestFilter(t *testing.T) { TestingT(t) }
+
+type FilterSuite struct{}
+
+var _ = Suite(&FilterSuite{})
+
+// parse parses filter from YAML
+func parse(c *C, raw string) *Filter {
+	f := &Filter{}
+	c.Assert(yaml.Unmarshal([]byte(raw), f), IsNil)
+
+	return f
+}
+
+func (s FilterSuite) TestCompile(c *C) {
+	testCases := []struct {
+		raw string
+		err string
+	}{
+		{raw: `{variable: $host, equals: ping}`, err: `filter name is not specified`},
+		{raw: `{name: relabel, variable: $host, equals: ping}`, err: `filter name "relabel" is reserved`},
+		{raw: `{name: f, action: skip, variable: $host, equals: ping}`, err: `unknown action "skip" of filter "f"`},
+		{raw: `{name: f}`, err: `invalid condition of filter "f": exactly one of variable, expr, and, or, not should be specified`},
+		{raw: `{name: f, variable: $host, not: {variable: $host, equals: a}}`, err: `invalid condition of filter "f": exactly one .*`},
+		{raw: `{name: f, variable: $host}`, err: `invalid condition of filter "f": comparison of variable "\$host" is not specified`},
+		{raw: `{name: f, variable: $host, regex: "("}`, err: `invalid condition of filter "f": error parsing regexp.*`},
+		{raw: `{name: f, variable: $remote_addr, cidr: [10.0.0.0/33]}`, err: `invalid condition of filter "f": invalid CIDR address.*`},
+		{raw: `{name: f, and: [{variable: $host}]}`, err: `invalid condition of filter "f": comparison of variable "\$host" is not specified`},
+		{raw: `{name: f, or: [null]}`, err: `invalid condition of filter "f": condition is empty`},
+		{raw: `{name: f, expr: "$status >="}`, err: `invalid condition of filter "f": could not compile expression .*`},
+		{raw: `{name: f, variable: $status, expr: "true"}`, err: `invalid condition of filter "f": exactly one .*`},
+		{raw: `{name: f, variable: $status, equals: ""}`},
+	}
+
+	for _, tc := range testCases {
+		err := parse(c, tc.raw).Compile()
+		if tc.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, tc.err, Commentf("%s", tc.raw))
+		}
+	}
+
+	f := parse(c, `{name: f, variable: $host, equals: ping}`)
+	c.Assert(f.Compile(), IsNil)
+	c.Assert(f.Action, Equals, Drop)
+}
+
+func (s FilterSuite) TestDrops(c *C) {
+	healthChecks := parse(c, `
+name: health_checks
+and:
+  - variable: $request_method
+    equals: GET
+  - variable: $request_uri
+    regex: ^/(ping|health)$
+  - not:
+      variable: $remote_addr
+      cidr: [10.0.0.0/8]
+`)
+	c.Assert(healthChecks.Compile(), IsNil)
+
+	slow := parse(c, `
+name: slow_or_errors
+action: keep
+or:
+  - variable: $request_time
+    gte: 1
+  - variable: $status
+    gt: 499
+    lt: 600
+`)
+	c.Assert(slow.Compile(), IsNil)
+
+	synthetic := parse(c, `
+name: synthetic
+or:
+  - expr: starts_with($http_user_agent, "Synthetic") && cidr_match($remote_addr, "192.168.0.0/16")
+  - expr: $status >= 100 && $status < 200
+`)
+	c.Assert(synthetic.Compile(), IsNil)
+
+	testCases := []struct {
+		filter  *Filter
+		data    map[string]string
+		dropped bool
+	}{
+		{
+			filter:  synthetic,
+			data:    map[string]string{"$http_user_agent": "SyntheticMonitor/1.0", "$remote_addr": "192.168.1.1", "$status": "200"},
+			dropped: true,
+		},
+		{
+			filter: synthetic,
+			data:   map[string]string{"$http_user_agent": "SyntheticMonitor/1.0", "$remote_addr": "8.8.8.8", "$status": "200"},
+		},
+		// expression that fails doesn't match
+		{
+			filter: synthetic,
+			data:   map[string]string{"$status": "-"},
+		},
+		{
+			filter:  synthetic,
+			data:    map[string]string{"$status": "101"},
+			dropped: true,
+		},
+		{
+			filter:  healthChecks,
+			data:    map[string]string{"$request_method": "GET", "$request_uri": "/ping", "$remote_addr": "1.2.3.4:80"},
+			dropped: true,
+		},
+		{
+			filter: healthChecks,
+			data:   map[string]string{"$request_method": "GET", "$request_uri": "/ping", "$remote_addr": "10.1.2.3"},
+		},
+		{
+			filter: healthChecks,
+			data:   map[string]string{"$request_method": "POST", "$request_uri": "/ping", "$remote_addr": "1.2.3.4"},
+		},
+		{
+			filter: healthChecks,
+			data:   map[string]string{"$request_method": "GET", "$request_uri": "/pings", "$remote_addr": "1.2.3.4"},
+		},
+		// invalid address doesn't belong to subnets
+		{
+			filter:  healthChecks,
+			data:    map[string]string{"$request_method": "GET", "$request_uri": "/health", "$remote_addr": "unix:"},
+			dropped: true,
+		},
+		{
+			filter: slow,
+			data:   map[string]string{"$request_time": "1.000", "$status": "200"},
+		},
+		{
+			filter: slow,
+			data:   map[string]string{"$request_time": "0.1", "$status": "503"},
+		},
+		{
+			filter:  slow,
+			data:    map[string]string{"$request_time": "0.1", "$status": "200"},
+			dropped: true,
+		},
+		// numeric comparisons are false for non-numeric values
+		{
+			filter:  slow,
+			data:    map[string]string{"$request_time": "-", "$status": "-"},
+			dropped: true,
+		},
+		{
+			filter:  slow,
+			data:    nil,
+			dropped: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		c.Assert(tc.filter.Drops(tc.data), Equals, tc.dropped, Commentf("case %d", i))
+	}
+}
@@ -0,0 +1,24 @@
+package geoip
+
+const (
+	// CountryLabelName is a name of label that contains ISO code of country
+	CountryLabelName = "country"
+	// ASNLabelName is a name of label that contains autonomous system number
+	ASNLabelName = "asn"
+
+	unknownLabelValue = "unknown"
+)
+
+// Resolver is an interface for service that resolves geo labels of ip address
+type Resolver interface {
+	Resolve(ip string) Location
+}
+
+// Location contains country and autonomous system of ip address
+type Location struct {
+	Country string
+	ASN     string
+}
+
+// unknownLocation is returned when ip address could not be resolved
+var unknownLocation = Location{Country: unknownLabelValue, ASN: unknownLabelValue}
@@ -0,0 +1,235 @@
+package geoip
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/cache"
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// countryRecord is a part of country database record that is needed to resolve country label
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// asnRecord is a part of ASN database record that is needed to resolve asn label
+type asnRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// database is MaxMind database file opened for lookups
+type database struct {
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// MMDBResolver resolves geo labels using local MaxMind databases. Resolved labels are stored in LRU cache,
+// databases are reopened when their files are changed.
+type MMDBResolver struct {
+	mu sync.RWMutex
+
+	country *database
+	asn     *database
+	closed  bool
+
+	cc *cache.LRUCache
+}
+
+// NewMMDBResolver creates new resolver. Any of database paths can be empty, in that case the label is always unknown.
+func NewMMDBResolver(countryPath, asnPath string, cacheSize int) (*MMDBResolver, error) {
+	cc, err := cache.NewLRUCache(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &MMDBResolver{cc: cc}
+
+	if countryPath != "" {
+		r.country, err = openDatabase(countryPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if asnPath != "" {
+		r.asn, err = openDatabase(asnPath)
+		if err != nil {
+			r.Close()
+
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Run checks databases files every interval and reloads them when they are changed.
+func (r *MMDBResolver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				logging.WithContext(ctx).Sugar().Warnf("could not reload geoip database: %s", err)
+			}
+		}
+	}
+}
+
+// Resolve returns country and autonomous system number of ip address.
+func (r *MMDBResolver) Resolve(ip string) Location {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if labels, ok := r.cc.Get(ip); ok {
+		return Location{Country: labels[CountryLabelName], ASN: labels[ASNLabelName]}
+	}
+
+	location := unknownLocation
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return location
+	}
+	addr = addr.Unmap()
+
+	if r.country != nil {
+		var record countryRecord
+		if err := r.country.reader.Lookup(addr).Decode(&record); err == nil {
+			if record.Country.ISOCode != "" {
+				location.Country = record.Country.ISOCode
+			} else if record.RegisteredCountry.ISOCode != "" {
+				location.Country = record.RegisteredCountry.ISOCode
+			}
+		}
+	}
+
+	if r.asn != nil {
+		var record asnRecord
+		if err := r.asn.reader.Lookup(addr).Decode(&record); err == nil && record.AutonomousSystemNumber != 0 {
+			location.ASN = strconv.FormatUint(uint64(record.AutonomousSystemNumber), 10)
+		}
+	}
+
+	// the cache is filled under read lock, so values resolved by old database can't get into cache after reload
+	r.cc.Set(ip, map[string]string{
+		CountryLabelName: location.Country,
+		ASNLabelName:     location.ASN,
+	})
+
+	return location
+}
+
+// Close closes opened databases, they are not reloaded after closing.
+func (r *MMDBResolver) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+
+	for _, db := range []*database{r.country, r.asn} {
+		if db != nil {
+			db.reader.Close()
+		}
+	}
+}
+
+// reload reopens databases which files were changed since last opening.
+func (r *MMDBResolver) reload() error {
+	r.mu.RLock()
+	oldCountry, oldASN := r.country, r.asn
+	r.mu.RUnlock()
+
+	country, err := reopenDatabase(oldCountry)
+	if err != nil {
+		return err
+	}
+
+	asn, err := reopenDatabase(oldASN)
+	if err != nil {
+		if country != oldCountry {
+			country.reader.Close()
+		}
+
+		return err
+	}
+
+	if country == oldCountry && asn == oldASN {
+		return nil
+	}
+
+	r.mu.Lock()
+	replaced := !r.closed && r.country == oldCountry && r.asn == oldASN
+	if replaced {
+		r.country, r.asn = country, asn
+		r.cc.Purge()
+	}
+	r.mu.Unlock()
+
+	// reopened databases are closed instead of replaced ones, if resolver was closed in the meantime
+	if !replaced {
+		oldCountry, country = country, oldCountry
+		oldASN, asn = asn, oldASN
+	}
+	if oldCountry != country {
+		oldCountry.reader.Close()
+	}
+	if oldASN != asn {
+		oldASN.reader.Close()
+	}
+
+	return nil
+}
+
+// openDatabase opens MaxMind database file.
+func openDatabase(path string) (*database, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &database{path: path, modTime: info.ModTime(), reader: reader}, nil
+}
+
+// reopenDatabase opens database again if its file was changed, otherwise it returns the same database.
+func reopenDatabase(db *database) (*database, error) {
+	if db == nil {
+		return nil, nil
+	}
+
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.ModTime().Equal(db.modTime) {
+		return db, nil
+	}
+
+	return openDatabase(db.path)
+}
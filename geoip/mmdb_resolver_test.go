@@ -0,0 +1,139 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestMMDBResolver(t *testing.T) { TestingT(t) }
+
+type MMDBResolverSuite struct{}
+
+var _ = Suite(&MMDBResolverSuite{})
+
+// writeDatabase builds tiny MaxMind database that contains passed networks with records.
+func writeDatabase(c *C, path, dbType string, records map[string]mmdbtype.Map) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, RecordSize: 24})
+	c.Assert(err, IsNil)
+
+	for network, record := range records {
+		_, ipNet, err := net.ParseCIDR(network)
+		c.Assert(err, IsNil)
+		c.Assert(tree.Insert(ipNet, record), IsNil)
+	}
+
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	_, err = tree.WriteTo(f)
+	c.Assert(err, IsNil)
+}
+
+func countryRecordMap(isoCode string) mmdbtype.Map {
+	return mmdbtype.Map{"country": mmdbtype.Map{"iso_code": mmdbtype.String(isoCode)}}
+}
+
+func asnRecordMap(asn uint32) mmdbtype.Map {
+	return mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(asn)}
+}
+
+func (s MMDBResolverSuite) TestResolve(c *C) {
+	dir := c.MkDir()
+	countryPath := filepath.Join(dir, "country.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+
+	writeDatabase(c, countryPath, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"81.2.69.0/24":   countryRecordMap("GB"),
+		"2a02:6b8::/32":  countryRecordMap("RU"),
+		"89.160.20.0/24": {"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("SE")}},
+	})
+	writeDatabase(c, asnPath, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"81.2.69.0/24":  asnRecordMap(20712),
+		"2a02:6b8::/32": asnRecordMap(13238),
+	})
+
+	r, err := NewMMDBResolver(countryPath, asnPath, 10)
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	c.Assert(r.Resolve("81.2.69.142"), DeepEquals, Location{Country: "GB", ASN: "20712"})
+	c.Assert(r.Resolve("2a02:6b8::1"), DeepEquals, Location{Country: "RU", ASN: "13238"})
+	c.Assert(r.Resolve("::ffff:81.2.69.142"), DeepEquals, Location{Country: "GB", ASN: "20712"})
+	c.Assert(r.Resolve("89.160.20.1"), DeepEquals, Location{Country: "SE", ASN: "unknown"})
+	c.Assert(r.Resolve("1.1.1.1"), DeepEquals, Location{Country: "unknown", ASN: "unknown"})
+	c.Assert(r.Resolve("-"), DeepEquals, Location{Country: "unknown", ASN: "unknown"})
+
+	// resolved locations are cached, invalid addresses are not
+	c.Assert(r.cc.Len(), Equals, 5)
+}
+
+func (s MMDBResolverSuite) TestResolveWithoutDatabases(c *C) {
+	r, err := NewMMDBResolver("", "", 10)
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	c.Assert(r.Resolve("81.2.69.142"), DeepEquals, Location{Country: "unknown", ASN: "unknown"})
+}
+
+func (s MMDBResolverSuite) TestNewMMDBResolver_Fail(c *C) {
+	r, err := NewMMDBResolver(filepath.Join(c.MkDir(), "nonexistent.mmdb"), "", 10)
+	c.Assert(err, NotNil)
+	c.Assert(r, IsNil)
+}
+
+func (s MMDBResolverSuite) TestReload(c *C) {
+	countryPath := filepath.Join(c.MkDir(), "country.mmdb")
+	writeDatabase(c, countryPath, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"81.2.69.0/24": countryRecordMap("GB"),
+	})
+
+	r, err := NewMMDBResolver(countryPath, "", 10)
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	c.Assert(r.Resolve("81.2.69.142").Country, Equals, "GB")
+
+	// nothing is changed
+	c.Assert(r.reload(), IsNil)
+	c.Assert(r.cc.Len(), Equals, 1)
+
+	writeDatabase(c, countryPath, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"81.2.69.0/24": countryRecordMap("IE"),
+	})
+	future := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(countryPath, future, future), IsNil)
+
+	c.Assert(r.reload(), IsNil)
+	c.Assert(r.cc.Len(), Equals, 0)
+	c.Assert(r.Resolve("81.2.69.142").Country, Equals, "IE")
+
+	// broken database file keeps previous database
+	c.Assert(os.WriteFile(countryPath, []byte("broken"), 0644), IsNil)
+	future = future.Add(time.Hour)
+	c.Assert(os.Chtimes(countryPath, future, future), IsNil)
+
+	c.Assert(r.reload(), NotNil)
+	c.Assert(r.Resolve("81.2.69.142").Country, Equals, "IE")
+
+	// databases are not reopened after closing
+	r.Close()
+	country := r.country
+
+	writeDatabase(c, countryPath, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"81.2.69.0/24": countryRecordMap("FR"),
+	})
+	future = future.Add(time.Hour)
+	c.Assert(os.Chtimes(countryPath, future, future), IsNil)
+
+	c.Assert(r.reload(), IsNil)
+	c.Assert(r.country, Equals, country)
+}
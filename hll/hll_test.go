@@ -0,0 +1,201 @@
+package hll
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/expr"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestHLL(t *testing.T) { TestingT(t) }
+
+type HLLSuite struct{}
+
+var _ = Suite(&HLLSuite{})
+
+func (s HLLSuite) TestEstimate(c *C) {
+	_, err := New(MaxPrecision + 1)
+	c.Assert(err, ErrorMatches, "precision should be from 4 to 18, got 19")
+
+	sketch, err := New(12)
+	c.Assert(err, IsNil)
+	c.Assert(sketch.Estimate(), Equals, uint64(0))
+
+	// small cardinalities are counted almost exactly
+	for i := 0; i < 100; i++ {
+		sketch.Add(Hash(fmt.Sprintf("10.0.0.%d", i)))
+		sketch.Add(Hash(fmt.Sprintf("10.0.0.%d", i)))
+	}
+	c.Assert(sketch.Estimate() >= 98 && sketch.Estimate() <= 102, Equals, true, Commentf("estimate %d", sketch.Estimate()))
+
+	// standard error is 1.04/sqrt(2^12), that is about 1.6%
+	for i := 0; i < 100000; i++ {
+		sketch.Add(Hash(fmt.Sprintf("user-%d", i)))
+	}
+	relative := math.Abs(float64(sketch.Estimate())-100100) / 100100
+	c.Assert(relative < 0.05, Equals, true, Commentf("estimate %d", sketch.Estimate()))
+
+	sketch.Reset()
+	c.Assert(sketch.Estimate(), Equals, uint64(0))
+}
+
+func (s HLLSuite) TestMerge(c *C) {
+	a, _ := New(10)
+	b, _ := New(10)
+	for i := 0; i < 3000; i++ {
+		a.Add(Hash(fmt.Sprintf("a-%d", i)))
+		b.Add(Hash(fmt.Sprintf("b-%d", i)))
+	}
+
+	// union of sketches estimates union of sets
+	union := a.Clone()
+	c.Assert(union.Merge(b), IsNil)
+	relative := math.Abs(float64(union.Estimate())-6000) / 6000
+	c.Assert(relative < 0.1, Equals, true, Commentf("estimate %d", union.Estimate()))
+
+	// merge is idempotent, so replicas observing the same values don't inflate estimate
+	again := union.Clone()
+	c.Assert(again.Merge(a), IsNil)
+	c.Assert(again.Estimate(), Equals, union.Estimate())
+
+	other, _ := New(11)
+	c.Assert(a.Merge(other), NotNil)
+}
+
+func (s HLLSuite) TestMarshalBinary(c *C) {
+	sketch, _ := New(8)
+	for i := 0; i < 500; i++ {
+		sketch.Add(Hash(fmt.Sprint(i)))
+	}
+
+	raw, err := sketch.MarshalBinary()
+	c.Assert(err, IsNil)
+	c.Assert(raw, HasLen, 1+256)
+
+	var decoded Sketch
+	c.Assert(decoded.UnmarshalBinary(raw), IsNil)
+	c.Assert(decoded.Estimate(), Equals, sketch.Estimate())
+
+	c.Assert(decoded.UnmarshalBinary(raw[:100]), NotNil)
+	c.Assert(decoded.UnmarshalBinary(nil), NotNil)
+}
+
+func (s HLLSuite) TestTracker(c *C) {
+	tracker, err := NewTracker(expr.MustCompile(`$host`), []Dimension{
+		{Name: "ip", Value: expr.MustCompile(`$remote_addr`)},
+		{Name: "user_agent", Value: expr.MustCompile(`$http_user_agent`)},
+	}, []time.Duration{time.Minute, time.Hour}, 10, 2)
+	c.Assert(err, IsNil)
+
+	tracker.Observe("localhost", map[string]string{"$host": "a.example.com", "$remote_addr": "10.0.0.1", "$http_user_agent": "curl/8.0"})
+	tracker.Observe("localhost", map[string]string{"$host": "a.example.com", "$remote_addr": "10.0.0.2", "$http_user_agent": "curl/8.0"})
+	tracker.Observe("localhost", map[string]string{"$host": "a.example.com", "$remote_addr": "10.0.0.1", "$http_user_agent": "-"})
+	// hosts exceeding limit are tracked as other
+	tracker.Observe("localhost", map[string]string{"$host": "b.example.com", "$remote_addr": "10.0.0.3"})
+	tracker.Observe("localhost", map[string]string{"$host": "c.example.com", "$remote_addr": "10.0.0.4"})
+
+	estimates := func() map[string]uint64 {
+		result := make(map[string]uint64)
+		for _, state := range tracker.States() {
+			result[state.Window+","+state.Host+","+state.Dimension] = state.Estimate
+		}
+
+		return result
+	}
+
+	c.Assert(estimates(), DeepEquals, map[string]uint64{
+		"1m,a.example.com,ip":         2,
+		"1m,a.example.com,user_agent": 1,
+		"1m,b.example.com,ip":         1,
+		"1m,b.example.com,user_agent": 0,
+		"1m,other,ip":                 1,
+		"1m,other,user_agent":         0,
+		"1h,a.example.com,ip":         2,
+		"1h,a.example.com,user_agent": 1,
+		"1h,b.example.com,ip":         1,
+		"1h,b.example.com,user_agent": 0,
+		"1h,other,ip":                 1,
+		"1h,other,user_agent":         0,
+	})
+
+	// values are forgotten, when window slides over their slot, and hosts without values are removed
+	tracker.rotate(tracker.windows[0])
+	tracker.Observe("localhost", map[string]string{"$host": "a.example.com", "$remote_addr": "10.0.0.5"})
+	for i := 0; i < slots-1; i++ {
+		tracker.rotate(tracker.windows[0])
+	}
+	c.Assert(estimates()["1m,a.example.com,ip"], Equals, uint64(1))
+	c.Assert(estimates()["1h,a.example.com,ip"], Equals, uint64(3))
+	_, ok := estimates()["1m,b.example.com,ip"]
+	c.Assert(ok, Equals, false)
+
+	_, err = NewTracker(expr.MustCompile(`$host`), nil, []time.Duration{time.Minute}, 2, 10)
+	c.Assert(err, NotNil)
+}
+
+func (s HLLSuite) TestExport(c *C) {
+	gauge, gatherer, err := exposer.NewDummyGauge(exposer.UniqueVisitors, exposer.MetricsOptions{SourceLabels: []string{"team"}})
+	c.Assert(err, IsNil)
+
+	tracker, err := NewTracker(expr.MustCompile(`$host`), []Dimension{{Name: "ip", Value: expr.MustCompile(`$remote_addr`)}},
+		[]time.Duration{time.Minute}, 12, 10)
+	c.Assert(err, IsNil)
+
+	series := func() map[string]float64 {
+		values, err := exposer.GatherValues(gatherer, exposer.UniqueVisitors)
+		c.Assert(err, IsNil)
+
+		return values
+	}
+
+	tracker.Observe("localhost", map[string]string{"$host": "example.com", "$remote_addr": "10.0.0.1"})
+	tracker.Observe("localhost", map[string]string{"$host": "example.com", "$remote_addr": "10.0.0.2"})
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.3"})
+	tracker.export(gauge)
+	c.Assert(series(), DeepEquals, map[string]float64{
+		"ip,example.com,1m": 2,
+		"ip,unknown,1m":     1,
+	})
+
+	// series of hosts, that are removed from window, are removed
+	for i := 0; i < slots; i++ {
+		tracker.rotate(tracker.windows[0])
+	}
+	tracker.export(gauge)
+	c.Assert(series(), DeepEquals, map[string]float64{})
+}
+
+func (s HLLSuite) TestServeHTTP(c *C) {
+	tracker, err := NewTracker(expr.MustCompile(`$host`), []Dimension{{Name: "ip", Value: expr.MustCompile(`$remote_addr`)}},
+		[]time.Duration{time.Hour}, 8, 10)
+	c.Assert(err, IsNil)
+	tracker.Observe("localhost", map[string]string{"$host": "example.com", "$remote_addr": "10.0.0.1"})
+
+	recorder := httptest.NewRecorder()
+	tracker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/hll", nil))
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), Equals, "application/json")
+
+	var response struct {
+		Precision uint8   `json:"precision"`
+		States    []State `json:"states"`
+	}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Precision, Equals, uint8(8))
+	c.Assert(response.States, HasLen, 1)
+	c.Assert(response.States[0].Window, Equals, "1h")
+	c.Assert(response.States[0].Estimate, Equals, uint64(1))
+
+	// sketches of replicas are merged by client
+	var sketch Sketch
+	c.Assert(sketch.UnmarshalBinary(response.States[0].Sketch), IsNil)
+	c.Assert(sketch.Estimate(), Equals, uint64(1))
+}
@@ -0,0 +1,137 @@
+package hll
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// MinPrecision and MaxPrecision limit number of registers of sketch, it is 2^precision
+	MinPrecision = 4
+	MaxPrecision = 18
+)
+
+// Sketch is a HyperLogLog sketch, that estimates number of distinct values. Sketches with the same precision
+// are merged without loss of accuracy, so sketches of replicas could be combined.
+type Sketch struct {
+	precision uint8
+	registers []uint8
+}
+
+// New creates empty sketch with 2^precision registers, standard error of estimate is 1.04/sqrt(2^precision)
+func New(precision uint8) (*Sketch, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision should be from %d to %d, got %d", MinPrecision, MaxPrecision, precision)
+	}
+
+	return &Sketch{precision: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Hash hashes value for sketch
+func Hash(value string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+
+	// FNV hashes of similar values differ in a few bits, so they are mixed by finalizer of splitmix64
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+
+	return x ^ (x >> 31)
+}
+
+// Add adds hash of value to sketch
+func (s *Sketch) Add(hash uint64) {
+	index := hash >> (64 - s.precision)
+	// the guard bit limits rank, when all remaining bits are zero
+	rank := uint8(bits.LeadingZeros64(hash<<s.precision|1<<(s.precision-1))) + 1
+
+	if rank > s.registers[index] {
+		s.registers[index] = rank
+	}
+}
+
+// Merge merges other sketch into sketch, sketches should have the same precision
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.precision != other.precision {
+		return fmt.Errorf("sketches with precision %d and %d could not be merged", s.precision, other.precision)
+	}
+
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+
+	return nil
+}
+
+// Estimate returns estimated number of distinct values, linear counting is used for small cardinalities
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.registers))
+
+	sum, zeros := 0.0, 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha(len(s.registers)) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// Reset makes sketch empty
+func (s *Sketch) Reset() {
+	for i := range s.registers {
+		s.registers[i] = 0
+	}
+}
+
+// Clone returns copy of sketch
+func (s *Sketch) Clone() *Sketch {
+	return &Sketch{precision: s.precision, registers: append([]uint8{}, s.registers...)}
+}
+
+// MarshalBinary encodes sketch as precision followed by registers
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	return append([]byte{s.precision}, s.registers...), nil
+}
+
+// UnmarshalBinary decodes sketch encoded by MarshalBinary
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("sketch is empty")
+	}
+
+	precision := data[0]
+	if precision < MinPrecision || precision > MaxPrecision || len(data)-1 != 1<<precision {
+		return fmt.Errorf("invalid sketch with precision %d and %d registers", precision, len(data)-1)
+	}
+
+	s.precision = precision
+	s.registers = append([]uint8{}, data[1:]...)
+
+	return nil
+}
+
+// alpha is a constant, that corrects bias of estimate for number of registers
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+
+	return 0.7213 / (1 + 1.079/float64(m))
+}
@@ -0,0 +1,261 @@
+package hll
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/expr"
+)
+
+const (
+	// slots is a number of sketches of rolling window, the oldest one is reset every window/slots
+	slots = 6
+
+	// otherHost is a host of log lines, when number of tracked hosts exceeds limit
+	otherHost = "other"
+	// unknownHost is a host of log lines, when host could not be evaluated
+	unknownHost = "unknown"
+)
+
+// Dimension is a dimension of log lines, which distinct values are counted
+type Dimension struct {
+	Name  string
+	Value *expr.Expression
+}
+
+// State is a merged sketch of window, host and dimension, sketches of replicas could be merged
+type State struct {
+	Window    string `json:"window"`
+	Host      string `json:"host"`
+	Dimension string `json:"dimension"`
+	Estimate  uint64 `json:"estimate"`
+	// Sketch is a sketch encoded by MarshalBinary
+	Sketch []byte `json:"sketch"`
+}
+
+// window is a rolling window, that contains sketches of slots by host and dimension
+type window struct {
+	size     time.Duration
+	current  int
+	sketches map[string][][]*Sketch
+}
+
+// Tracker estimates number of distinct values of dimensions by host in rolling windows
+type Tracker struct {
+	host       *expr.Expression
+	dimensions []Dimension
+	precision  uint8
+	maxHosts   int
+
+	mu      sync.Mutex
+	windows []*window
+}
+
+// NewTracker creates tracker of windows, host of log line is evaluated by expression. Hosts exceeding maxHosts
+// are tracked as "other".
+func NewTracker(host *expr.Expression, dimensions []Dimension, windows []time.Duration, precision uint8, maxHosts int) (*Tracker, error) {
+	if _, err := New(precision); err != nil {
+		return nil, err
+	}
+
+	t := &Tracker{host: host, dimensions: dimensions, precision: precision, maxHosts: maxHosts}
+	for _, size := range windows {
+		t.windows = append(t.windows, &window{size: size, sketches: make(map[string][][]*Sketch)})
+	}
+
+	return t, nil
+}
+
+// Observe adds values of dimensions of log line to sketches of its host. Empty values, "-" and values that
+// could not be evaluated are not counted.
+func (t *Tracker) Observe(nginxHost string, data map[string]string) {
+	host, err := t.host.EvalString(data)
+	if err != nil || host == "" || host == "-" {
+		host = unknownHost
+	}
+
+	hashes := make([]uint64, len(t.dimensions))
+	added := make([]bool, len(t.dimensions))
+	for i, dimension := range t.dimensions {
+		if value, err := dimension.Value.EvalString(data); err == nil && value != "" && value != "-" {
+			hashes[i], added[i] = Hash(value), true
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, w := range t.windows {
+		h := host
+		if _, ok := w.sketches[h]; !ok && len(w.sketches) >= t.maxHosts {
+			h = otherHost
+		}
+
+		sketches, ok := w.sketches[h]
+		if !ok {
+			sketches = make([][]*Sketch, len(t.dimensions))
+			for i := range sketches {
+				sketches[i] = make([]*Sketch, slots)
+			}
+			w.sketches[h] = sketches
+		}
+
+		for i := range t.dimensions {
+			if !added[i] {
+				continue
+			}
+
+			if sketches[i][w.current] == nil {
+				sketches[i][w.current], _ = New(t.precision)
+			}
+			sketches[i][w.current].Add(hashes[i])
+		}
+	}
+}
+
+// States returns sketches of windows merged from all slots sorted by window, host and dimension. Sketches of slots
+// are cloned under lock and merged without it, so observation of log lines is not blocked by merging.
+func (t *Tracker) States() []State {
+	type slotSketches struct {
+		window    string
+		host      string
+		dimension string
+		sketches  []*Sketch
+	}
+
+	var snapshot []slotSketches
+
+	t.mu.Lock()
+	for _, w := range t.windows {
+		hosts := make([]string, 0, len(w.sketches))
+		for host := range w.sketches {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+
+		for _, host := range hosts {
+			for i, dimension := range t.dimensions {
+				var sketches []*Sketch
+				for _, sketch := range w.sketches[host][i] {
+					if sketch != nil {
+						sketches = append(sketches, sketch.Clone())
+					}
+				}
+
+				snapshot = append(snapshot, slotSketches{formatWindow(w.size), host, dimension.Name, sketches})
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	states := make([]State, 0, len(snapshot))
+	for _, slot := range snapshot {
+		merged, _ := New(t.precision)
+		for _, sketch := range slot.sketches {
+			_ = merged.Merge(sketch)
+		}
+
+		raw, _ := merged.MarshalBinary()
+		states = append(states, State{
+			Window:    slot.window,
+			Host:      slot.host,
+			Dimension: slot.dimension,
+			Estimate:  merged.Estimate(),
+			Sketch:    raw,
+		})
+	}
+
+	return states
+}
+
+// Run rolls windows and exports estimates to gauge every slot of the shortest window, if gauge is not nil
+func (t *Tracker) Run(ctx context.Context, gauge *exposer.Gauge) {
+	interval := t.windows[0].size / slots
+	for _, w := range t.windows {
+		if w.size/slots < interval {
+			interval = w.size / slots
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for tick := 1; ; tick++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, w := range t.windows {
+				if ticks := int((w.size/slots + interval/2) / interval); tick%ticks == 0 {
+					t.rotate(w)
+				}
+			}
+
+			if gauge != nil {
+				t.export(gauge)
+			}
+		}
+	}
+}
+
+// rotate makes the oldest slot of window current resetting its sketches, hosts without values are removed
+func (t *Tracker) rotate(w *window) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w.current = (w.current + 1) % slots
+	for host, sketches := range w.sketches {
+		empty := true
+		for i := range sketches {
+			sketches[i][w.current] = nil
+			for _, sketch := range sketches[i] {
+				empty = empty && sketch == nil
+			}
+		}
+
+		if empty {
+			delete(w.sketches, host)
+		}
+	}
+}
+
+// export replaces series of gauge with estimates of windows
+func (t *Tracker) export(gauge *exposer.Gauge) {
+	states := t.States()
+
+	gauge.Reset()
+	for _, state := range states {
+		gauge.Set(float64(state.Estimate), state.Host, state.Dimension, state.Window)
+	}
+}
+
+// ServeHTTP serves states of windows as JSON
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Precision uint8   `json:"precision"`
+		States    []State `json:"states"`
+	}{
+		Precision: t.precision,
+		States:    t.States(),
+	})
+}
+
+// formatWindow formats duration of window without zero units, for example 1h instead of 1h0m0s
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+
+	return s
+}
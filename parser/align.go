@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ozonru/accesslog-exporter/pkg/net"
+)
+
+// valueRes contains patterns of values of well-known nginx variables
+var valueRes = map[string]*regexp.Regexp{
+	"$status":                 regexp.MustCompile(`^[1-5][0-9]{2}$`),
+	"$request_time":           regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`),
+	"$body_bytes_sent":        regexp.MustCompile(`^[0-9]+$`),
+	"$bytes_sent":             regexp.MustCompile(`^[0-9]+$`),
+	"$request_length":         regexp.MustCompile(`^[0-9]+$`),
+	"$connection_requests":    regexp.MustCompile(`^[0-9]+$`),
+	"$request_method":         regexp.MustCompile(`^[A-Z]+$`),
+	"$request":                regexp.MustCompile(`^[A-Z]+ \S+ HTTP/[0-9.]+$`),
+	"$time_local":             regexp.MustCompile(`^[0-9]{2}/[A-Za-z]{3}/[0-9]{4}:[0-9]{2}:[0-9]{2}:[0-9]{2} [+-][0-9]{4}$`),
+	"$time_iso8601":           regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}([+-][0-9]{2}:[0-9]{2}|Z)$`),
+	"$upstream_status":        regexp.MustCompile(`^(-|[1-5][0-9]{2})([,:] ?(-|[1-5][0-9]{2}))*$`),
+	"$upstream_response_time": regexp.MustCompile(`^(-|[0-9]+(\.[0-9]+)?)([,:] ?(-|[0-9]+(\.[0-9]+)?))*$`),
+}
+
+// Field is a variable of format aligned with value of log line. Variable or value is missing, if format
+// and content have different number of fields.
+type Field struct {
+	Variable string
+	Value    string
+
+	MissingVariable bool
+	MissingValue    bool
+	// Plausible is false, if value doesn't look like value of well-known variable or one of them is missing
+	Plausible bool
+}
+
+// AlignPipedFormat aligns variables of format with values of log line one by one, so that it could be seen,
+// where format and content diverge, when they are inconsistent
+func AlignPipedFormat(format, content string) []Field {
+	variables := strings.Split(format, "|")
+	values := strings.Split(content, "|")
+
+	n := len(variables)
+	if len(values) > n {
+		n = len(values)
+	}
+
+	fields := make([]Field, 0, n)
+	for i := 0; i < n; i++ {
+		field := Field{MissingVariable: i >= len(variables), MissingValue: i >= len(values)}
+		if !field.MissingVariable {
+			field.Variable = clean(variables[i])
+		}
+		if !field.MissingValue {
+			field.Value = clean(values[i])
+		}
+		field.Plausible = !field.MissingVariable && !field.MissingValue && isPlausible(field.Variable, field.Value)
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// Divergence returns index of the first field, which is missing or implausible, or -1 if all fields are plausible
+func Divergence(fields []Field) int {
+	for i, field := range fields {
+		if !field.Plausible {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// isPlausible checks if value looks like value of variable, values of unknown variables and empty values are plausible
+func isPlausible(variable, value string) bool {
+	if value == "" || value == "-" {
+		return true
+	}
+
+	if variable == "$remote_addr" {
+		_, err := net.NormalizeIP(value)
+
+		return err == nil
+	}
+
+	if re, ok := valueRes[variable]; ok {
+		return re.MatchString(value)
+	}
+
+	return true
+}
+
+// clean trims spaces, quotes and brackets around variable or value
+func clean(s string) string {
+	s = strings.TrimSpace(s)
+	for _, cutset := range []string{"\"", "[", "]", "(", ")"} {
+		s = strings.Trim(s, cutset)
+	}
+
+	return s
+}
@@ -1,4 +1,9 @@
 package parser
 
+import "errors"
+
+// ErrFieldCountMismatch is an error of log line, which number of fields differs from format
+var ErrFieldCountMismatch = errors.New("format and content are inconsistent")
+
 // LogLineParser is an interface for service that parses log lines
 type LogLineParser func(format, content string) (map[string]string, error)
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"errors"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -31,7 +32,8 @@ func (s LogLineParserSuite) TestParseSpacedFormat_Fail(c *C) {
 	data, err := ParseSpacedFormat(`$var1 $var3`, `1 2 3`)
 
 	c.Assert(data, IsNil)
-	c.Assert(err, NotNil)
+	c.Assert(errors.Is(err, ErrFieldCountMismatch), Equals, true)
+	c.Assert(err, ErrorMatches, "format and content are inconsistent: format has 2 fields, content has 3")
 }
 
 func (s LogLineParserSuite) TestParsePipedFormat_Success(c *C) {
@@ -53,5 +55,25 @@ func (s LogLineParserSuite) TestParsePipedFormat_Fail(c *C) {
 	data, err := ParsePipedFormat(`$var1 | $var3`, `1 | 2 | 3`)
 
 	c.Assert(data, IsNil)
-	c.Assert(err, NotNil)
+	c.Assert(errors.Is(err, ErrFieldCountMismatch), Equals, true)
+}
+
+func (s LogLineParserSuite) TestAlignPipedFormat(c *C) {
+	format := `$remote_addr | [$time_local] | "$request" | $status | $request_time | "$http_user_agent"`
+
+	// value containing delimiter shifts the following values
+	fields := AlignPipedFormat(format, `10.0.0.1 | [19/Sep/2018:19:52:01 +0400] | "GET /a|b HTTP/1.1" | 200 | 0.5 | "curl/8.0"`)
+	c.Assert(fields, HasLen, 7)
+	c.Assert(fields[1], DeepEquals, Field{Variable: "$time_local", Value: "19/Sep/2018:19:52:01 +0400", Plausible: true})
+	c.Assert(fields[2], DeepEquals, Field{Variable: "$request", Value: "GET /a"})
+	c.Assert(fields[6], DeepEquals, Field{Value: "curl/8.0", MissingVariable: true})
+	c.Assert(Divergence(fields), Equals, 2)
+
+	// missing value is pointed at the end, if other values are plausible
+	fields = AlignPipedFormat(format, `2001:db8::1 | [19/Sep/2018:19:52:01 +0400] | "GET / HTTP/1.1" | 200 | -`)
+	c.Assert(fields, HasLen, 6)
+	c.Assert(fields[5], DeepEquals, Field{Variable: "$http_user_agent", MissingValue: true})
+	c.Assert(Divergence(fields), Equals, 5)
+
+	c.Assert(Divergence(AlignPipedFormat(format, `10.0.0.1 | - | "GET / HTTP/1.1" | 200 | 0.5 | "curl/8.0"`)), Equals, -1)
 }
@@ -11,29 +11,12 @@ func ParsePipedFormat(format, content string) (map[string]string, error) {
 	values := strings.Split(content, "|")
 
 	if len(variables) != len(values) {
-		return nil, fmt.Errorf("format and content are inconsistent")
+		return nil, fmt.Errorf("%w: format has %d fields, content has %d", ErrFieldCountMismatch, len(variables), len(values))
 	}
 
 	data := make(map[string]string)
 	for k, variable := range variables {
-		// clear variables
-		variable = strings.TrimSpace(variable)
-		variable = strings.Trim(variable, "\"")
-		variable = strings.Trim(variable, "[")
-		variable = strings.Trim(variable, "]")
-		variable = strings.Trim(variable, "(")
-		variable = strings.Trim(variable, ")")
-
-		// clear values
-		value := strings.TrimSpace(values[k])
-		value = strings.Trim(value, "\"")
-		value = strings.Trim(value, "[")
-		value = strings.Trim(value, "]")
-		value = strings.Trim(value, "(")
-		value = strings.Trim(value, ")")
-
-		data[variable] = value
-
+		data[clean(variable)] = clean(values[k])
 	}
 
 	return data, nil
@@ -16,7 +16,7 @@ func ParseSpacedFormat(format, content string) (map[string]string, error) {
 	values := strings.Split(replaceInnerSpaces(content), " ")
 
 	if len(variables) != len(values) {
-		return nil, fmt.Errorf("format and content are inconsistent")
+		return nil, fmt.Errorf("%w: format has %d fields, content has %d", ErrFieldCountMismatch, len(variables), len(values))
 	}
 
 	data := make(map[string]string)
@@ -1,21 +1,140 @@
 package net
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 )
 
-// IsSubnetContainsIP checks if the passed ip is in subnet
-func IsSubnetContainsIP(ip string, subNets []string) (bool, error) {
+// ErrInvalidAddress is returned when address could not be parsed as ip address
+var ErrInvalidAddress = errors.New("invalid ip address")
+
+// NormalizeIP parses address, that can contain port and zone, as ip address. IPv4-mapped IPv6 addresses are
+// converted to IPv4, so they belong to IPv4 subnets. The following forms are supported:
+// 1.2.3.4, 1.2.3.4:80, ::ffff:1.2.3.4, 2001:db8::1, [2001:db8::1]:80, fe80::1%eth0.
+func NormalizeIP(addr string) (net.IP, error) {
+	host := strings.TrimSpace(addr)
+
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, addr)
+		}
+
+		if rest := host[end+1:]; rest != "" && !isPort(rest) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, addr)
+		}
+
+		host = host[1:end]
+	} else if strings.Count(host, ":") == 1 {
+		// IPv4 address with port
+		i := strings.IndexByte(host, ':')
+		if !isPort(host[i:]) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, addr)
+		}
+
+		host = host[:i]
+	}
+
+	// strip zone of link-local address
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+
+	return ip, nil
+}
+
+// isPort checks if the passed string is port with leading colon
+func isPort(s string) bool {
+	if len(s) < 2 || s[0] != ':' {
+		return false
+	}
+
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseCIDRs parses list of subnets, the single ip address is considered as subnet that contains only this address
+func ParseCIDRs(subNets []string) ([]*net.IPNet, error) {
+	IPNets := make([]*net.IPNet, 0, len(subNets))
 	for _, subNet := range subNets {
+		if !strings.Contains(subNet, "/") {
+			if ip := net.ParseIP(subNet); ip != nil && !strings.Contains(subNet, ":") {
+				subNet += "/32"
+			} else {
+				subNet += "/128"
+			}
+		}
+
 		_, IPNet, err := net.ParseCIDR(subNet)
 		if err != nil {
-			return false, err
+			return nil, err
+		}
+
+		IPNets = append(IPNets, IPNet)
+	}
+
+	return IPNets, nil
+}
+
+// RealIP returns address of client, that is passed by trusted proxies, the same way as nginx realip module does.
+// If remote address is trusted, the addresses are checked from right to left and the first untrusted one
+// is returned. Without recursive search the last address is returned. An unparseable address stops the search
+// and the previous one, that is trusted, is returned instead.
+func RealIP(remoteAddr, forwardedFor string, trustedProxies []*net.IPNet, recursive bool) string {
+	if forwardedFor == "" || forwardedFor == "-" || !ContainsIP(trustedProxies, remoteAddr) {
+		return remoteAddr
+	}
+
+	prev := remoteAddr
+	addrs := strings.Split(forwardedFor, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if addr == "" {
+			continue
+		}
+
+		if _, err := NormalizeIP(addr); err != nil {
+			return prev
 		}
 
-		if IPNet.Contains(net.ParseIP(ip)) {
-			return true, nil
+		if !recursive || i == 0 || !ContainsIP(trustedProxies, addr) {
+			return addr
+		}
+
+		prev = addr
+	}
+
+	return prev
+}
+
+// ContainsIP checks if address belongs to one of subnets, invalid address doesn't belong to them
+func ContainsIP(IPNets []*net.IPNet, addr string) bool {
+	parsedIP, err := NormalizeIP(addr)
+	if err != nil {
+		return false
+	}
+
+	for _, IPNet := range IPNets {
+		if IPNet.Contains(parsedIP) {
+			return true
 		}
 	}
 
-	return false, nil
+	return false
 }
@@ -1,6 +1,7 @@
 package net
 
 import (
+	"errors"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -12,21 +13,118 @@ type IPSuite struct{}
 
 var _ = Suite(&IPSuite{})
 
-func (s IPSuite) TestIsSubnetContainsIP(c *C) {
-	isSubnet, err := IsSubnetContainsIP("30.2.2.1", []string{"30.0.0.0/8", "31.0.0.0/8"})
+func (s IPSuite) TestContainsIP(c *C) {
+	IPNets, err := ParseCIDRs([]string{"30.0.0.0/8", "2001:db8::/32"})
 	c.Assert(err, IsNil)
-	c.Assert(isSubnet, Equals, true)
 
-	isSubnet, err = IsSubnetContainsIP("32.2.2.1", []string{"30.0.0.0/8", "31.0.0.0/8"})
+	c.Assert(ContainsIP(IPNets, "30.2.2.1"), Equals, true)
+	c.Assert(ContainsIP(IPNets, "[::ffff:30.2.2.1]:8080"), Equals, true)
+	c.Assert(ContainsIP(IPNets, "2001:db8::1"), Equals, true)
+	c.Assert(ContainsIP(IPNets, "31.2.2.1"), Equals, false)
+	c.Assert(ContainsIP(IPNets, "unix:"), Equals, false)
+	c.Assert(ContainsIP(nil, "30.2.2.1"), Equals, false)
+}
+
+func (s IPSuite) TestNormalizeIP(c *C) {
+	for _, tc := range []struct {
+		addr     string
+		expected string
+	}{
+		{addr: "81.2.69.142", expected: "81.2.69.142"},
+		{addr: " 81.2.69.142 ", expected: "81.2.69.142"},
+		{addr: "81.2.69.142:51234", expected: "81.2.69.142"},
+		{addr: "::ffff:81.2.69.142", expected: "81.2.69.142"},
+		{addr: "::ffff:5102:458e", expected: "81.2.69.142"},
+		{addr: "[::ffff:81.2.69.142]:80", expected: "81.2.69.142"},
+		{addr: "2001:db8::1", expected: "2001:db8::1"},
+		{addr: "2001:DB8:0:0:0:0:0:1", expected: "2001:db8::1"},
+		{addr: "[2001:db8::1]", expected: "2001:db8::1"},
+		{addr: "[2001:db8::1]:443", expected: "2001:db8::1"},
+		{addr: "fe80::1%eth0", expected: "fe80::1"},
+		{addr: "[fe80::1%eth0]:8080", expected: "fe80::1"},
+		{addr: "::1", expected: "::1"},
+		{addr: "::", expected: "::"},
+	} {
+		ip, err := NormalizeIP(tc.addr)
+		c.Assert(err, IsNil, Commentf("address %q", tc.addr))
+		c.Assert(ip.String(), Equals, tc.expected, Commentf("address %q", tc.addr))
+	}
+
+	// IPv4 addresses are always in 4-byte form
+	ip, err := NormalizeIP("::ffff:81.2.69.142")
 	c.Assert(err, IsNil)
-	c.Assert(isSubnet, Equals, false)
+	c.Assert(len(ip), Equals, 4)
+
+	for _, addr := range []string{
+		"",
+		"-",
+		"unix:",
+		"unix:/var/run/nginx.sock",
+		"localhost",
+		"81.2.69",
+		"81.2.69.256",
+		"81.2.69.142:",
+		"81.2.69.142:port",
+		"[2001:db8::1",
+		"[2001:db8::1]443",
+		"[2001:db8::1]:",
+		"2001:db8::g",
+		"81.2.69.142, 10.0.0.1",
+	} {
+		ip, err := NormalizeIP(addr)
+		c.Assert(err, NotNil, Commentf("address %q", addr))
+		c.Assert(errors.Is(err, ErrInvalidAddress), Equals, true, Commentf("address %q", addr))
+		c.Assert(ip, IsNil, Commentf("address %q", addr))
+	}
+}
 
-	isSubnet, err = IsSubnetContainsIP("32.2.2.1", []string{})
+func (s IPSuite) TestParseCIDRs(c *C) {
+	IPNets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "2001:db8::1"})
 	c.Assert(err, IsNil)
-	c.Assert(isSubnet, Equals, false)
+	c.Assert(len(IPNets), Equals, 4)
+	c.Assert(IPNets[0].String(), Equals, "10.0.0.0/8")
+	c.Assert(IPNets[1].String(), Equals, "192.168.1.1/32")
+	c.Assert(IPNets[2].String(), Equals, "2001:db8::/32")
+	c.Assert(IPNets[3].String(), Equals, "2001:db8::1/128")
 
-	isSubnet, err = IsSubnetContainsIP("30.3.0.1", []string{"30.0.0.t/8", "31.0.0.0/8"})
+	IPNets, err = ParseCIDRs([]string{"10.0.0.t/8"})
 	c.Assert(err, NotNil)
-	c.Assert(err.Error(), Equals, "invalid CIDR address: 30.0.0.t/8")
-	c.Assert(isSubnet, Equals, false)
+	c.Assert(IPNets, IsNil)
+}
+
+func (s IPSuite) TestRealIP(c *C) {
+	trustedProxies, err := ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	c.Assert(err, IsNil)
+
+	// remote address is not trusted
+	c.Assert(RealIP("81.2.69.142", "1.1.1.1", trustedProxies, true), Equals, "81.2.69.142")
+
+	// there is no forwarded address
+	c.Assert(RealIP("10.0.0.1", "", trustedProxies, true), Equals, "10.0.0.1")
+	c.Assert(RealIP("10.0.0.1", "-", trustedProxies, true), Equals, "10.0.0.1")
+
+	// the last address is taken without recursive search
+	c.Assert(RealIP("10.0.0.1", "81.2.69.142, 10.0.0.2", trustedProxies, false), Equals, "10.0.0.2")
+	c.Assert(RealIP("10.0.0.1", "81.2.69.142", trustedProxies, false), Equals, "81.2.69.142")
+
+	// the first untrusted address from the right is taken with recursive search
+	c.Assert(RealIP("10.0.0.1", "1.1.1.1, 81.2.69.142, 10.0.0.2", trustedProxies, true), Equals, "81.2.69.142")
+	c.Assert(RealIP("10.0.0.1", "1.1.1.1,10.0.0.3,10.0.0.2", trustedProxies, true), Equals, "1.1.1.1")
+	c.Assert(RealIP("2001:db8::1", "2a02:6b8::1, 2001:db8::2", trustedProxies, true), Equals, "2a02:6b8::1")
+
+	// all addresses are trusted, the leftmost is taken
+	c.Assert(RealIP("10.0.0.1", "10.0.0.3, 10.0.0.2", trustedProxies, true), Equals, "10.0.0.3")
+
+	// addresses of trusted proxies are normalized
+	c.Assert(RealIP("::ffff:10.0.0.1", "81.2.69.142", trustedProxies, false), Equals, "81.2.69.142")
+	c.Assert(RealIP("10.0.0.1", "81.2.69.142, 10.0.0.2:8080", trustedProxies, true), Equals, "81.2.69.142")
+	c.Assert(RealIP("[2001:db8::1]:443", "2a02:6b8::1", trustedProxies, true), Equals, "2a02:6b8::1")
+
+	// invalid addresses are never trusted
+	c.Assert(RealIP("unix:", "81.2.69.142", trustedProxies, true), Equals, "unix:")
+
+	// search stops at unparseable address, the last valid one is kept
+	c.Assert(RealIP("10.0.0.1", "81.2.69.142, garbage", trustedProxies, true), Equals, "10.0.0.1")
+	c.Assert(RealIP("10.0.0.1", "81.2.69.142, garbage", trustedProxies, false), Equals, "10.0.0.1")
+	c.Assert(RealIP("10.0.0.1", "81.2.69.142, garbage, 10.0.0.2", trustedProxies, true), Equals, "10.0.0.2")
 }
@@ -0,0 +1,81 @@
+package net
+
+import (
+	"net"
+)
+
+// Trie is a binary prefix tree of subnets, that finds the most specific subnet containing ip address.
+// IPv4 and IPv6 subnets are kept in separate trees, IPv4-mapped IPv6 addresses are looked up among IPv4 subnets.
+type Trie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+// trieNode is a node of prefix tree, the value is set if some subnet ends on this node
+type trieNode struct {
+	children [2]*trieNode
+	value    string
+	hasValue bool
+}
+
+// NewTrie creates new empty prefix tree
+func NewTrie() *Trie {
+	return &Trie{v4: &trieNode{}, v6: &trieNode{}}
+}
+
+// Insert adds subnet with value to the tree, value of the same subnet is replaced. IPv4-mapped IPv6 subnet
+// is added to IPv4 tree with the prefix length of IPv4 address.
+func (t *Trie) Insert(IPNet *net.IPNet, value string) {
+	ones, _ := IPNet.Mask.Size()
+
+	ip, node := t.root(IPNet.IP)
+	if len(ip) == net.IPv4len && len(IPNet.Mask) == net.IPv6len {
+		ones -= 96
+	}
+	for i := 0; i < ones; i++ {
+		bit := bitAt(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+
+	node.value = value
+	node.hasValue = true
+}
+
+// Lookup returns value of the most specific subnet that contains ip address
+func (t *Trie) Lookup(ip net.IP) (string, bool) {
+	if ip == nil {
+		return "", false
+	}
+
+	value, found := "", false
+	ip, node := t.root(ip)
+	for i := 0; node != nil; i++ {
+		if node.hasValue {
+			value, found = node.value, true
+		}
+
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bitAt(ip, i)]
+	}
+
+	return value, found
+}
+
+// root returns ip address in the form of its family and the root of the family tree
+func (t *Trie) root(ip net.IP) (net.IP, *trieNode) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, t.v4
+	}
+
+	return ip.To16(), t.v6
+}
+
+// bitAt returns bit of ip address at position i
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,97 @@
+package net
+
+import (
+	"net"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestTrie(t *testing.T) { TestingT(t) }
+
+type TrieSuite struct{}
+
+var _ = Suite(&TrieSuite{})
+
+func (s TrieSuite) TestLookup(c *C) {
+	trie := NewTrie()
+	for subNet, value := range map[string]string{
+		"10.0.0.0/8":    "datacenter",
+		"10.1.0.0/16":   "office",
+		"10.1.2.3/32":   "monitoring",
+		"2001:db8::/32": "partner",
+		"::/0":          "any_ipv6",
+	} {
+		_, IPNet, err := net.ParseCIDR(subNet)
+		c.Assert(err, IsNil)
+		trie.Insert(IPNet, value)
+	}
+
+	for ip, expected := range map[string]string{
+		"10.2.0.1":           "datacenter",
+		"10.1.1.1":           "office",
+		"10.1.2.3":           "monitoring",
+		"::ffff:10.1.1.1":    "office",
+		"2001:db8:1::1":      "partner",
+		"2a02:6b8::1":        "any_ipv6",
+		"2001:db9::1":        "any_ipv6",
+		"::":                 "any_ipv6",
+		"ffff:ffff::ffff:ff": "any_ipv6",
+	} {
+		value, ok := trie.Lookup(net.ParseIP(ip))
+		c.Assert(ok, Equals, true, Commentf("ip %s", ip))
+		c.Assert(value, Equals, expected, Commentf("ip %s", ip))
+	}
+
+	// IPv4 addresses are not contained in IPv6 subnets
+	value, ok := trie.Lookup(net.ParseIP("11.0.0.1"))
+	c.Assert(ok, Equals, false)
+	c.Assert(value, Equals, "")
+
+	value, ok = trie.Lookup(nil)
+	c.Assert(ok, Equals, false)
+	c.Assert(value, Equals, "")
+}
+
+func (s TrieSuite) TestLookup_NotFound(c *C) {
+	trie := NewTrie()
+
+	value, ok := trie.Lookup(net.ParseIP("10.0.0.1"))
+	c.Assert(ok, Equals, false)
+	c.Assert(value, Equals, "")
+
+	_, IPNet, err := net.ParseCIDR("10.0.0.0/8")
+	c.Assert(err, IsNil)
+	trie.Insert(IPNet, "datacenter")
+
+	value, ok = trie.Lookup(net.ParseIP("11.0.0.1"))
+	c.Assert(ok, Equals, false)
+	c.Assert(value, Equals, "")
+
+	value, ok = trie.Lookup(net.ParseIP("2001:db8::1"))
+	c.Assert(ok, Equals, false)
+	c.Assert(value, Equals, "")
+}
+
+func (s TrieSuite) TestInsert_IPv4Mapped(c *C) {
+	trie := NewTrie()
+
+	IPNets, err := ParseCIDRs([]string{"::ffff:10.0.0.0/104", "::ffff:10.1.2.3"})
+	c.Assert(err, IsNil)
+	trie.Insert(IPNets[0], "datacenter")
+	trie.Insert(IPNets[1], "monitoring")
+
+	for ip, expected := range map[string]string{
+		"10.2.0.1":        "datacenter",
+		"::ffff:10.2.0.1": "datacenter",
+		"10.1.2.3":        "monitoring",
+	} {
+		value, ok := trie.Lookup(net.ParseIP(ip))
+		c.Assert(ok, Equals, true, Commentf("ip %s", ip))
+		c.Assert(value, Equals, expected, Commentf("ip %s", ip))
+	}
+
+	value, ok := trie.Lookup(net.ParseIP("11.0.0.1"))
+	c.Assert(ok, Equals, false)
+	c.Assert(value, Equals, "")
+}
@@ -0,0 +1,181 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Action is an action of relabeling
+type Action string
+
+const (
+	// Replace sets target label to replacement, if concatenated source labels match regex
+	Replace Action = "replace"
+	// Keep drops labels set, if concatenated source labels don't match regex
+	Keep Action = "keep"
+	// Drop drops labels set, if concatenated source labels match regex
+	Drop Action = "drop"
+	// LabelMap copies values of labels, which names match regex, to labels with names built from replacement
+	LabelMap Action = "labelmap"
+	// HashMod sets target label to modulus of hash of concatenated source labels
+	HashMod Action = "hashmod"
+	// Lowercase sets target label to lowercased concatenated source labels
+	Lowercase Action = "lowercase"
+)
+
+var (
+	// labelNameRe matches valid label names
+	labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// targetLabelRe matches target labels with references to regex groups
+	targetLabelRe = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+)
+
+// Config is a relabeling step, it has the same semantics as relabel_configs of Prometheus. Source labels
+// are nginx variables with $ prefix, for example $http_x_forwarded_for, or labels computed by exporter.
+type Config struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       Action   `yaml:"action"`
+
+	// compiled settings
+	regex *regexp.Regexp
+}
+
+// defaultConfig contains default values of settings omitted in config
+var defaultConfig = Config{
+	Separator:   ";",
+	Regex:       "(.*)",
+	Replacement: "$1",
+	Action:      Replace,
+}
+
+// UnmarshalYAML sets default values of omitted settings, so that they could be set to empty values explicitly
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = defaultConfig
+
+	type plain Config
+
+	return unmarshal((*plain)(c))
+}
+
+// Compile checks settings of action and compiles regex, which is anchored on both ends
+func (c *Config) Compile() error {
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q of relabel config: %s", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case Replace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel config with action %q requires target_label", c.Action)
+		}
+		if !targetLabelRe.MatchString(c.TargetLabel) {
+			return fmt.Errorf("%q is invalid target_label of relabel config with action %q", c.TargetLabel, c.Action)
+		}
+	case HashMod, Lowercase:
+		if !labelNameRe.MatchString(c.TargetLabel) {
+			return fmt.Errorf("%q is invalid target_label of relabel config with action %q", c.TargetLabel, c.Action)
+		}
+		if c.Action == HashMod && c.Modulus == 0 {
+			return fmt.Errorf("relabel config with action %q requires non-zero modulus", c.Action)
+		}
+	case Keep, Drop, LabelMap:
+	default:
+		return fmt.Errorf("unknown action %q of relabel config", c.Action)
+	}
+
+	return nil
+}
+
+// TargetLabels returns names of labels, that could be set by relabel configs. Labels set by labelmap action
+// and target labels with references to regex groups are unknown before processing, so they are not returned.
+func TargetLabels(cfgs []*Config) []string {
+	var labels []string
+	for _, c := range cfgs {
+		switch c.Action {
+		case Replace, HashMod, Lowercase:
+			if labelNameRe.MatchString(c.TargetLabel) {
+				labels = append(labels, c.TargetLabel)
+			}
+		}
+	}
+
+	return labels
+}
+
+// Process applies relabel configs to labels in order. It returns false, if labels set is dropped by keep
+// or drop action, then processing is stopped.
+func Process(labels map[string]string, cfgs []*Config) bool {
+	for _, c := range cfgs {
+		if !c.process(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// process applies relabel config to labels
+func (c *Config) process(labels map[string]string) bool {
+	values := make([]string, 0, len(c.SourceLabels))
+	for _, name := range c.SourceLabels {
+		values = append(values, labels[name])
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case Keep:
+		return c.regex.MatchString(value)
+	case Drop:
+		return !c.regex.MatchString(value)
+	case Replace:
+		indexes := c.regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			break
+		}
+
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value, indexes))
+		if !labelNameRe.MatchString(target) {
+			break
+		}
+
+		replacement := string(c.regex.ExpandString(nil, c.Replacement, value, indexes))
+		if replacement == "" {
+			delete(labels, target)
+			break
+		}
+
+		labels[target] = replacement
+	case HashMod:
+		sum := md5.Sum([]byte(value))
+		labels[c.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % c.Modulus)
+	case Lowercase:
+		labels[c.TargetLabel] = strings.ToLower(value)
+	case LabelMap:
+		mapped := make(map[string]string)
+		for name, value := range labels {
+			if !c.regex.MatchString(name) {
+				continue
+			}
+
+			if target := c.regex.ReplaceAllString(name, c.Replacement); labelNameRe.MatchString(target) {
+				mapped[target] = value
+			}
+		}
+
+		for name, value := range mapped {
+			labels[name] = value
+		}
+	}
+
+	return true
+}
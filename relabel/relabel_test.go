@@ -0,0 +1,176 @@
+package relabel
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestRelabel(t *testing.T) { TestingT(t) }
+
+type RelabelSuite struct{}
+
+var _ = Suite(&RelabelSuite{})
+
+// compile parses relabel configs from YAML and compiles them
+func compile(c *C, raw string) []*Config {
+	var cfgs []*Config
+	c.Assert(yaml.Unmarshal([]byte(raw), &cfgs), IsNil)
+
+	for _, cfg := range cfgs {
+		c.Assert(cfg.Compile(), IsNil)
+	}
+
+	return cfgs
+}
+
+func (s RelabelSuite) TestUnmarshalYAML(c *C) {
+	cfgs := compile(c, `
+- target_label: host
+- target_label: uri
+  replacement: ""
+`)
+
+	c.Assert(cfgs[0].Action, Equals, Replace)
+	c.Assert(cfgs[0].Separator, Equals, ";")
+	c.Assert(cfgs[0].Regex, Equals, "(.*)")
+	c.Assert(cfgs[0].Replacement, Equals, "$1")
+
+	// replacement could be set to empty value explicitly
+	c.Assert(cfgs[1].Replacement, Equals, "")
+}
+
+func (s RelabelSuite) TestCompile(c *C) {
+	testCases := []struct {
+		raw string
+		err string
+	}{
+		{raw: `[{regex: "(", target_label: host}]`, err: `invalid regex "\(" of relabel config: .*`},
+		{raw: `[{action: replace}]`, err: `relabel config with action "replace" requires target_label`},
+		{raw: `[{action: replace, target_label: "1host"}]`, err: `"1host" is invalid target_label of relabel config with action "replace"`},
+		{raw: `[{action: lowercase, target_label: "${1}"}]`, err: `"\$\{1\}" is invalid target_label of relabel config with action "lowercase"`},
+		{raw: `[{action: hashmod, target_label: shard}]`, err: `relabel config with action "hashmod" requires non-zero modulus`},
+		{raw: `[{action: uppercase, target_label: host}]`, err: `unknown action "uppercase" of relabel config`},
+		{raw: `[{action: replace, target_label: "${1}_host"}]`},
+		{raw: `[{action: drop, source_labels: [uri]}]`},
+	}
+
+	for _, tc := range testCases {
+		var cfgs []*Config
+		c.Assert(yaml.Unmarshal([]byte(tc.raw), &cfgs), IsNil)
+
+		err := cfgs[0].Compile()
+		if tc.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, tc.err)
+		}
+	}
+}
+
+func (s RelabelSuite) TestProcess(c *C) {
+	testCases := []struct {
+		raw      string
+		labels   map[string]string
+		expected map[string]string
+		dropped  bool
+	}{
+		// replace with concatenated source labels
+		{
+			raw: `
+- source_labels: [$scheme, host]
+  regex: "(https?);(.*)"
+  target_label: origin
+  replacement: "$1://$2"
+`,
+			labels:   map[string]string{"$scheme": "https", "host": "site.com"},
+			expected: map[string]string{"$scheme": "https", "host": "site.com", "origin": "https://site.com"},
+		},
+		// replace is skipped, if regex doesn't match, regex is anchored
+		{
+			raw:      `[{source_labels: [host], regex: "site", target_label: host, replacement: other}]`,
+			labels:   map[string]string{"host": "www.site.com"},
+			expected: map[string]string{"host": "www.site.com"},
+		},
+		// empty replacement deletes target label
+		{
+			raw:      `[{source_labels: [uri], regex: "/health.*", target_label: uri, replacement: ""}]`,
+			labels:   map[string]string{"uri": "/health/live"},
+			expected: map[string]string{},
+		},
+		// target label with reference to regex group
+		{
+			raw:      `[{source_labels: [$upstream], regex: "(\\w+):(.*)", target_label: "${1}_upstream", replacement: "$2"}]`,
+			labels:   map[string]string{"$upstream": "backend:8080"},
+			expected: map[string]string{"$upstream": "backend:8080", "backend_upstream": "8080"},
+		},
+		// keep
+		{
+			raw:     `[{source_labels: [code], regex: "5..", action: keep}]`,
+			labels:  map[string]string{"code": "200"},
+			dropped: true,
+		},
+		{
+			raw:      `[{source_labels: [code], regex: "5..", action: keep}]`,
+			labels:   map[string]string{"code": "503"},
+			expected: map[string]string{"code": "503"},
+		},
+		// drop stops processing
+		{
+			raw: `
+- source_labels: [user_agent]
+  regex: "kube-probe.*"
+  action: drop
+- target_label: probe
+  replacement: "false"
+`,
+			labels:  map[string]string{"user_agent": "kube-probe/1.28"},
+			dropped: true,
+		},
+		// labelmap copies nginx variables to labels
+		{
+			raw:      `[{regex: "\\$http_x_(.+)", action: labelmap}]`,
+			labels:   map[string]string{"$http_x_tenant": "team1", "$host": "site.com"},
+			expected: map[string]string{"$http_x_tenant": "team1", "$host": "site.com", "tenant": "team1"},
+		},
+		// hashmod
+		{
+			raw:      `[{source_labels: [host], modulus: 8, target_label: shard, action: hashmod}]`,
+			labels:   map[string]string{"host": "site.com"},
+			expected: map[string]string{"host": "site.com", "shard": "0"},
+		},
+		// lowercase
+		{
+			raw:      `[{source_labels: [$request_method], target_label: method, action: lowercase}]`,
+			labels:   map[string]string{"$request_method": "GET"},
+			expected: map[string]string{"$request_method": "GET", "method": "get"},
+		},
+	}
+
+	for _, tc := range testCases {
+		ok := Process(tc.labels, compile(c, tc.raw))
+		c.Assert(ok, Equals, !tc.dropped, Commentf("%s", tc.raw))
+		if ok {
+			c.Assert(tc.labels, DeepEquals, tc.expected, Commentf("%s", tc.raw))
+		}
+	}
+}
+
+func (s RelabelSuite) TestTargetLabels(c *C) {
+	cfgs := compile(c, `
+- target_label: tenant
+- target_label: "${1}_upstream"
+- regex: "\\$http_x_(.+)"
+  action: labelmap
+- source_labels: [host]
+  modulus: 4
+  target_label: shard
+  action: hashmod
+- source_labels: [code]
+  action: drop
+`)
+
+	c.Assert(TargetLabels(cfgs), DeepEquals, []string{"tenant", "shard"})
+}
@@ -0,0 +1,106 @@
+package sampling
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile is a file, that is rotated when its size exceeds limit. Rotated files are renamed to path.1,
+// path.2 and so on, files older than maxBackups are removed.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens file for appending, it is created if it doesn't exist
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write writes data to file rotating it first, if data doesn't fit in limit. Data larger than limit is written
+// to empty file.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close closes file
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+// open opens file with flag in addition to write and create flags
+func (f *rotatingFile) open(flag int) error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	f.file, f.size = file, info.Size()
+
+	return nil
+}
+
+// rotate shifts backups removing the oldest one and reopens empty file. The current file is reopened, if it could
+// not be rotated, so rotation is retried by the next write.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		err = f.shiftBackups()
+	}
+	if err != nil {
+		if openErr := f.open(os.O_APPEND); openErr != nil {
+			return openErr
+		}
+
+		return err
+	}
+
+	return f.open(os.O_TRUNC)
+}
+
+// shiftBackups renames file and its backups to the next numbers, file is removed, if backups are not kept
+func (f *rotatingFile) shiftBackups() error {
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for i := f.maxBackups; i > 0; i-- {
+		src := f.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", f.path, i-1)
+		}
+
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", f.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
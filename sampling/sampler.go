@@ -0,0 +1,171 @@
+package sampling
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exporter"
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/pkg/logging"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// reasons of sampling
+	reasonServerError = "server_error"
+	reasonSlow        = "slow"
+
+	// results of writing of sampled lines
+	resultWritten     = "written"
+	resultRateLimited = "rate_limited"
+	resultFailed      = "failed"
+
+	// maxHosts limits number of hosts with own rate limits, the least recently seen hosts are forgotten
+	maxHosts = 1000
+
+	bytesInMB = 1 << 20
+)
+
+// Record is a sampled log line written as JSON
+type Record struct {
+	Time         time.Time         `json:"time"`
+	Reason       string            `json:"reason"`
+	NginxHost    string            `json:"nginx_host"`
+	Host         string            `json:"host"`
+	URI          string            `json:"uri"`
+	Method       string            `json:"method"`
+	Code         string            `json:"code"`
+	ResponseTime float64           `json:"response_time"`
+	Line         string            `json:"line"`
+	Fields       map[string]string `json:"fields"`
+}
+
+// Sampler writes log lines of slow and failed requests, number of lines is limited by host label
+type Sampler struct {
+	cfg     *config.Sampling
+	counter *exposer.Counter
+
+	// now is the clock of rate limit buckets and written timestamps, tests set it to refill buckets
+	now func() time.Time
+
+	// mu guards buckets only, so requests are not rate limited while sampled line is written under outMu
+	mu      sync.Mutex
+	buckets *simplelru.LRU
+
+	outMu sync.Mutex
+	out   io.Writer
+}
+
+// bucket is a token bucket of host, tokens are refilled with rate limit up to burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewSampler creates sampler writing to output of settings, lines are counted by counter with reason and result labels
+func NewSampler(cfg *config.Sampling, counter *exposer.Counter) (*Sampler, error) {
+	buckets, err := simplelru.NewLRU(maxHosts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.Output != config.SamplingOutputStdout {
+		if out, err = openRotatingFile(cfg.Output, int64(cfg.MaxSizeMB)*bytesInMB, *cfg.MaxBackups); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Sampler{cfg: cfg, counter: counter, now: time.Now, out: out, buckets: buckets}, nil
+}
+
+// Close closes output file
+func (s *Sampler) Close() error {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+
+	if closer, ok := s.out.(io.Closer); ok && s.out != os.Stdout {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// ObserveRequest writes request, if it fails with 5xx code or is slower than latency threshold of its uri label
+func (s *Sampler) ObserveRequest(request *exporter.Request) {
+	var reason string
+	switch threshold := s.cfg.LatencyThreshold(request.URI); {
+	case len(request.Code) == 3 && request.Code[0] == '5':
+		reason = reasonServerError
+	case threshold > 0 && request.ResponseTime > threshold.Seconds():
+		reason = reasonSlow
+	default:
+		return
+	}
+
+	now := s.now()
+
+	s.mu.Lock()
+	allowed := s.allow(request.Host, now)
+	s.mu.Unlock()
+
+	if !allowed {
+		s.counter.Inc(reason, resultRateLimited)
+
+		return
+	}
+
+	raw, err := json.Marshal(Record{
+		Time:         now,
+		Reason:       reason,
+		NginxHost:    request.NginxHost,
+		Host:         request.Host,
+		URI:          request.URI,
+		Method:       request.Method,
+		Code:         request.Code,
+		ResponseTime: request.ResponseTime,
+		Line:         request.Content,
+		Fields:       request.Data,
+	})
+	if err == nil {
+		s.outMu.Lock()
+		_, err = s.out.Write(append(raw, '\n'))
+		s.outMu.Unlock()
+	}
+	if err != nil {
+		logging.WithContext(context.Background()).Sugar().Errorf("could not write sampled line: %s", err)
+		s.counter.Inc(reason, resultFailed)
+
+		return
+	}
+
+	s.counter.Inc(reason, resultWritten)
+}
+
+// allow takes token of host, if bucket of host is not empty
+func (s *Sampler) allow(host string, now time.Time) bool {
+	var b *bucket
+	if value, ok := s.buckets.Get(host); ok {
+		b = value.(*bucket)
+	} else {
+		b = &bucket{tokens: float64(s.cfg.Burst), last: now}
+		s.buckets.Add(host, b)
+	}
+
+	b.tokens = math.Min(float64(s.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*s.cfg.RateLimit)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
@@ -0,0 +1,218 @@
+package sampling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/config"
+	"github.com/ozonru/accesslog-exporter/exporter"
+	"github.com/ozonru/accesslog-exporter/exposer"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestSampling(t *testing.T) { TestingT(t) }
+
+type SamplingSuite struct{}
+
+var _ = Suite(&SamplingSuite{})
+
+// newSampler creates sampler writing to buffer and counting lines to returned gatherer, the clock is set to now
+func newSampler(c *C, cfg *config.Sampling, now *time.Time) (*Sampler, *bytes.Buffer, prometheus.Gatherer) {
+	counter, gatherer, err := exposer.NewDummyCounter(exposer.SampledLinesTotal, exposer.MetricsOptions{})
+	c.Assert(err, IsNil)
+
+	sampler, err := NewSampler(cfg, counter)
+	c.Assert(err, IsNil)
+
+	out := &bytes.Buffer{}
+	sampler.out = out
+	sampler.now = func() time.Time { return *now }
+
+	return sampler, out, gatherer
+}
+
+// sampled returns values of sampled lines counter by reason and result
+func sampled(c *C, gatherer prometheus.Gatherer) map[string]float64 {
+	values, err := exposer.GatherValues(gatherer, exposer.SampledLinesTotal)
+	c.Assert(err, IsNil)
+
+	return values
+}
+
+// records decodes written records
+func records(c *C, out *bytes.Buffer) []Record {
+	var result []Record
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var record Record
+		c.Assert(json.Unmarshal([]byte(line), &record), IsNil)
+		result = append(result, record)
+	}
+
+	return result
+}
+
+func (s SamplingSuite) TestObserveRequest(c *C) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sampler, out, gatherer := newSampler(c, &config.Sampling{
+		Output:                  config.SamplingOutputStdout,
+		LatencyThresholds:       map[string]time.Duration{"search": 300 * time.Millisecond},
+		DefaultLatencyThreshold: time.Second,
+		RateLimit:               10,
+		Burst:                   10,
+	}, &now)
+
+	data := map[string]string{"$request": "GET /search?q=1 HTTP/1.1", "$status": "200", "$request_time": "0.5"}
+	sampler.ObserveRequest(&exporter.Request{
+		NginxHost:    "localhost",
+		Host:         "example.com",
+		URI:          "search",
+		Method:       "GET",
+		Code:         "200",
+		ResponseTime: 0.5,
+		Content:      "raw line",
+		Data:         data,
+	})
+	// fast request and request slower than threshold of other uri are not sampled
+	sampler.ObserveRequest(&exporter.Request{Host: "example.com", URI: "search", Code: "200", ResponseTime: 0.1})
+	sampler.ObserveRequest(&exporter.Request{Host: "example.com", URI: "cart", Code: "200", ResponseTime: 0.5})
+	sampler.ObserveRequest(&exporter.Request{Host: "example.com", URI: "cart", Code: "502", ResponseTime: 0.1})
+
+	c.Assert(records(c, out), DeepEquals, []Record{
+		{
+			Time:         now,
+			Reason:       "slow",
+			NginxHost:    "localhost",
+			Host:         "example.com",
+			URI:          "search",
+			Method:       "GET",
+			Code:         "200",
+			ResponseTime: 0.5,
+			Line:         "raw line",
+			Fields:       data,
+		},
+		{Time: now, Reason: "server_error", Host: "example.com", URI: "cart", Code: "502", ResponseTime: 0.1},
+	})
+	c.Assert(sampled(c, gatherer), DeepEquals, map[string]float64{"slow,written": 1, "server_error,written": 1})
+}
+
+func (s SamplingSuite) TestRateLimit(c *C) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sampler, out, gatherer := newSampler(c, &config.Sampling{
+		Output:    config.SamplingOutputStdout,
+		RateLimit: 2,
+		Burst:     3,
+	}, &now)
+
+	failed := func(host string) *exporter.Request {
+		return &exporter.Request{Host: host, Code: "500"}
+	}
+
+	// burst is written at once, other lines are dropped until bucket is refilled
+	for i := 0; i < 5; i++ {
+		sampler.ObserveRequest(failed("a.example.com"))
+	}
+	// hosts are limited separately
+	sampler.ObserveRequest(failed("b.example.com"))
+	c.Assert(records(c, out), HasLen, 4)
+
+	now = now.Add(time.Second)
+	out.Reset()
+	for i := 0; i < 5; i++ {
+		sampler.ObserveRequest(failed("a.example.com"))
+	}
+	c.Assert(records(c, out), HasLen, 2)
+	c.Assert(sampled(c, gatherer), DeepEquals, map[string]float64{"server_error,written": 6, "server_error,rate_limited": 5})
+}
+
+func (s SamplingSuite) TestRotatingFile(c *C) {
+	path := filepath.Join(c.MkDir(), "samples.log")
+
+	f, err := openRotatingFile(path, 10, 2)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 4; i++ {
+		_, err := f.Write([]byte(fmt.Sprintf("line %d\n", i)))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	// every line exceeds limit with the previous one, the oldest backup is removed
+	for name, content := range map[string]string{"samples.log": "line 3\n", "samples.log.1": "line 2\n", "samples.log.2": "line 1\n"} {
+		raw, err := ioutil.ReadFile(filepath.Join(filepath.Dir(path), name))
+		c.Assert(err, IsNil)
+		c.Assert(string(raw), Equals, content)
+	}
+	matches, err := filepath.Glob(path + "*")
+	c.Assert(err, IsNil)
+	c.Assert(matches, HasLen, 3)
+
+	// size of existing file is taken into account
+	f, err = openRotatingFile(path, 20, 2)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("line 4\n"))
+	c.Assert(err, IsNil)
+	c.Assert(f.size, Equals, int64(14))
+	c.Assert(f.Close(), IsNil)
+}
+
+func (s SamplingSuite) TestRotatingFile_WithoutBackups(c *C) {
+	path := filepath.Join(c.MkDir(), "samples.log")
+
+	f, err := openRotatingFile(path, 10, 0)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		_, err := f.Write([]byte(fmt.Sprintf("line %d\n", i)))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	raw, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(raw), Equals, "line 1\n")
+
+	matches, err := filepath.Glob(path + "*")
+	c.Assert(err, IsNil)
+	c.Assert(matches, HasLen, 1)
+}
+
+func (s SamplingSuite) TestRotatingFile_RenameFailure(c *C) {
+	path := filepath.Join(c.MkDir(), "samples.log")
+
+	f, err := openRotatingFile(path, 10, 1)
+	c.Assert(err, IsNil)
+
+	_, err = f.Write([]byte("line 0\n"))
+	c.Assert(err, IsNil)
+
+	// file could not be renamed to non-empty directory
+	c.Assert(os.MkdirAll(filepath.Join(path+".1", "dir"), 0755), IsNil)
+	_, err = f.Write([]byte("line 1\n"))
+	c.Assert(err, NotNil)
+
+	// file is reopened, so rotation succeeds, when backup could be written
+	c.Assert(os.RemoveAll(path+".1"), IsNil)
+	_, err = f.Write([]byte("line 2\n"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	for name, content := range map[string]string{"samples.log": "line 2\n", "samples.log.1": "line 0\n"} {
+		raw, err := ioutil.ReadFile(filepath.Join(filepath.Dir(path), name))
+		c.Assert(err, IsNil)
+		c.Assert(string(raw), Equals, content)
+	}
+}
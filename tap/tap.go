@@ -0,0 +1,212 @@
+package tap
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/exporter"
+	"github.com/ozonru/accesslog-exporter/expr"
+)
+
+// Record is a parsed log line with labels detected by exporter
+type Record struct {
+	Time         time.Time         `json:"time"`
+	NginxHost    string            `json:"nginx_host"`
+	Host         string            `json:"host"`
+	URI          string            `json:"uri"`
+	Method       string            `json:"method"`
+	Code         string            `json:"code"`
+	ClientIP     string            `json:"client_ip"`
+	UserAgent    string            `json:"user_agent"`
+	OS           string            `json:"os"`
+	Device       string            `json:"device"`
+	DeviceType   string            `json:"device_type"`
+	ResponseTime float64           `json:"response_time"`
+	Variables    map[string]string `json:"variables"`
+}
+
+// subscriber is a client streaming records of source matching filter, empty source matches all sources
+type subscriber struct {
+	source  string
+	filter  *expr.Expression
+	records chan []byte
+}
+
+// Tap streams parsed log lines to subscribers. Records are dropped, when buffer of subscriber is full, so slow
+// subscribers don't slow down processing of log lines.
+type Tap struct {
+	bufferSize     int
+	idleTimeout    time.Duration
+	maxSubscribers int
+
+	// now stamps streamed records, tests set it to get stable output
+	now func() time.Time
+
+	// active is a number of subscribers, requests are not checked without them
+	active      int32
+	mu          sync.RWMutex
+	subscribers map[*subscriber]struct{}
+}
+
+// NewTap creates tap with buffer of bufferSize records by subscriber. Stream is closed, if no record was written
+// to it in idle timeout.
+func NewTap(bufferSize int, idleTimeout time.Duration, maxSubscribers int) *Tap {
+	return &Tap{
+		bufferSize:     bufferSize,
+		idleTimeout:    idleTimeout,
+		maxSubscribers: maxSubscribers,
+		now:            time.Now,
+		subscribers:    make(map[*subscriber]struct{}),
+	}
+}
+
+// ObserveRequest sends record of request to subscribers of its source, which filter matches variables of request
+func (t *Tap) ObserveRequest(request *exporter.Request) {
+	if atomic.LoadInt32(&t.active) == 0 {
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var raw []byte
+	for s := range t.subscribers {
+		if s.source != "" && s.source != request.NginxHost {
+			continue
+		}
+		if s.filter != nil {
+			if match, err := s.filter.EvalBool(request.Data); err != nil || !match {
+				continue
+			}
+		}
+
+		if raw == nil {
+			var err error
+			if raw, err = json.Marshal(t.record(request)); err != nil {
+				return
+			}
+		}
+
+		select {
+		case s.records <- raw:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams records as NDJSON or as server-sent events, if format parameter is sse or client accepts
+// them. Records are selected by source(nginx host) and filter(expression over variables) parameters.
+func (t *Tap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s := &subscriber{source: query.Get("source"), records: make(chan []byte, t.bufferSize)}
+	if filter := query.Get("filter"); filter != "" {
+		expression, err := expr.Compile(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		s.filter = expression
+	}
+
+	if !t.subscribe(s) {
+		http.Error(w, "too many subscribers", http.StatusServiceUnavailable)
+
+		return
+	}
+	defer t.unsubscribe(s)
+
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	idle := time.NewTimer(t.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-idle.C:
+			return
+		case raw := <-s.records:
+			// client, that doesn't read stream, is disconnected
+			_ = controller.SetWriteDeadline(time.Now().Add(t.idleTimeout))
+
+			var err error
+			if sse {
+				_, err = w.Write([]byte("data: " + string(raw) + "\n\n"))
+			} else {
+				_, err = w.Write(append(raw, '\n'))
+			}
+			if err != nil || controller.Flush() != nil {
+				return
+			}
+
+			idle.Reset(t.idleTimeout)
+		}
+	}
+}
+
+// subscribe adds subscriber, if number of subscribers doesn't exceed limit
+func (t *Tap) subscribe(s *subscriber) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.subscribers) >= t.maxSubscribers {
+		return false
+	}
+
+	t.subscribers[s] = struct{}{}
+	atomic.AddInt32(&t.active, 1)
+
+	return true
+}
+
+// unsubscribe removes subscriber
+func (t *Tap) unsubscribe(s *subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.subscribers, s)
+	atomic.AddInt32(&t.active, -1)
+}
+
+// record creates record of request
+func (t *Tap) record(request *exporter.Request) Record {
+	var clientIP string
+	if request.ClientIP != nil {
+		clientIP = request.ClientIP.String()
+	}
+
+	return Record{
+		Time:         t.now(),
+		NginxHost:    request.NginxHost,
+		Host:         request.Host,
+		URI:          request.URI,
+		Method:       request.Method,
+		Code:         request.Code,
+		ClientIP:     clientIP,
+		UserAgent:    request.UserAgentLabel,
+		OS:           request.OSLabel,
+		Device:       request.DeviceLabel,
+		DeviceType:   request.DeviceType,
+		ResponseTime: request.ResponseTime,
+		Variables:    request.Data,
+	}
+}
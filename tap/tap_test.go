@@ -0,0 +1,159 @@
+package tap
+
+import (
+	"bufio"
+	"encoding/json"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/exporter"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestTap(t *testing.T) { TestingT(t) }
+
+type TapSuite struct{}
+
+var _ = Suite(&TapSuite{})
+
+// stream subscribes to tap and waits until subscriber is added
+func stream(c *C, tap *Tap, server *httptest.Server, query url.Values, header http.Header) *http.Response {
+	active := atomic.LoadInt32(&tap.active)
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/debug/tap?"+query.Encode(), nil)
+	c.Assert(err, IsNil)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+
+	if response.StatusCode == http.StatusOK {
+		for atomic.LoadInt32(&tap.active) == active {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return response
+}
+
+func (s TapSuite) TestStream(c *C) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tap := NewTap(10, time.Minute, 10)
+	tap.now = func() time.Time { return now }
+
+	server := httptest.NewServer(tap)
+	defer server.Close()
+
+	response := stream(c, tap, server, url.Values{"source": {"backend"}, "filter": {`$status >= 500`}}, nil)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Content-Type"), Equals, "application/x-ndjson")
+
+	failed := &exporter.Request{
+		NginxHost:      "backend",
+		Host:           "example.com",
+		URI:            "search",
+		Method:         "GET",
+		Code:           "502",
+		ClientIP:       stdnet.ParseIP("10.0.0.1").To4(),
+		ResponseTime:   0.5,
+		UserAgentLabel: "Chrome",
+		OSLabel:        "Linux",
+		DeviceLabel:    "Other",
+		DeviceType:     "desktop",
+		Data:           map[string]string{"$status": "502"},
+	}
+	// requests of other sources and requests not matching filter are not streamed
+	tap.ObserveRequest(&exporter.Request{NginxHost: "frontend", Data: map[string]string{"$status": "502"}})
+	tap.ObserveRequest(&exporter.Request{NginxHost: "backend", Data: map[string]string{"$status": "200"}})
+	tap.ObserveRequest(failed)
+
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+	c.Assert(err, IsNil)
+
+	var record Record
+	c.Assert(json.Unmarshal([]byte(line), &record), IsNil)
+	c.Assert(record, DeepEquals, Record{
+		Time:         now,
+		NginxHost:    "backend",
+		Host:         "example.com",
+		URI:          "search",
+		Method:       "GET",
+		Code:         "502",
+		ClientIP:     "10.0.0.1",
+		UserAgent:    "Chrome",
+		OS:           "Linux",
+		Device:       "Other",
+		DeviceType:   "desktop",
+		ResponseTime: 0.5,
+		Variables:    map[string]string{"$status": "502"},
+	})
+}
+
+func (s TapSuite) TestServerSentEvents(c *C) {
+	tap := NewTap(10, time.Minute, 10)
+
+	server := httptest.NewServer(tap)
+	defer server.Close()
+
+	response := stream(c, tap, server, url.Values{}, http.Header{"Accept": {"text/event-stream"}})
+	defer response.Body.Close()
+	c.Assert(response.Header.Get("Content-Type"), Equals, "text/event-stream")
+
+	tap.ObserveRequest(&exporter.Request{NginxHost: "backend"})
+
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(line, `data: {"time":`), Equals, true)
+
+	line, err = reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "\n")
+}
+
+func (s TapSuite) TestLimits(c *C) {
+	tap := NewTap(1, 100*time.Millisecond, 1)
+
+	server := httptest.NewServer(tap)
+	defer server.Close()
+
+	// invalid filter is rejected
+	response := stream(c, tap, server, url.Values{"filter": {`$status >`}}, nil)
+	c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(response.Body.Close(), IsNil)
+
+	first := stream(c, tap, server, url.Values{}, nil)
+	defer first.Body.Close()
+
+	// number of subscribers is limited
+	response = stream(c, tap, server, url.Values{}, nil)
+	c.Assert(response.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(response.Body.Close(), IsNil)
+
+	// records exceeding buffer are dropped without blocking
+	for i := 0; i < 100; i++ {
+		tap.ObserveRequest(&exporter.Request{NginxHost: "backend"})
+	}
+
+	// stream is closed, when no record is written in idle timeout
+	scanner := bufio.NewScanner(first.Body)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	c.Assert(lines >= 1 && lines <= 2, Equals, true, Commentf("%d lines", lines))
+
+	for atomic.LoadInt32(&tap.active) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,114 @@
+package topk
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Item is a value of dimension with its estimated count, count is overestimated by error at most
+type Item struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// sketch is a Space-Saving sketch, that keeps counters of capacity most frequent values. When there is no free
+// counter, the value replaces the least frequent one and inherits its count as error. Items are kept
+// in min-heap by count.
+type sketch struct {
+	capacity int
+	items    []Item
+	indexes  map[string]int
+}
+
+// newSketch creates empty sketch
+func newSketch(capacity int) *sketch {
+	return &sketch{capacity: capacity, indexes: make(map[string]int, capacity)}
+}
+
+// add counts value
+func (s *sketch) add(value string, count uint64) {
+	if i, ok := s.indexes[value]; ok {
+		s.items[i].Count += count
+		heap.Fix(s, i)
+
+		return
+	}
+
+	if len(s.items) < s.capacity {
+		heap.Push(s, Item{Value: value, Count: count})
+
+		return
+	}
+
+	// the least frequent value is replaced
+	min := s.items[0]
+	delete(s.indexes, min.Value)
+	s.items[0] = Item{Value: value, Count: min.Count + count, Error: min.Count}
+	s.indexes[value] = 0
+	heap.Fix(s, 0)
+}
+
+// reset removes all counters
+func (s *sketch) reset() {
+	s.items = nil
+	s.indexes = make(map[string]int, s.capacity)
+}
+
+func (s *sketch) Len() int { return len(s.items) }
+
+func (s *sketch) Less(i, j int) bool { return s.items[i].Count < s.items[j].Count }
+
+func (s *sketch) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.indexes[s.items[i].Value] = i
+	s.indexes[s.items[j].Value] = j
+}
+
+func (s *sketch) Push(x interface{}) {
+	item := x.(Item)
+	s.indexes[item.Value] = len(s.items)
+	s.items = append(s.items, item)
+}
+
+func (s *sketch) Pop() interface{} {
+	item := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	delete(s.indexes, item.Value)
+
+	return item
+}
+
+// merge merges items of sketches summing counts and errors of the same values, items are sorted by count
+// in descending order
+func merge(sketches []*sketch) []Item {
+	merged := make(map[string]*Item)
+	for _, s := range sketches {
+		for _, item := range s.items {
+			if m, ok := merged[item.Value]; ok {
+				m.Count += item.Count
+				m.Error += item.Error
+
+				continue
+			}
+
+			item := item
+			merged[item.Value] = &item
+		}
+	}
+
+	items := make([]Item, 0, len(merged))
+	for _, item := range merged {
+		items = append(items, *item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+
+		return items[i].Value < items[j].Value
+	})
+
+	return items
+}
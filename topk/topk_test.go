@@ -0,0 +1,133 @@
+package topk
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/expr"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestTopK(t *testing.T) { TestingT(t) }
+
+type TopKSuite struct{}
+
+var _ = Suite(&TopKSuite{})
+
+func (s TopKSuite) TestSketch(c *C) {
+	sk := newSketch(3)
+	for value, count := range map[string]uint64{"a": 10, "b": 5, "c": 3} {
+		sk.add(value, count)
+	}
+	sk.add("a", 1)
+
+	// counts are exact until capacity is exceeded
+	c.Assert(merge([]*sketch{sk}), DeepEquals, []Item{
+		{Value: "a", Count: 11},
+		{Value: "b", Count: 5},
+		{Value: "c", Count: 3},
+	})
+
+	// new value replaces the least frequent one inheriting its count as error
+	sk.add("d", 1)
+	c.Assert(merge([]*sketch{sk}), DeepEquals, []Item{
+		{Value: "a", Count: 11},
+		{Value: "b", Count: 5},
+		{Value: "d", Count: 4, Error: 3},
+	})
+
+	// heavy hitter is not lost among many rare values
+	sk.reset()
+	for i := 0; i < 1000; i++ {
+		sk.add("heavy", 1)
+		sk.add(string(rune('A'+i%50)), 1)
+	}
+	c.Assert(merge([]*sketch{sk})[0].Value, Equals, "heavy")
+	c.Assert(merge([]*sketch{sk})[0].Count, Equals, uint64(1000))
+}
+
+func (s TopKSuite) TestTracker(c *C) {
+	tracker := NewTracker([]Dimension{
+		{Name: "ip", Value: expr.MustCompile(`$remote_addr`)},
+		{Name: "path", Value: expr.MustCompile(`split(split($request, " ")[1], "?")[0]`)},
+	}, 10, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.1", "$request": "GET /search?q=1 HTTP/1.1"})
+	}
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.2", "$request": "GET /cart HTTP/1.1"})
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "-"})
+
+	c.Assert(tracker.Top(1), DeepEquals, map[string][]Item{
+		"ip":   {{Value: "10.0.0.1", Count: 3}},
+		"path": {{Value: "/search", Count: 3}},
+	})
+
+	// values are counted in all slots of window
+	tracker.rotate()
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.2", "$request": "GET /cart HTTP/1.1"})
+	c.Assert(tracker.Top(10)["ip"], DeepEquals, []Item{{Value: "10.0.0.1", Count: 3}, {Value: "10.0.0.2", Count: 2}})
+
+	// values of slot are forgotten, when window slides over it
+	for i := 0; i < slots-1; i++ {
+		tracker.rotate()
+	}
+	c.Assert(tracker.Top(10)["ip"], DeepEquals, []Item{{Value: "10.0.0.2", Count: 1}})
+}
+
+func (s TopKSuite) TestExport(c *C) {
+	gauge, gatherer, err := exposer.NewDummyGauge(exposer.TopKRequests, exposer.MetricsOptions{SourceLabels: []string{"team"}})
+	c.Assert(err, IsNil)
+
+	tracker := NewTracker([]Dimension{{Name: "ip", Value: expr.MustCompile(`$remote_addr`)}}, 10, time.Minute)
+
+	series := func() map[string]float64 {
+		values, err := exposer.GatherValues(gatherer, exposer.TopKRequests)
+		c.Assert(err, IsNil)
+
+		return values
+	}
+
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.1"})
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.1"})
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.2"})
+	tracker.export(gauge, 1)
+	c.Assert(series(), DeepEquals, map[string]float64{"ip,10.0.0.1": 2})
+
+	// series of values, that are not in top anymore, are removed
+	for i := 0; i < slots; i++ {
+		tracker.rotate()
+	}
+	tracker.Observe("localhost", map[string]string{"$remote_addr": "10.0.0.3"})
+	tracker.export(gauge, 1)
+	c.Assert(series(), DeepEquals, map[string]float64{"ip,10.0.0.3": 1})
+}
+
+func (s TopKSuite) TestServeHTTP(c *C) {
+	tracker := NewTracker([]Dimension{{Name: "ua", Value: expr.MustCompile(`$http_user_agent`)}}, 10, time.Minute)
+	tracker.Observe("localhost", map[string]string{"$http_user_agent": "curl/8.0"})
+	tracker.Observe("localhost", map[string]string{"$http_user_agent": "Mozilla/5.0"})
+	tracker.Observe("localhost", map[string]string{"$http_user_agent": "curl/8.0"})
+
+	recorder := httptest.NewRecorder()
+	tracker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/topk?n=1", nil))
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), Equals, "application/json")
+
+	var response struct {
+		Window     string            `json:"window"`
+		Dimensions map[string][]Item `json:"dimensions"`
+	}
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &response), IsNil)
+	c.Assert(response.Window, Equals, "1m0s")
+	c.Assert(response.Dimensions, DeepEquals, map[string][]Item{"ua": {{Value: "curl/8.0", Count: 2}}})
+
+	recorder = httptest.NewRecorder()
+	tracker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/topk?n=abc", nil))
+	c.Assert(recorder.Code, Equals, http.StatusBadRequest)
+}
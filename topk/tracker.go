@@ -0,0 +1,147 @@
+package topk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ozonru/accesslog-exporter/exposer"
+	"github.com/ozonru/accesslog-exporter/expr"
+)
+
+const (
+	// slots is a number of sketches of sliding window, the oldest one is reset every window/slots
+	slots = 6
+	// defaultTopN is a default number of values served by endpoint
+	defaultTopN = 10
+)
+
+// Dimension is a dimension of log lines, which most frequent values are tracked
+type Dimension struct {
+	Name  string
+	Value *expr.Expression
+}
+
+// Tracker tracks the most frequent values of dimensions in sliding window
+type Tracker struct {
+	dimensions []Dimension
+	window     time.Duration
+
+	mu sync.Mutex
+	// sketches are sketches of slots by dimension, values are counted by sketch of current slot
+	sketches [][]*sketch
+	current  int
+}
+
+// NewTracker creates tracker with capacity counters of every dimension per slot of window
+func NewTracker(dimensions []Dimension, capacity int, window time.Duration) *Tracker {
+	t := &Tracker{dimensions: dimensions, window: window, sketches: make([][]*sketch, len(dimensions))}
+	for i := range dimensions {
+		for j := 0; j < slots; j++ {
+			t.sketches[i] = append(t.sketches[i], newSketch(capacity))
+		}
+	}
+
+	return t
+}
+
+// Observe counts values of dimensions of log line. Empty values, "-" and values that could not be evaluated
+// are not counted.
+func (t *Tracker) Observe(nginxHost string, data map[string]string) {
+	values := make([]string, len(t.dimensions))
+	for i, dimension := range t.dimensions {
+		values[i], _ = dimension.Value.EvalString(data)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, value := range values {
+		if value != "" && value != "-" {
+			t.sketches[i][t.current].add(value, 1)
+		}
+	}
+}
+
+// Top returns n most frequent values in window by dimension name
+func (t *Tracker) Top(n int) map[string][]Item {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	top := make(map[string][]Item, len(t.dimensions))
+	for i, dimension := range t.dimensions {
+		items := merge(t.sketches[i])
+		if len(items) > n {
+			items = items[:n]
+		}
+		top[dimension.Name] = items
+	}
+
+	return top
+}
+
+// Run slides window, top n values are exported to gauge every window, if gauge is not nil
+func (t *Tracker) Run(ctx context.Context, gauge *exposer.Gauge, n int) {
+	ticker := time.NewTicker(t.window / slots)
+	defer ticker.Stop()
+
+	for tick := 1; ; tick++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if gauge != nil && tick%slots == 0 {
+				t.export(gauge, n)
+			}
+			t.rotate()
+		}
+	}
+}
+
+// rotate makes the oldest slot current resetting its counters
+func (t *Tracker) rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current = (t.current + 1) % slots
+	for i := range t.dimensions {
+		t.sketches[i][t.current].reset()
+	}
+}
+
+// export replaces series of gauge with top n values of dimensions
+func (t *Tracker) export(gauge *exposer.Gauge, n int) {
+	top := t.Top(n)
+
+	gauge.Reset()
+	for _, dimension := range t.dimensions {
+		for _, item := range top[dimension.Name] {
+			gauge.Set(float64(item.Count), dimension.Name, item.Value)
+		}
+	}
+}
+
+// ServeHTTP serves the most frequent values as JSON, number of values by dimension is set by n parameter
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopN
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		var err error
+		if n, err = strconv.Atoi(raw); err != nil || n <= 0 {
+			http.Error(w, "n should be a positive number", http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Window     string            `json:"window"`
+		Dimensions map[string][]Item `json:"dimensions"`
+	}{
+		Window:     t.window.String(),
+		Dimensions: t.Top(n),
+	})
+}